@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/armor"
+	"github.com/rotisserie/eris"
+	"golang.org/x/crypto/ssh"
+)
+
+// passphraseKeyFile holds the data key encrypted with an scrypt passphrase.
+// age requires scrypt recipients to be the only recipient of a file so
+// it is kept apart from dataKeyFile.
+var passphraseKeyFile = ".PASSPHRASE_KEY"
+
+// parseRecipient parses an age X25519 recipient (age1...) or an
+// ssh-ed25519 / ssh-rsa public key as found in ~/.ssh/id_ed25519.pub
+func parseRecipient(s string) (age.Recipient, error) {
+	if strings.HasPrefix(s, "ssh-") {
+		return agessh.ParseRecipient(s)
+	}
+	return age.ParseX25519Recipient(s)
+}
+
+// readSSHRecipient reads an ssh public key from a file such as
+// ~/.ssh/id_ed25519.pub, or accepts the key itself
+func readSSHRecipient(pathOrKey string) (string, error) {
+	line := pathOrKey
+	if !strings.HasPrefix(pathOrKey, "ssh-") {
+		b, err := os.ReadFile(pathOrKey)
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimSpace(string(b))
+	}
+
+	if _, err := agessh.ParseRecipient(line); err != nil {
+		return "", eris.Wrapf(err, "unsupported ssh public key, use ssh-ed25519 or ssh-rsa: %+v", pathOrKey)
+	}
+	return line, nil
+}
+
+// readIdentityFile reads the identities in an age identity file, one
+// AGE-SECRET-KEY per line optionally prefixed as printed by create-keys,
+// or an ssh private key file such as ~/.ssh/id_ed25519.
+//
+// Identity files encrypted with a passphrase, eg with "age -p", are
+// decrypted after prompting for the passphrase.
+func readIdentityFile(path string) ([]age.Identity, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, eris.Wrap(err, "Unable to read identity file")
+	}
+
+	if bytes.HasPrefix(b, []byte(armor.Header)) || isAgeFile(b) {
+		b, err = decryptIdentityFile(b)
+		if err != nil {
+			return nil, eris.Wrapf(err, "Unable to decrypt identity file: %+v", path)
+		}
+	}
+
+	if bytes.Contains(b, []byte("PRIVATE KEY-----")) {
+		identity, err := parseSSHIdentity(b, path)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Identity{identity}, nil
+	}
+
+	identities, err := parseIdentities(bytes.NewReader(b))
+	return identities, eris.Wrapf(err, "Unable to parse identity file: %+v", path)
+}
+
+func decryptIdentityFile(b []byte) ([]byte, error) {
+	var r io.Reader = bytes.NewReader(b)
+	if bytes.HasPrefix(b, []byte(armor.Header)) {
+		r = armor.NewReader(r)
+	}
+
+	passphrase, err := promptForPassword("IDENTITY FILE PASSPHRASE > ")
+	if err != nil {
+		return nil, err
+	}
+	identity, err := age.NewScryptIdentity(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := age.Decrypt(r, identity)
+	if err != nil {
+		return nil, err
+	}
+	return readSecret(plaintext)
+}
+
+func parseIdentities(r io.Reader) ([]age.Identity, error) {
+	var identities []age.Identity
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if i := strings.Index(line, "AGE-SECRET-KEY-"); i > 0 {
+			line = line[i:]
+		}
+		identity, err := age.ParseX25519Identity(line)
+		if err != nil {
+			return nil, eris.Errorf("invalid identity on line %d", lineNumber)
+		}
+		identities = append(identities, identity)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(identities) == 0 {
+		return nil, eris.New("no identities found")
+	}
+	return identities, nil
+}
+
+// readSSHIdentity reads an ssh private key file such as ~/.ssh/id_ed25519.
+func readSSHIdentity(path string) (age.Identity, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, eris.Wrap(err, "Unable to read ssh identity")
+	}
+	return parseSSHIdentity(pemBytes, path)
+}
+
+// parseSSHIdentity parses an ssh private key. Passphrase protected keys
+// prompt for their passphrase when first used.
+func parseSSHIdentity(pemBytes []byte, path string) (age.Identity, error) {
+	identity, err := agessh.ParseIdentity(pemBytes)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return identity, eris.Wrapf(err, "Unable to parse ssh identity: %+v", path)
+	}
+
+	pubKey := missing.PublicKey
+	if pubKey == nil {
+		b, err := os.ReadFile(path + ".pub")
+		if err != nil {
+			return nil, eris.Wrapf(err, "encrypted ssh identity needs its public key alongside it: %+v.pub", path)
+		}
+		pubKey, _, _, _, err = ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return nil, eris.Wrapf(err, "Unable to parse ssh public key: %+v.pub", path)
+		}
+	}
+
+	return agessh.NewEncryptedSSHIdentity(pubKey, pemBytes, func() ([]byte, error) {
+		p, err := promptForPassword("SSH KEY PASSPHRASE > ")
+		return []byte(p), err
+	})
+}
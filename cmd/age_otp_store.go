@@ -1,30 +1,26 @@
 package cmd
 
 import (
-	"bytes"
+	"errors"
+	"fmt"
 	"os"
 
 	"github.com/99designs/keyring"
 	"github.com/rotisserie/eris"
 	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
 	chainv1 "github.com/zph/chain/gen/go/chain/v1"
 )
 
-// TODO: consider adding re-keying option for the scenario
-// where user has 1 valid private key remaining and would
-// like to keep using the same stored secrets with N new
-// keys.
+var ErrLastOneTimeKey = errors.New("refusing to use the chain's last one-time key")
 
 // AgeStore is used for both AgeStore and AgeOTPStore
 func NewAgeOTPStore(chain string) (Store, error) {
-	s := AgeOTPStore{}
-	cfg := keyring.Config{
-		ServiceName:      chain,
-		FilePasswordFunc: getPassword,
-		FileDir:          filePath(chain),
-	}
-	s.Config = cfg
-	return s, nil
+	s, err := openAgeStore(chain)
+	if err != nil {
+		return nil, err
+	}
+	return AgeOTPStore{s}, nil
 }
 
 type AgeOTPStore struct {
@@ -35,54 +31,150 @@ func (s AgeOTPStore) Name() string {
 	return chainv1.StorageType_STORAGE_TYPE_AGE_OTP_STORE.String()
 }
 
-func (s AgeOTPStore) PostRunHook() error {
-	// Fetch the publicKeyPrefix:PrivateKey string from user
-	publicKeyPrefix, _, err := s.getKeysFromUser()
+// CheckOneTimeKeys is called before any values are revealed and refuses
+// to use the chain's last one-time key unless a replacement batch will be
+// generated in this run, see replenish
+func (s AgeOTPStore) CheckOneTimeKeys() error {
+	identity, err := s.usedIdentity()
 	if err != nil {
 		return err
 	}
+	if _, ok := identityRecipient(identity); !ok {
+		return nil
+	}
 
-	// Remove public key from list of keys
-	err = s.expirePublicKey(publicKeyPrefix)
+	registry, err := loadRecipients(s.Config.FileDir)
 	if err != nil {
-		return eris.Wrap(err, "failed to expire keys and rekey")
+		return err
+	}
+	if active, _ := registry.OneTimeKeys(); active <= 1 && viper.GetInt(OTPReplenishKey) <= 0 {
+		return eris.Wrap(ErrLastOneTimeKey, "re-run with --replenish N or CHAIN_OTP_REPLENISH=N to generate replacement keys")
+	}
+	return nil
+}
+
+// PostRunHook expires the one-time key used in this run. Only the data key
+// is re-encrypted to the remaining public keys, items are left untouched.
+//
+// When fewer than CHAIN_OTP_WARN_THRESHOLD one-time keys remain a batch of
+// CHAIN_OTP_REPLENISH (or --replenish) new keys is added, otherwise a
+// warning is logged.
+//
+// Because the data key itself is unchanged, a copy of the previous data key
+// file plus the expired private key still reveals the data key.
+func (s AgeOTPStore) PostRunHook() error {
+	// Work out which identity was used from the age header it decrypted
+	identity, err := s.usedIdentity()
+	if err != nil {
+		return err
+	}
+
+	// ssh keys and passphrases are long lived and are never expired
+	recipient, ok := identityRecipient(identity)
+	if !ok {
+		log.Warn().Str("chain", s.Config.ServiceName).Msg("Identity is not a one-time age key, no key was expired")
+		return nil
+	}
+
+	// Read everything which needs the expiring key before expiring it
+	var dataKey []byte
+	if _, err = os.Stat(s.FilePath(dataKeyFile)); err == nil {
+		dataKey, err = s.getDataKey()
+		if err != nil {
+			return eris.Wrap(err, "failed to decrypt data key")
+		}
 	}
 
-	// Rekey existing records after now that we've expired
-	// the one-time-use public/private keypair
 	var keys []string
 	keys, err = s.Keys()
 	if err != nil {
 		return eris.Wrap(err, "failed to list keys")
 	}
+	var legacy []keyring.Item
 	for _, k := range keys {
+		var b []byte
+		b, err = os.ReadFile(s.FilePath(k))
+		if err != nil {
+			return eris.Wrapf(err, "failed to read key: %+v", k)
+		}
+		if isCurrentEnvelope(b) {
+			continue
+		}
+
 		var item keyring.Item
 		item, err = s.Get(k)
 		if err != nil {
 			return eris.Wrapf(err, "failed to fetch key: %+v", k)
 		}
-		err = s.Set(item)
+		legacy = append(legacy, item)
+	}
+
+	registry, err := loadRecipients(s.Config.FileDir)
+	if err != nil {
+		return err
+	}
+	active, _ := registry.OneTimeKeys()
+	remaining := active - 1
+	threshold := viper.GetInt(OTPWarnThresholdKey)
+	replenish := viper.GetInt(OTPReplenishKey)
+
+	if replenish > 0 && (remaining <= 0 || remaining < threshold) {
+		err = s.replenish(registry, replenish)
 		if err != nil {
-			return eris.Wrapf(err, "failed to set key using new public keys: %+v", k)
+			return eris.Wrap(err, "failed to generate replacement keys")
 		}
+		remaining += replenish
+	} else if remaining <= 0 {
+		return ErrLastOneTimeKey
 	}
-	return nil
-}
 
-func (s AgeOTPStore) expirePublicKey(publicKeyPrefix string) error {
-	content, err := os.ReadFile(s.FilePath(publicKeyFile))
+	// Stop encrypting to the used public key
+	e, err := registry.SetState(recipientID(recipient), recipientUsed)
+	if err != nil {
+		return eris.Wrap(err, "failed to expire keys and rekey")
+	}
+	log.Debug().Str("id", e.ID).Str("label", e.Label).Msg("Expired one-time key")
+	err = registry.Save(s.Config.FileDir)
 	if err != nil {
-		log.Fatal().Err(err).Msgf("Failed to open public key file")
+		return eris.Wrap(err, "failed to expire keys and rekey")
 	}
 
-	lines := bytes.Split(content, []byte("\n"))
-	var newLines [][]byte
-	for _, l := range lines {
-		if string(l)[:10] != publicKeyPrefix {
-			newLines = append(newLines, l)
+	if remaining < threshold {
+		log.Warn().Str("chain", s.Config.ServiceName).Int("remaining", remaining).Msg("Chain is running low on one-time keys, generate more with --replenish N")
+	}
+
+	// Re-encrypt the data key now that we've expired
+	// the one-time-use public/private keypair
+	if dataKey != nil {
+		err = s.writeDataKey(dataKey)
+		if err != nil {
+			return eris.Wrap(err, "failed to encrypt data key using new public keys")
+		}
+	}
+	return nil
+}
+
+// replenish adds count one-time keys to the registry. Keys are derived
+// from the seed when the chain was decrypted with its mnemonic, otherwise
+// new private keys are generated and printed to stderr, leaving stdout to
+// the command's output.
+func (s AgeOTPStore) replenish(registry *recipientRegistry, count int) error {
+	if s.cache.seed != nil {
+		err := addSeedRecipients(registry, s.cache.seed, count, createKeysLabel)
+		if err == nil {
+			log.Info().Str("chain", s.Config.ServiceName).Int("count", count).Msg("Derived replacement one-time keys from seed")
 		}
+		return err
 	}
 
-	os.WriteFile(s.FilePath(publicKeyFile), bytes.Join(newLines, []byte("\n")), secureFSPerm)
+	var privateKeys string
+	for _, id := range createIdentities(count) {
+		e, err := registry.Add(id.Recipient().String(), fmt.Sprintf("%s-%d", createKeysLabel, len(registry.Recipients)+1))
+		if err != nil {
+			return err
+		}
+		privateKeys += formatIdentity(*e, id)
+	}
+	fmt.Fprintf(os.Stderr, "# Replacement one-time keys, store these for decryption.\n%s\n", privateKeys)
 	return nil
 }
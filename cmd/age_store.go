@@ -3,34 +3,100 @@ package cmd
 import (
 	"bytes"
 	"errors"
-	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"filippo.io/age"
 	"github.com/99designs/keyring"
+	"github.com/rotisserie/eris"
 	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
 	chainv1 "github.com/zph/chain/gen/go/chain/v1"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 var publicKeyFile = ".PUBLIC_KEYS"
 
 // AgeStore is used for both AgeStore and AgeOTPStore
 func NewAgeStore(chain string) (Store, error) {
-	s := AgeStore{}
+	return openAgeStore(chain)
+}
+
+var ErrRekeyPending = errors.New("an interrupted re-encryption of the chain must be completed first")
+
+// openAgeStore completes a re-encryption of the chain interrupted by a crash
+// before opening it, see finishRekey. Only a command holding the chain's
+// exclusive lock moves files in the chain, readers of a chain with a
+// committed re-encryption fail with ErrRekeyPending.
+func openAgeStore(chain string) (AgeStore, error) {
+	s := newAgeStore(chain)
+	if !lockedExclusively(chain) {
+		if rekeyCommitted(s.Config.FileDir) {
+			return s, eris.Wrapf(ErrRekeyPending, "%s, complete it with a command which writes to the chain, eg chain set %s </dev/null", chain, chain)
+		}
+		return s, nil
+	}
+	if err := finishRekey(s.Config.FileDir); err != nil {
+		return s, eris.Wrapf(err, "Unable to recover an interrupted re-encryption of chain: %+v", chain)
+	}
+	return s, nil
+}
+
+func newAgeStore(chain string) AgeStore {
+	return newAgeStoreAt(chain, filePath(chain))
+}
+
+// newAgeStoreAt opens a copy of the chain stored in dir, eg by sync
+func newAgeStoreAt(chain string, dir string) AgeStore {
 	cfg := keyring.Config{
 		ServiceName:      chain,
 		FilePasswordFunc: getPassword,
-		FileDir:          filePath(chain),
+		FileDir:          dir,
 	}
-	s.Config = cfg
-	return s, nil
+
+	cache, ok := ageStoreCaches[cfg.FileDir]
+	if !ok {
+		cache = &ageStoreCache{groupKeys: map[string][]byte{}}
+		ageStoreCaches[cfg.FileDir] = cache
+	}
+	return AgeStore{Config: cfg, cache: cache}
 }
 
 type AgeStore struct {
 	Config keyring.Config
+	cache  *ageStoreCache
+}
+
+// ageStoreCache is shared between every AgeStore for a chain so the data
+// key is only decrypted once per process, eg by get and its PostRun
+type ageStoreCache struct {
+	dataKey      []byte
+	identities   []age.Identity
+	usedIdentity age.Identity
+	seed         []byte
+	groupKeys    map[string][]byte
+}
+
+var ageStoreCaches = map[string]*ageStoreCache{}
+
+// forgetCachedKeys drops the data keys cached for the chain in dir after
+// its files were replaced, eg by sync, keeping the identities already read
+func forgetCachedKeys(dir string) {
+	cache, ok := ageStoreCaches[dir]
+	if !ok {
+		return
+	}
+	ageStoreCaches[dir] = &ageStoreCache{
+		identities:   cache.identities,
+		usedIdentity: cache.usedIdentity,
+		seed:         cache.seed,
+		groupKeys:    map[string][]byte{},
+	}
 }
 
 func (s AgeStore) Keys() ([]string, error) {
@@ -41,13 +107,18 @@ func (s AgeStore) Keys() ([]string, error) {
 
 	var output []string
 	for _, f := range files {
-		if f.Name() != publicKeyFile {
+		// Dot files belong to the store, eg .PUBLIC_KEYS and .DATA_KEY
+		// Directories hold namespaced chains, eg "team/aws" within "team"
+		if !strings.HasPrefix(f.Name(), ".") && !f.IsDir() {
 			output = append(output, f.Name())
 		}
 	}
 	return output, nil
 }
 
+// getKeysFromUser prompts for the private key, mnemonic or passphrase. The
+// public key prefix printed by older versions of create-keys is only split
+// off age private keys as passphrases may contain ':' themselves.
 func (s AgeStore) getKeysFromUser() (string, string, error) {
 	pk, err := s.Config.FilePasswordFunc("")
 	if err != nil {
@@ -55,102 +126,829 @@ func (s AgeStore) getKeysFromUser() (string, string, error) {
 	}
 
 	publicKeyPrefix, privateKey, found := strings.Cut(pk, ":")
-	if !found {
-		return "", "", err
+	if !found || !strings.HasPrefix(publicKeyPrefix, "age1") || !strings.HasPrefix(strings.TrimSpace(privateKey), "AGE-SECRET-KEY-") {
+		return "", pk, nil
 	}
 
 	return publicKeyPrefix, privateKey, nil
 }
 
-func (s AgeStore) Get(key string) (keyring.Item, error) {
-	_, privateKey, err := s.getKeysFromUser()
+// getIdentities returns the identities used to decrypt the chain. In order
+// of precedence those are read from the identity file (-i or
+// CHAIN_IDENTITY_FILE), the ssh private key configured with
+// CHAIN_SSH_IDENTITY, or the prompted input as either an age private key
+// (optionally with the prefix printed by create-keys), the mnemonic of the
+// seed the chain's one-time keys were derived from, or the chain's passphrase.
+func (s AgeStore) getIdentities() ([]age.Identity, error) {
+	if s.cache.identities != nil {
+		return s.cache.identities, nil
+	}
+
+	var identities []age.Identity
+	if identityFile := viper.GetString(IdentityFileKey); identityFile != "" {
+		var err error
+		identities, err = readIdentityFile(identityFile)
+		if err != nil {
+			return nil, err
+		}
+	} else if sshIdentity := viper.GetString(SSHIdentityKey); sshIdentity != "" {
+		identity, err := readSSHIdentity(sshIdentity)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	} else {
+		_, privateKey, err := s.getKeysFromUser()
+		if err != nil {
+			return nil, err
+		}
+
+		var identity age.Identity
+		privateKey = strings.TrimSpace(privateKey)
+		if strings.HasPrefix(privateKey, "AGE-SECRET-KEY-") {
+			identity, err = age.ParseX25519Identity(privateKey)
+			if err != nil {
+				return nil, eris.Wrap(err, "Failed to parse private key")
+			}
+			identities = append(identities, identity)
+		} else if looksLikeMnemonic(privateKey) {
+			identities, err = s.getSeedIdentities(privateKey)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			identity, err = age.NewScryptIdentity(privateKey)
+			if err != nil {
+				return nil, eris.Wrap(err, "Failed to use passphrase")
+			}
+			identities = append(identities, identity)
+		}
+	}
+
+	s.cache.identities = identities
+	return identities, nil
+}
+
+func (s AgeStore) getSeedIdentities(mnemonic string) ([]age.Identity, error) {
+	seed, err := mnemonicToSeed(mnemonic)
 	if err != nil {
-		return keyring.Item{}, err
+		return nil, err
 	}
+	registry, err := loadRecipients(s.Config.FileDir)
+	if err != nil {
+		return nil, err
+	}
+	identities, err := seedIdentities(registry, seed)
+	if err != nil {
+		return nil, err
+	}
+	s.cache.seed = seed
+	return identities, nil
+}
 
-	identity, err := age.ParseX25519Identity(strings.TrimSpace(privateKey))
+// decrypt tries each identity in turn against the age header of b and
+// records which one was able to decrypt it, see usedIdentity
+func (s AgeStore) decrypt(b []byte, identities []age.Identity) ([]byte, error) {
+	var lastErr error = &age.NoIdentityMatchError{}
+	for _, identity := range identities {
+		r, err := age.Decrypt(bytes.NewReader(b), identity)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		s.cache.usedIdentity = identity
+		return readSecret(r)
+	}
+	return nil, lastErr
+}
+
+// usedIdentity returns the identity which decrypted the chain in this run
+func (s AgeStore) usedIdentity() (age.Identity, error) {
+	if s.cache.usedIdentity == nil {
+		if _, err := s.getDataKey(); err != nil {
+			return nil, err
+		}
+	}
+	return s.cache.usedIdentity, nil
+}
+
+// getDataKey decrypts the chain's data key with the user's identity and
+// checks the chain directory against its manifest
+func (s AgeStore) getDataKey() ([]byte, error) {
+	if s.cache.dataKey != nil {
+		return s.cache.dataKey, nil
+	}
+
+	dataKey, err := s.decryptDataKey()
 	if err != nil {
-		log.Fatal().Msgf("Failed to parse private key: %v", err)
+		return nil, err
 	}
 
-	credsFile := s.FilePath(key)
-	f, err := os.Open(credsFile)
+	report, err := checkManifest(s.Config.FileDir, s.Config.ServiceName, dataKey)
 	if err != nil {
-		log.Fatal().Str("credsFile", credsFile).Err(err).Msg("Failed to open file")
+		return nil, eris.Wrap(ErrIntegrity, err.Error())
+	}
+	if report.Missing && !report.RolledBack {
+		log.Info().Str("chain", s.Config.ServiceName).Msg("Chain has no manifest, trusting current contents and creating one")
+		if err := writeManifest(s.Config.FileDir, s.Config.ServiceName, dataKey); err != nil {
+			return nil, err
+		}
+	} else if !report.OK() {
+		return nil, eris.Wrap(ErrIntegrity, report.String())
 	}
 
-	log.Debug().Str("credsFile", credsFile).Msg("Opened file")
-	r, err := age.Decrypt(f, identity)
+	s.cache.dataKey = dataKey
+	return dataKey, nil
+}
+
+func (s AgeStore) decryptDataKey() ([]byte, error) {
+	identities, err := s.getIdentities()
 	if err != nil {
-		log.Fatal().Msgf("Failed to open encrypted file: %v", err)
+		return nil, err
 	}
-	out := &bytes.Buffer{}
-	if _, err := io.Copy(out, r); err != nil {
-		log.Fatal().Msgf("Failed to read encrypted file: %v", err)
+
+	// Passphrases only decrypt passphraseKeyFile and other identities
+	// only decrypt dataKeyFile
+	var scrypt, others []age.Identity
+	for _, identity := range identities {
+		if _, ok := identity.(*age.ScryptIdentity); ok {
+			scrypt = append(scrypt, identity)
+		} else {
+			others = append(others, identity)
+		}
 	}
 
-	return keyring.Item{Key: key, Data: out.Bytes()}, nil
+	var lastErr error
+	for _, attempt := range []struct {
+		file       string
+		identities []age.Identity
+	}{{dataKeyFile, others}, {passphraseKeyFile, scrypt}} {
+		if len(attempt.identities) == 0 {
+			continue
+		}
+
+		wrapped, err := os.ReadFile(s.FilePath(attempt.file))
+		if err != nil {
+			lastErr = eris.Wrap(err, "Failed to read data key")
+			continue
+		}
+
+		dataKey, err := s.decrypt(wrapped, attempt.identities)
+		if err != nil {
+			lastErr = eris.Wrap(err, "Unable to decrypt data key")
+			continue
+		}
+		if len(dataKey) != chacha20poly1305.KeySize {
+			return nil, eris.New("Unable to decrypt data key: unexpected length")
+		}
+		return dataKey, nil
+	}
+	return nil, lastErr
 }
 
-// Load Public Keys
-// Using pub keys, encode item
-func (s AgeStore) Set(item keyring.Item) error {
-	// https://pkg.go.dev/filippo.io/age#example-Encrypt
+// ensureDataKey returns the chain's data key, generating one encrypted to
+// the chain's recipients when the chain has none yet
+func (s AgeStore) ensureDataKey() ([]byte, error) {
+	for _, file := range []string{dataKeyFile, passphraseKeyFile} {
+		if _, err := os.Stat(s.FilePath(file)); err == nil {
+			return s.getDataKey()
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	dataKey, err := newDataKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.writeDataKey(dataKey); err != nil {
+		return nil, err
+	}
+	s.cache.dataKey = dataKey
+	return dataKey, nil
+}
 
-	recipients := s.getRecipients()
+// writeDataKey encrypts the data key to the current recipients. A chain
+// with only a passphrase has no recipients and keeps no dataKeyFile.
+//
+// The data keys of recipient groups the user is a member of are
+// re-encrypted to their current members as well.
+func (s AgeStore) writeDataKey(dataKey []byte) error {
+	registry, err := loadRecipients(s.Config.FileDir)
+	if err != nil {
+		return eris.Wrap(err, "Failed to open recipients")
+	}
+	recipients, err := registry.ActiveRecipients()
+	if err != nil {
+		return eris.Wrap(err, "Failed to parse public keys")
+	}
+	// Checked before anything is written
+	groupKeys, err := s.groupKeysToWrite(registry)
+	if err != nil {
+		return err
+	}
 
-	out := &bytes.Buffer{}
+	if len(recipients) == 0 {
+		if _, err := os.Stat(s.FilePath(passphraseKeyFile)); err != nil {
+			return eris.New("chain has no public keys or passphrase to encrypt to")
+		}
+		err := os.Remove(s.FilePath(dataKeyFile))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	} else {
+		wrapped, err := wrapDataKey(dataKey, recipients...)
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(s.FilePath(dataKeyFile), wrapped, secureFSPerm)
+		if err != nil {
+			return err
+		}
+	}
 
-	w, err := age.Encrypt(out, recipients...)
+	if err := s.writeGroupKeys(registry, groupKeys); err != nil {
+		return err
+	}
+	return writeManifest(s.Config.FileDir, s.Config.ServiceName, dataKey)
+}
+
+// writePassphraseKey encrypts the data key with an scrypt passphrase
+func (s AgeStore) writePassphraseKey(dataKey []byte, passphrase string) error {
+	recipient, err := age.NewScryptRecipient(passphrase)
 	if err != nil {
-		log.Fatal().Msgf("Failed to create encrypted file: %v", err)
+		return err
 	}
-	if _, err := io.WriteString(w, string(item.Data)); err != nil {
-		log.Fatal().Msgf("Failed to write to encrypted file: %v", err)
+	wrapped, err := wrapDataKey(dataKey, recipient)
+	if err != nil {
+		return err
 	}
-	if err := w.Close(); err != nil {
-		log.Fatal().Msgf("Failed to close encrypted file: %v", err)
+	return writeFileAtomic(s.FilePath(passphraseKeyFile), wrapped, secureFSPerm)
+}
+
+// Recipients returns the chain's recipient registry
+func (s AgeStore) Recipients() (*recipientRegistry, error) {
+	return loadRecipients(s.Config.FileDir)
+}
+
+// UpdateRecipients applies update to the recipient registry and re-encrypts
+// the data key to the resulting active recipients
+func (s AgeStore) UpdateRecipients(update func(*recipientRegistry) error) error {
+	dataKey, err := s.ensureDataKey()
+	if err != nil {
+		return err
 	}
 
-	err = os.WriteFile(s.FilePath(item.Key), out.Bytes(), secureFSPerm)
+	before, err := loadRecipients(s.Config.FileDir)
 	if err != nil {
-		log.Fatal().Err(err).Msg("")
+		return err
+	}
+	registry, err := loadRecipients(s.Config.FileDir)
+	if err != nil {
+		return err
+	}
+	if err := update(registry); err != nil {
+		return err
+	}
+	if err := s.checkGroupChanges(before, registry); err != nil {
+		return err
+	}
+	if err := registry.Save(s.Config.FileDir); err != nil {
+		return err
 	}
 
-	return nil
+	return s.writeDataKey(dataKey)
 }
 
-func (s AgeStore) getRecipients() []age.Recipient {
-	publicKeys, err := os.Open(s.FilePath(publicKeyFile))
+// RemoveRecipient revokes a recipient, usually a member, and re-encrypts
+// every item they could read with new data keys encrypted to the remaining
+// recipients. The removed recipient may have kept copies of those values,
+// so their keys are flagged as needing rotation and returned.
+func (s AgeStore) RemoveRecipient(ref string) (recipientEntry, []string, error) {
+	if _, err := s.ensureDataKey(); err != nil {
+		return recipientEntry{}, nil, err
+	}
 
+	before, err := loadRecipients(s.Config.FileDir)
 	if err != nil {
-		log.Fatal().Msgf("Failed to open private keys file: %v", err)
+		return recipientEntry{}, nil, err
 	}
-	recipients, err := age.ParseRecipients(publicKeys)
+	registry, err := loadRecipients(s.Config.FileDir)
 	if err != nil {
-		log.Fatal().Msgf("Failed to parse public keys: %v", err)
+		return recipientEntry{}, nil, err
 	}
-	return recipients
+	e, err := registry.SetState(ref, recipientRevoked)
+	if err != nil {
+		return recipientEntry{}, nil, err
+	}
+	removed := *e
+
+	_, err = os.Stat(s.FilePath(passphraseKeyFile))
+	hasPassphrase := err == nil
+	if len(registry.Active()) == 0 && !hasPassphrase {
+		return removed, nil, eris.New("refusing to remove the chain's last public key")
+	}
+
+	// "" is the chain's own data key, which every recipient can read
+	rotate := map[string][]byte{"": nil}
+	groups, err := s.groups()
+	if err != nil {
+		return removed, nil, err
+	}
+	for _, group := range groups {
+		if !removed.InGroup(group) {
+			continue
+		}
+		key, err := s.getGroupKey(group)
+		if err != nil {
+			return removed, nil, eris.Wrapf(err, "only a member of group %s can remove %s", group, ref)
+		}
+		if err := before.verifyGroupMembers(group, key); err != nil {
+			return removed, nil, err
+		}
+		if recipients, _ := registry.GroupRecipients(group); len(recipients) == 0 {
+			return removed, nil, eris.Errorf("refusing to remove the last member of group %s", group)
+		}
+		rotate[group] = nil
+	}
+	for group := range rotate {
+		if rotate[group], err = newDataKey(); err != nil {
+			return removed, nil, err
+		}
+		if group == "" {
+			continue
+		}
+		if err := registry.signGroupMembers(group, rotate[group]); err != nil {
+			return removed, nil, err
+		}
+	}
+
+	keys, err := s.Keys()
+	if err != nil {
+		return removed, nil, err
+	}
+	var readable []string
+	sealed := make(map[string][]byte)
+	for _, k := range keys {
+		group, err := s.itemGroup(k)
+		if err != nil {
+			return removed, nil, err
+		}
+		key, ok := rotate[group]
+		if !ok {
+			continue
+		}
+
+		b, err := os.ReadFile(s.FilePath(k))
+		if err != nil {
+			return removed, nil, err
+		}
+		data, header, err := s.openItem(k, b)
+		if err != nil {
+			return removed, nil, eris.Wrapf(err, "Failed to decrypt key: %+v", k)
+		}
+		registerSecret(data)
+		header.Group = group
+		sealed[k], err = sealEnvelope(key, header, data)
+		if err != nil {
+			return removed, nil, eris.Wrapf(err, "Failed to encrypt key: %+v", k)
+		}
+		readable = append(readable, k)
+	}
+
+	var passphrase string
+	if hasPassphrase {
+		passphrase, err = s.chainPassphrase()
+		if err != nil {
+			return removed, nil, err
+		}
+	}
+
+	// The new chain is written to a staging copy and replaces the chain once
+	// complete, items sealed with the new data keys are never stored
+	// without those keys, see finishRekey
+	staging := s
+	staging.Config.FileDir = filepath.Join(s.Config.FileDir, rekeyStagingDir)
+	// The staged keys are only used by this store once committed
+	staging.cache = &ageStoreCache{
+		identities:   s.cache.identities,
+		usedIdentity: s.cache.usedIdentity,
+		seed:         s.cache.seed,
+		groupKeys:    map[string][]byte{},
+	}
+	if err := os.RemoveAll(staging.Config.FileDir); err != nil {
+		return removed, nil, err
+	}
+	if err := copyChainFiles(s.Config.FileDir, staging.Config.FileDir); err != nil {
+		return removed, nil, err
+	}
+	defer func() {
+		if p, err := manifestStatePath(staging.Config.FileDir); err == nil {
+			os.Remove(p)
+		}
+	}()
+
+	if err := registry.Save(staging.Config.FileDir); err != nil {
+		return removed, nil, err
+	}
+	dataKey := rotate[""]
+	if hasPassphrase {
+		if err := staging.writePassphraseKey(dataKey, passphrase); err != nil {
+			return removed, nil, err
+		}
+	}
+	for group, key := range rotate {
+		if group != "" {
+			staging.cache.groupKeys[group] = key
+		}
+	}
+	// Also writes the new group keys
+	if err := staging.writeDataKey(dataKey); err != nil {
+		return removed, nil, err
+	}
+	for _, k := range readable {
+		if err := writeFileAtomic(staging.FilePath(k), sealed[k], secureFSPerm); err != nil {
+			return removed, nil, err
+		}
+	}
+
+	flags, err := loadRotationFlags(staging.Config.FileDir)
+	if err != nil {
+		return removed, nil, err
+	}
+	name := removed.Label
+	if name == "" {
+		name = removed.ID
+	}
+	flags.Flag(readable, name, removed.Updated)
+	if err := flags.Save(staging.Config.FileDir); err != nil {
+		return removed, nil, err
+	}
+	if err := writeManifest(staging.Config.FileDir, s.Config.ServiceName, dataKey); err != nil {
+		return removed, nil, err
+	}
+
+	if err := commitRekey(staging.Config.FileDir); err != nil {
+		return removed, nil, err
+	}
+	s.cache.dataKey = dataKey
+	for group, key := range staging.cache.groupKeys {
+		s.cache.groupKeys[group] = key
+	}
+	if err := finishRekey(s.Config.FileDir); err != nil {
+		return removed, nil, err
+	}
+	// Records the staged manifest's version as seen for the chain
+	return removed, readable, writeManifest(s.Config.FileDir, s.Config.ServiceName, dataKey)
 }
 
-func setPublicKeys(recipients []string, outputPath string) error {
-	log.Debug().Str("path", outputPath).Msgf("recipients %+v", recipients)
-	err := os.WriteFile(outputPath, []byte(strings.Join(recipients, "\n")), secureFSPerm)
+// rekeyStagingDir holds the re-encrypted copy of a chain written by
+// RemoveRecipient until it is committed by writing rekeyCommitFile, which
+// lists the files of the new chain, and moved into place by finishRekey
+var rekeyStagingDir = ".rekey"
+var rekeyCommitFile = ".COMMIT"
+
+// commitRekey marks the staged copy of a chain as complete
+func commitRekey(staging string) error {
+	files, err := hashChainFiles(staging)
 	if err != nil {
-		log.Fatal().Err(err).Msg("")
+		return err
 	}
+	names := []string{manifestFile}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return writeFileAtomic(filepath.Join(staging, rekeyCommitFile), []byte(strings.Join(names, "\n")+"\n"), secureFSPerm)
+}
 
-	return nil
+// rekeyCommitted reports whether dir holds a committed re-encryption which
+// hasn't been moved into place
+func rekeyCommitted(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, rekeyStagingDir, rekeyCommitFile))
+	return err == nil
 }
 
-func (s AgeStore) publicKeysExist() (bool, error) {
-	if _, err := os.Stat(s.FilePath(publicKeyFile)); err == nil {
-		return true, nil
-	} else if errors.Is(err, os.ErrNotExist) {
-		return false, nil
-	} else {
-		return false, err
+// finishRekey completes a committed re-encryption of the chain in dir by
+// moving the staged files into place and removing the files the new chain
+// no longer has, or discards an uncommitted one. It is safe to repeat after
+// being interrupted.
+func finishRekey(dir string) error {
+	staging := filepath.Join(dir, rekeyStagingDir)
+	b, err := os.ReadFile(filepath.Join(staging, rekeyCommitFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return os.RemoveAll(staging)
+	} else if err != nil {
+		return err
+	}
+	keep := make(map[string]bool)
+	for _, name := range strings.Fields(string(b)) {
+		keep[name] = true
+	}
+
+	staged, err := os.ReadDir(staging)
+	if err != nil {
+		return err
+	}
+	for _, e := range staged {
+		if !keep[e.Name()] {
+			continue
+		}
+		err := os.Rename(filepath.Join(staging, e.Name()), filepath.Join(dir, e.Name()))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	current, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range current {
+		if e.IsDir() || keep[e.Name()] || manifestIgnored(e.Name()) {
+			continue
+		}
+		err := os.Remove(filepath.Join(dir, e.Name()))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.RemoveAll(staging)
+}
+
+// chainPassphrase returns the chain's passphrase, reusing the one the
+// chain was decrypted with in this run
+func (s AgeStore) chainPassphrase() (string, error) {
+	if _, ok := s.cache.usedIdentity.(*age.ScryptIdentity); ok {
+		return getPassword("")
+	}
+
+	passphrase, err := promptForPassword("CHAIN PASSPHRASE > ")
+	if err != nil {
+		return "", err
+	}
+	identity, err := age.NewScryptIdentity(passphrase)
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := os.ReadFile(s.FilePath(passphraseKeyFile))
+	if err != nil {
+		return "", err
+	}
+	if _, err := age.Decrypt(bytes.NewReader(wrapped), identity); err != nil {
+		return "", eris.Wrap(err, "incorrect passphrase")
+	}
+	return passphrase, nil
+}
+
+// VerifyIntegrity compares the chain directory with its manifest
+func (s AgeStore) VerifyIntegrity() (manifestReport, error) {
+	dataKey, err := s.decryptDataKey()
+	if err != nil {
+		return manifestReport{}, err
+	}
+	return checkManifest(s.Config.FileDir, s.Config.ServiceName, dataKey)
+}
+
+// UpdateManifest signs the current contents of the chain directory
+func (s AgeStore) UpdateManifest() error {
+	dataKey, err := s.decryptDataKey()
+	if err != nil {
+		return err
+	}
+	return writeManifest(s.Config.FileDir, s.Config.ServiceName, dataKey)
+}
+
+func (s AgeStore) Get(key string) (keyring.Item, error) {
+	if err := validateKeyPath(key); err != nil {
+		return keyring.Item{}, err
+	}
+
+	credsFile := s.FilePath(key)
+	b, err := os.ReadFile(credsFile)
+	if err != nil {
+		return keyring.Item{}, eris.Wrapf(err, "Failed to open file: %+v", credsFile)
+	}
+	log.Debug().Str("credsFile", credsFile).Msg("Opened file")
+
+	data, _, err := s.openItem(key, b)
+	if err != nil {
+		return keyring.Item{}, eris.Wrapf(err, "Failed to decrypt key: %+v", key)
+	}
+	registerSecret(data)
+
+	if flags, err := loadRotationFlags(s.Config.FileDir); err == nil {
+		if members := flags.Members(key); len(members) > 0 {
+			log.Warn().Str("key", key).Strs("members", members).Msg("Value was readable by removed members, set a new value to rotate it")
+		}
+	}
+
+	return keyring.Item{Key: key, Data: data}, nil
+}
+
+// openItem decrypts the stored bytes b of key, returning the envelope
+// header it was sealed with. Values in formats which don't bind them to
+// their key and chain are refused, see Migrate.
+func (s AgeStore) openItem(key string, b []byte) ([]byte, envelopeHeader, error) {
+	header, _, err := readEnvelopeHeader(b)
+	if err != nil {
+		if !isCurrentEnvelope(b) {
+			err = ErrUnboundValue
+		}
+		return nil, header, err
+	}
+
+	dataKey, err := s.getDataKey()
+	if err != nil {
+		return nil, header, err
+	}
+	if header.Group != "" {
+		dataKey, err = s.getGroupKey(header.Group)
+		if err != nil {
+			return nil, header, err
+		}
+	}
+
+	data, err := openEnvelope(dataKey, s.envelopeHeader(key, header.Group), b)
+	return data, header, err
+}
+
+// openUnboundItem decrypts an item written before values were bound to
+// their key and chain, either encrypted directly to the recipients with
+// age or in a version 1 envelope
+func (s AgeStore) openUnboundItem(b []byte) ([]byte, error) {
+	if isAgeFile(b) {
+		return s.decryptAgeFile(b)
+	}
+	if !bytes.HasPrefix(b, envelopeMagicV1) {
+		return nil, ErrInvalidEnvelope
+	}
+	dataKey, err := s.getDataKey()
+	if err != nil {
+		return nil, err
+	}
+	return openEnvelope(dataKey, envelopeHeader{}, b)
+}
+
+// Migrate re-seals the values written before values were bound to their key
+// and chain and returns their keys. Anyone with the chain's public keys can
+// write a value in those formats, so they are only trusted when the chain's
+// signed manifest lists them unchanged, or with trust for chains which
+// predate manifests.
+func (s AgeStore) Migrate(trust bool) ([]string, error) {
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+	var unbound []string
+	for _, k := range keys {
+		b, err := os.ReadFile(s.FilePath(k))
+		if err != nil {
+			return nil, err
+		}
+		if !isCurrentEnvelope(b) {
+			unbound = append(unbound, k)
+		}
+	}
+	if len(unbound) == 0 {
+		return nil, nil
+	}
+
+	if err := s.verifyUnbound(trust); err != nil {
+		return nil, err
+	}
+
+	// Decrypt everything before writing as the first Set creates the data
+	// key of a chain which has none yet
+	var items []keyring.Item
+	for _, k := range unbound {
+		b, err := os.ReadFile(s.FilePath(k))
+		if err != nil {
+			return nil, err
+		}
+		data, err := s.openUnboundItem(b)
+		if err != nil {
+			return nil, eris.Wrapf(err, "Failed to decrypt key: %+v", k)
+		}
+		registerSecret(data)
+		items = append(items, keyring.Item{Key: k, Data: data})
+	}
+	for _, item := range items {
+		if err := s.SetInGroup(item, ""); err != nil {
+			return nil, eris.Wrapf(err, "Failed to migrate key: %+v", item.Key)
+		}
+	}
+	return unbound, nil
+}
+
+// verifyUnbound checks the chain against its signed manifest before values
+// in unbound formats are migrated
+func (s AgeStore) verifyUnbound(trust bool) error {
+	var hasDataKey bool
+	for _, file := range []string{dataKeyFile, passphraseKeyFile} {
+		if _, err := os.Stat(s.FilePath(file)); err == nil {
+			hasDataKey = true
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	report := manifestReport{Chain: s.Config.ServiceName, Missing: true}
+	if hasDataKey {
+		dataKey, err := s.decryptDataKey()
+		if err != nil {
+			return err
+		}
+		report, err = checkManifest(s.Config.FileDir, s.Config.ServiceName, dataKey)
+		if err != nil {
+			return eris.Wrap(ErrIntegrity, err.Error())
+		}
+	}
+
+	switch {
+	case report.OK():
+		return nil
+	case report.Missing && !report.RolledBack:
+		if trust {
+			return nil
+		}
+		return eris.Errorf("chain %s has no signed manifest to verify its values against, rerun with --trust if nobody else could have written to %s", s.Config.ServiceName, s.Config.FileDir)
+	}
+	return eris.Wrap(ErrIntegrity, report.String())
+}
+
+func (s AgeStore) envelopeHeader(key string, group string) envelopeHeader {
+	return envelopeHeader{Chain: s.Config.ServiceName, Key: key, Group: group}
+}
+
+// decryptAgeFile reads items written before envelope encryption
+// where every item was encrypted to the recipients with age
+func (s AgeStore) decryptAgeFile(b []byte) ([]byte, error) {
+	identities, err := s.getIdentities()
+	if err != nil {
+		return nil, err
+	}
+	return s.decrypt(b, identities)
+}
+
+// Set encrypts the item with the chain's data key, or with the data key of
+// its recipient group when it was previously set in one
+func (s AgeStore) Set(item keyring.Item) error {
+	if err := validateKeyPath(item.Key); err != nil {
+		return err
+	}
+
+	group, err := s.itemGroup(item.Key)
+	if err != nil {
+		return err
+	}
+	return s.SetInGroup(item, group)
+}
+
+// SetInGroup encrypts the item so only members of the recipient group can
+// read it, or with the chain's data key when group is ""
+func (s AgeStore) SetInGroup(item keyring.Item, group string) error {
+	if err := validateKeyPath(item.Key); err != nil {
+		return err
+	}
+
+	dataKey, err := s.ensureDataKey()
+	if err != nil {
+		return err
+	}
+	itemKey := dataKey
+	if group != "" {
+		itemKey, err = s.ensureGroupKey(group)
+		if err != nil {
+			return err
+		}
+	}
+
+	header := s.envelopeHeader(item.Key, group)
+	header.Modified = time.Now().UnixNano()
+	sealed, err := sealEnvelope(itemKey, header, item.Data)
+	if err != nil {
+		return eris.Wrapf(err, "Failed to encrypt key: %+v", item.Key)
+	}
+
+	err = writeFileAtomic(s.FilePath(item.Key), sealed, secureFSPerm)
+	if err != nil {
+		return err
+	}
+
+	// A new value no longer needs rotating
+	flags, err := loadRotationFlags(s.Config.FileDir)
+	if err != nil {
+		return err
+	}
+	if _, ok := flags[item.Key]; ok {
+		delete(flags, item.Key)
+		if err := flags.Save(s.Config.FileDir); err != nil {
+			return err
+		}
 	}
+	return writeManifest(s.Config.FileDir, s.Config.ServiceName, dataKey)
 }
 
 func createIdentities(amt int) []*age.X25519Identity {
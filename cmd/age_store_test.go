@@ -0,0 +1,285 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/99designs/keyring"
+	"github.com/spf13/viper"
+)
+
+// useTestAgeStore stores chains in an age store in a temporary directory,
+// with manifest state kept in another
+func useTestAgeStore(t *testing.T) {
+	t.Helper()
+	viper.Set(ChainDirKey, t.TempDir())
+	viper.Set(StoreBackendTypeName, 4)
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	caches := ageStoreCaches
+	ageStoreCaches = map[string]*ageStoreCache{}
+	t.Cleanup(func() {
+		viper.Reset()
+		ageStoreCaches = caches
+	})
+}
+
+// newTestAgeChain creates chain encrypted to a new identity, which is used
+// to decrypt it, see asIdentity
+func newTestAgeChain(t *testing.T, chain string) (AgeStore, *age.X25519Identity) {
+	t.Helper()
+	identity := newTestIdentity(t)
+	registry := &recipientRegistry{Version: 1}
+	if _, err := registry.Add(identity.Recipient().String(), "owner"); err != nil {
+		t.Fatal(err)
+	}
+	dir := filePath(chain)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	return asIdentity(t, chain, identity), identity
+}
+
+func newTestIdentity(t *testing.T) *age.X25519Identity {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+// asIdentity opens chain as a new process decrypting with identity would
+func asIdentity(t *testing.T, chain string, identity *age.X25519Identity) AgeStore {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "identity")
+	if err := os.WriteFile(path, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set(IdentityFileKey, path)
+	ageStoreCaches = map[string]*ageStoreCache{}
+
+	s, err := openAgeStore(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func mustSet(t *testing.T, s Store, key string, value string) {
+	t.Helper()
+	if err := s.Set(keyring.Item{Key: key, Data: []byte(value)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertValue(t *testing.T, s Store, key string, want string) {
+	t.Helper()
+	item, err := s.Get(key)
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+	if string(item.Data) != want {
+		t.Errorf("%s is %q, want %q", key, item.Data, want)
+	}
+}
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readTestFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, e := range entries {
+		if e.IsDir() {
+			files[e.Name()+"/"] = ""
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[e.Name()] = string(b)
+	}
+	return files
+}
+
+func assertFiles(t *testing.T, dir string, want map[string]string) {
+	t.Helper()
+	got := readTestFiles(t, dir)
+	var names []string
+	for name := range got {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(got) != len(want) {
+		t.Fatalf("%s has %v, want %d files", dir, names, len(want))
+	}
+	for name, content := range want {
+		if got[name] != content {
+			t.Errorf("%s: got %q, want %q", name, got[name], content)
+		}
+	}
+}
+
+// TestFinishRekey resumes a re-encryption interrupted after some of the
+// staged files were moved into place
+func TestFinishRekey(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		// Already moved
+		dataKeyFile: "new key",
+		"A":         "new A",
+		// Not moved yet
+		"B":           "old B",
+		manifestFile:  "old manifest",
+		publicKeyFile: "removed by the new chain",
+		lockFile:      "",
+	})
+	writeTestFiles(t, filepath.Join(dir, "child"), map[string]string{"A": "namespaced chain"})
+	staging := filepath.Join(dir, rekeyStagingDir)
+	writeTestFiles(t, staging, map[string]string{
+		"B":             "new B",
+		manifestFile:    "new manifest",
+		rekeyCommitFile: ".DATA_KEY\n.MANIFEST\nA\nB\n",
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := finishRekey(dir); err != nil {
+			t.Fatal(err)
+		}
+		assertFiles(t, dir, map[string]string{
+			dataKeyFile:  "new key",
+			"A":          "new A",
+			"B":          "new B",
+			manifestFile: "new manifest",
+			lockFile:     "",
+			"child/":     "",
+		})
+	}
+}
+
+// TestFinishRekeyUncommitted discards a re-encryption interrupted before
+// it was committed, leaving the chain as it was
+func TestFinishRekeyUncommitted(t *testing.T) {
+	dir := t.TempDir()
+	chain := map[string]string{dataKeyFile: "old key", "A": "old A", manifestFile: "old manifest"}
+	writeTestFiles(t, dir, chain)
+	writeTestFiles(t, filepath.Join(dir, rekeyStagingDir), map[string]string{dataKeyFile: "new key", "A": "new A"})
+
+	if err := finishRekey(dir); err != nil {
+		t.Fatal(err)
+	}
+	assertFiles(t, dir, chain)
+}
+
+func TestRemoveRecipient(t *testing.T) {
+	useTestAgeStore(t)
+	s, owner := newTestAgeChain(t, "aws")
+	mustSet(t, s, "A", "1")
+	bob := newTestIdentity(t)
+	if err := s.UpdateRecipients(func(r *recipientRegistry) error {
+		_, err := r.Add(bob.Recipient().String(), "bob")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assertValue(t, asIdentity(t, "aws", bob), "A", "1")
+	before, err := s.getDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	before = append([]byte(nil), before...)
+
+	s = asIdentity(t, "aws", owner)
+	_, rotate, err := s.RemoveRecipient("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotate) != 1 || rotate[0] != "A" {
+		t.Errorf("flagged %v for rotation, want [A]", rotate)
+	}
+
+	// The store keeps working with the committed keys
+	after, err := s.getDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(before, after) {
+		t.Error("data key was not rotated")
+	}
+	assertValue(t, s, "A", "1")
+	mustSet(t, s, "B", "2")
+
+	s = asIdentity(t, "aws", owner)
+	assertValue(t, s, "A", "1")
+	assertValue(t, s, "B", "2")
+	if report, err := s.VerifyIntegrity(); err != nil || !report.OK() {
+		t.Errorf("chain is not OK after removing a recipient: %v %v", report, err)
+	}
+	if _, err := os.Stat(filepath.Join(s.Config.FileDir, rekeyStagingDir)); !os.IsNotExist(err) {
+		t.Error("staging directory left behind")
+	}
+	if _, err := asIdentity(t, "aws", bob).Get("A"); err == nil {
+		t.Error("removed recipient can still read the chain")
+	}
+}
+
+// TestRekeyRecoveryNeedsExclusiveLock leaves a committed re-encryption
+// which readers must not move into place
+func TestRekeyRecoveryNeedsExclusiveLock(t *testing.T) {
+	useTestAgeStore(t)
+	s, owner := newTestAgeChain(t, "aws")
+	mustSet(t, s, "A", "old")
+	staging := filepath.Join(s.Config.FileDir, rekeyStagingDir)
+	if err := copyChainFiles(s.Config.FileDir, staging); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, s, "A", "new")
+	dataKey, err := s.getDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeManifest(staging, "aws", dataKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitRekey(staging); err != nil {
+		t.Fatal(err)
+	}
+
+	holdLock(t, "aws", lockShared)
+	if _, err := openAgeStore("aws"); !errors.Is(err, ErrRekeyPending) {
+		t.Errorf("got %v, want ErrRekeyPending", err)
+	}
+	if !rekeyCommitted(s.Config.FileDir) {
+		t.Fatal("a reader moved the staged files")
+	}
+	unlockChainPostRun(nil, nil)
+
+	holdLock(t, "aws", lockExclusive)
+	s = asIdentity(t, "aws", owner)
+	if rekeyCommitted(s.Config.FileDir) {
+		t.Fatal("staged files were not moved into place")
+	}
+	assertValue(t, s, "A", "old")
+}
@@ -0,0 +1,484 @@
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/99designs/keyring"
+	"github.com/rotisserie/eris"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/hkdf"
+
+	chainv1 "github.com/zph/chain/gen/go/chain/v1"
+)
+
+// Single file database store
+//
+// BoltStore keeps a chain in one bbolt database, boltFile in the chain's
+// directory, instead of a file per key. Key names are never stored in the
+// clear so the database only reveals how many keys the chain holds.
+//
+// As with the vault format a random data key is encrypted with a key derived
+// from the chain's password with Argon2id, the parameters being stored in
+// the meta bucket.
+// Each key has an ID, the HMAC-SHA256 of its name keyed from the data key,
+// and two XChaCha20-Poly1305 encrypted records under that ID:
+//
+//	entries: boltEntry, the name and metadata, read by Keys()
+//	values:  the value itself, only read by Get()
+//
+// Records are authenticated with the chain, bucket and ID as additional
+// data so they can't be swapped between keys or chains. Writes of several
+// keys, eg from chain set, happen in a single transaction.
+
+var boltFile = "chain.db"
+var boltVersion = "1"
+
+var boltMetaBucket = []byte("meta")
+var boltEntriesBucket = []byte("entries")
+var boltValuesBucket = []byte("values")
+
+var ErrBoltPassword = errors.New("incorrect password for chain database")
+
+// boltEntry is the metadata stored for each key
+type boltEntry struct {
+	Key         string    `json:"key"`
+	Label       string    `json:"label,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Created     time.Time `json:"created"`
+	Modified    time.Time `json:"modified"`
+}
+
+type BoltStore struct {
+	chain string
+	path  string
+	keys  *boltKeys
+}
+
+// boltKeys holds the keys of an unlocked database
+type boltKeys struct {
+	data  []byte
+	index []byte
+}
+
+func NewBoltStore(chain string) (Store, error) {
+	return BoltStore{
+		chain: chain,
+		path:  filepath.Join(filePath(chain), boltFile),
+		keys:  &boltKeys{},
+	}, nil
+}
+
+func (s BoltStore) Name() string {
+	return chainv1.StorageType_STORAGE_TYPE_BOLT_STORE.String()
+}
+
+func (s BoltStore) PostRunHook() error { return nil }
+
+// Keys lists the chain's keys, decrypting only their entries
+func (s BoltStore) Keys() ([]string, error) {
+	var keys []string
+	err := s.view(func(tx *bolt.Tx) error {
+		entries, err := s.entries(tx)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+func (s BoltStore) Get(key string) (keyring.Item, error) {
+	var item keyring.Item
+	err := s.view(func(tx *bolt.Tx) error {
+		if !s.initialized(tx) {
+			return keyring.ErrKeyNotFound
+		}
+		if err := s.unlock(tx); err != nil {
+			return err
+		}
+
+		id := s.id(key)
+		sealedEntry := tx.Bucket(boltEntriesBucket).Get(id)
+		sealedValue := tx.Bucket(boltValuesBucket).Get(id)
+		if sealedEntry == nil || sealedValue == nil {
+			return keyring.ErrKeyNotFound
+		}
+
+		e, err := s.openEntry(id, sealedEntry)
+		if err != nil {
+			return err
+		}
+		data, err := s.open(boltValuesBucket, id, sealedValue)
+		if err != nil {
+			return eris.Wrapf(err, "Failed to decrypt key: %+v", key)
+		}
+		registerSecret(data)
+
+		item = keyring.Item{Key: e.Key, Data: data, Label: e.Label, Description: e.Description}
+		return nil
+	})
+	return item, err
+}
+
+func (s BoltStore) Set(item keyring.Item) error {
+	return s.SetItems([]keyring.Item{item})
+}
+
+// SetItems stores items in a single transaction, either every item is
+// saved or none are
+func (s BoltStore) SetItems(items []keyring.Item) error {
+	return s.update(func(tx *bolt.Tx) error {
+		now := time.Now().UTC()
+		for _, item := range items {
+			id := s.id(item.Key)
+			e := boltEntry{Key: item.Key, Label: item.Label, Description: item.Description, Created: now, Modified: now}
+			if existing := tx.Bucket(boltEntriesBucket).Get(id); existing != nil {
+				previous, err := s.openEntry(id, existing)
+				if err != nil {
+					return err
+				}
+				e.Created = previous.Created
+			}
+
+			b, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			sealedEntry, err := s.seal(boltEntriesBucket, id, b)
+			if err != nil {
+				return err
+			}
+			sealedValue, err := s.seal(boltValuesBucket, id, item.Data)
+			if err != nil {
+				return eris.Wrapf(err, "Failed to encrypt key: %+v", item.Key)
+			}
+			if err := tx.Bucket(boltEntriesBucket).Put(id, sealedEntry); err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltValuesBucket).Put(id, sealedValue); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s BoltStore) Remove(key string) error {
+	if _, err := os.Stat(s.path); errors.Is(err, os.ErrNotExist) {
+		return keyring.ErrKeyNotFound
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		id := s.id(key)
+		if tx.Bucket(boltEntriesBucket).Get(id) == nil {
+			return keyring.ErrKeyNotFound
+		}
+		if err := tx.Bucket(boltEntriesBucket).Delete(id); err != nil {
+			return err
+		}
+		return tx.Bucket(boltValuesBucket).Delete(id)
+	})
+}
+
+// entries decrypts the entry of every key
+func (s BoltStore) entries(tx *bolt.Tx) ([]boltEntry, error) {
+	if !s.initialized(tx) {
+		return nil, nil
+	}
+	if err := s.unlock(tx); err != nil {
+		return nil, err
+	}
+
+	var entries []boltEntry
+	err := tx.Bucket(boltEntriesBucket).ForEach(func(id, sealed []byte) error {
+		e, err := s.openEntry(id, sealed)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+func (s BoltStore) openEntry(id []byte, sealed []byte) (boltEntry, error) {
+	var e boltEntry
+	b, err := s.open(boltEntriesBucket, id, sealed)
+	if err != nil {
+		return e, err
+	}
+	if err := json.Unmarshal(b, &e); err != nil {
+		return e, eris.Wrap(err, "invalid entry in chain database")
+	}
+	if !hmac.Equal(s.id(e.Key), id) {
+		return e, eris.Errorf("entry for %s is stored under the wrong ID", e.Key)
+	}
+	return e, nil
+}
+
+// view runs fn in a read only transaction, a chain without a database
+// is treated as empty
+func (s BoltStore) view(fn func(tx *bolt.Tx) error) error {
+	if _, err := os.Stat(s.path); errors.Is(err, os.ErrNotExist) {
+		return fn(nil)
+	}
+
+	db, err := s.openDB(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+// update runs fn in a read-write transaction, creating the database on
+// first use
+func (s BoltStore) update(fn func(tx *bolt.Tx) error) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	db, err := s.openDB(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		if !s.initialized(tx) {
+			if err := s.initialize(tx); err != nil {
+				return err
+			}
+		} else if err := s.unlock(tx); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+func (s BoltStore) openDB(readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(s.path, secureFSPerm, &bolt.Options{
+		Timeout:  viper.GetDuration(LockTimeoutKey),
+		ReadOnly: readOnly,
+	})
+	if err != nil {
+		return nil, eris.Wrapf(err, "Unable to open chain database: %+v", s.path)
+	}
+	return db, nil
+}
+
+func (s BoltStore) initialized(tx *bolt.Tx) bool {
+	return tx != nil && tx.Bucket(boltMetaBucket) != nil
+}
+
+// initialize creates the buckets and data key of a new database
+func (s BoltStore) initialize(tx *bolt.Tx) error {
+	password, err := getChainPassword(s.chain)
+	if err != nil {
+		return err
+	}
+	kdf, err := newKDFParams()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range [][]byte{boltMetaBucket, boltEntriesBucket, boltValuesBucket} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	dataKey, err := newDataKey()
+	if err != nil {
+		return err
+	}
+	if err := s.writeDataKey(tx, kdf, password, dataKey); err != nil {
+		return err
+	}
+	return s.keys.set(dataKey)
+}
+
+// writeDataKey stores dataKey encrypted with password
+func (s BoltStore) writeDataKey(tx *bolt.Tx, kdf kdfParams, password string, dataKey []byte) error {
+	kdfJSON, err := json.Marshal(kdf)
+	if err != nil {
+		return err
+	}
+	wrapped, err := sealWithParams(kdf, password, dataKey, s.dataKeyAD(kdfJSON))
+	if err != nil {
+		return err
+	}
+
+	meta := tx.Bucket(boltMetaBucket)
+	for k, v := range map[string][]byte{"version": []byte(boltVersion), "kdf": kdfJSON, "data_key": wrapped} {
+		if err := meta.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChangePassword re-encrypts every key under a new data key wrapped with
+// the new password, in a single transaction so an interrupted change
+// leaves the database as it was. The store only switches to the new keys
+// once the transaction is committed.
+func (s BoltStore) ChangePassword(newPassword func() (string, error)) error {
+	if _, err := os.Stat(s.path); errors.Is(err, os.ErrNotExist) {
+		return eris.Errorf("chain %s has no values", s.chain)
+	}
+	// Verify the current password before asking for the new one
+	if _, err := s.Keys(); err != nil {
+		return err
+	}
+	password, err := newPassword()
+	if err != nil {
+		return err
+	}
+
+	next := BoltStore{chain: s.chain, path: s.path, keys: &boltKeys{}}
+	err = s.update(func(tx *bolt.Tx) error {
+		entries, err := s.entries(tx)
+		if err != nil {
+			return err
+		}
+		values := make([][]byte, len(entries))
+		for i, e := range entries {
+			id := s.id(e.Key)
+			if values[i], err = s.open(boltValuesBucket, id, tx.Bucket(boltValuesBucket).Get(id)); err != nil {
+				return eris.Wrapf(err, "Failed to decrypt key: %+v", e.Key)
+			}
+			registerSecret(values[i])
+		}
+
+		var kdf kdfParams
+		if err := json.Unmarshal(tx.Bucket(boltMetaBucket).Get([]byte("kdf")), &kdf); err != nil {
+			return err
+		}
+		params, err := newKDFParams()
+		if err != nil {
+			return err
+		}
+		dataKey, err := newDataKey()
+		if err != nil {
+			return err
+		}
+		if err := next.keys.set(dataKey); err != nil {
+			return err
+		}
+		if err := s.writeDataKey(tx, params.max(kdf), password, dataKey); err != nil {
+			return err
+		}
+
+		// IDs are keyed from the data key so every record moves
+		for _, name := range [][]byte{boltEntriesBucket, boltValuesBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		for i, e := range entries {
+			id := next.id(e.Key)
+			b, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			sealedEntry, err := next.seal(boltEntriesBucket, id, b)
+			if err != nil {
+				return err
+			}
+			sealedValue, err := next.seal(boltValuesBucket, id, values[i])
+			if err != nil {
+				return eris.Wrapf(err, "Failed to encrypt key: %+v", e.Key)
+			}
+			if err := tx.Bucket(boltEntriesBucket).Put(id, sealedEntry); err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltValuesBucket).Put(id, sealedValue); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	*s.keys = *next.keys
+	return nil
+}
+
+// unlock decrypts the data key with the chain's password
+func (s BoltStore) unlock(tx *bolt.Tx) error {
+	if s.keys.data != nil {
+		return nil
+	}
+
+	meta := tx.Bucket(boltMetaBucket)
+	if v := string(meta.Get([]byte("version"))); v != boltVersion {
+		return eris.Errorf("unsupported chain database version %q", v)
+	}
+	kdfJSON := meta.Get([]byte("kdf"))
+	var kdf kdfParams
+	if err := json.Unmarshal(kdfJSON, &kdf); err != nil {
+		return eris.Wrap(err, "invalid key derivation parameters in chain database")
+	}
+
+	password, err := getChainPassword(s.chain)
+	if err != nil {
+		return err
+	}
+	key, err := kdf.derive(password)
+	if err != nil {
+		return err
+	}
+	dataKey, err := xchachaOpen(key, meta.Get([]byte("data_key")), s.dataKeyAD(kdfJSON))
+	if err != nil {
+		return eris.Wrapf(ErrBoltPassword, "Unable to unlock chain database: %+v", s.chain)
+	}
+	return s.keys.set(dataKey)
+}
+
+func (k *boltKeys) set(dataKey []byte) error {
+	index := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dataKey, nil, []byte("chain-bolt/v1 index")), index); err != nil {
+		return err
+	}
+	k.data, k.index = dataKey, index
+	return nil
+}
+
+// id is the name a key is stored under
+func (s BoltStore) id(key string) []byte {
+	mac := hmac.New(sha256.New, s.keys.index)
+	mac.Write([]byte(key))
+	return mac.Sum(nil)
+}
+
+func (s BoltStore) seal(bucket []byte, id []byte, plaintext []byte) ([]byte, error) {
+	return xchachaSeal(s.keys.data, plaintext, s.recordAD(bucket, id))
+}
+
+func (s BoltStore) open(bucket []byte, id []byte, sealed []byte) ([]byte, error) {
+	return xchachaOpen(s.keys.data, sealed, s.recordAD(bucket, id))
+}
+
+func (s BoltStore) recordAD(bucket []byte, id []byte) []byte {
+	return []byte("chain-bolt/v1\n" + s.chain + "\n" + string(bucket) + "\n" + string(id))
+}
+
+// dataKeyAD also authenticates the key derivation parameters, so they
+// can't be weakened without knowing the password
+func (s BoltStore) dataKeyAD(kdfJSON []byte) []byte {
+	return []byte("chain-bolt/v1\n" + s.chain + "\ndata_key\n" + string(kdfJSON))
+}
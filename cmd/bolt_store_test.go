@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/99designs/keyring"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+// usePassword sets the chain password as a new process would read it
+func usePassword(t *testing.T, password string) {
+	t.Helper()
+	viper.Set(KeyringPassword, password)
+	passwordCache = map[string][]byte{}
+	t.Cleanup(func() { passwordCache = map[string][]byte{} })
+}
+
+// rejectNewPassword fails a test which asks for a new password
+func rejectNewPassword(t *testing.T) func() (string, error) {
+	return func() (string, error) {
+		t.Error("asked for a new password before verifying the current one")
+		return "", errors.New("unexpected new password")
+	}
+}
+
+func newPassword(password string) func() (string, error) {
+	return func() (string, error) { return password, nil }
+}
+
+func TestBoltStoreRoundTrip(t *testing.T) {
+	s := newTestBoltStore(t, "bolt")
+	if keys, err := s.Keys(); err != nil || len(keys) != 0 {
+		t.Fatalf("new chain has keys %v: %v", keys, err)
+	}
+	if err := s.(BoltStore).SetItems([]keyring.Item{
+		{Key: "API_TOKEN", Data: []byte("token")},
+		{Key: "DB_PASSWORD", Data: []byte("hunter2")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, s, "API_TOKEN", "rotated")
+
+	s = newTestBoltStoreAt(t, "bolt")
+	assertValue(t, s, "API_TOKEN", "rotated")
+	assertValue(t, s, "DB_PASSWORD", "hunter2")
+	if keys, err := s.Keys(); err != nil || !reflect.DeepEqual(keys, []string{"API_TOKEN", "DB_PASSWORD"}) {
+		t.Errorf("got keys %v: %v", keys, err)
+	}
+
+	if err := s.Remove("API_TOKEN"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("API_TOKEN"); !errors.Is(err, keyring.ErrKeyNotFound) {
+		t.Errorf("removed key: got %v, want ErrKeyNotFound", err)
+	}
+	if err := s.Remove("API_TOKEN"); !errors.Is(err, keyring.ErrKeyNotFound) {
+		t.Errorf("removing a missing key: got %v, want ErrKeyNotFound", err)
+	}
+
+	// Key names are never stored in the clear
+	b, err := os.ReadFile(s.(BoltStore).path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("DB_PASSWORD")) || bytes.Contains(b, []byte("hunter2")) {
+		t.Error("database contains a key name or value in the clear")
+	}
+}
+
+// newTestBoltStoreAt reopens chain in the current test directory
+func newTestBoltStoreAt(t *testing.T, chain string) Store {
+	t.Helper()
+	s, err := NewBoltStore(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestBoltStoreWrongPassword(t *testing.T) {
+	s := newTestBoltStore(t, "bolt")
+	mustSet(t, s, "A", "1")
+	path := s.(BoltStore).path
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usePassword(t, "an incorrect password of some length")
+	s = newTestBoltStoreAt(t, "bolt")
+	if _, err := s.Get("A"); !errors.Is(err, ErrBoltPassword) {
+		t.Errorf("get: got %v, want ErrBoltPassword", err)
+	}
+	if err := s.Set(keyring.Item{Key: "B", Data: []byte("2")}); !errors.Is(err, ErrBoltPassword) {
+		t.Errorf("set: got %v, want ErrBoltPassword", err)
+	}
+	if err := s.(BoltStore).ChangePassword(rejectNewPassword(t)); !errors.Is(err, ErrBoltPassword) {
+		t.Errorf("passwd: got %v, want ErrBoltPassword", err)
+	}
+
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("database was written with an incorrect password")
+	}
+}
+
+func TestBoltStoreChangePassword(t *testing.T) {
+	s := newTestBoltStore(t, "bolt")
+	mustSet(t, s, "A", "1")
+	mustSet(t, s, "B", "2")
+
+	next := "a new password which is long enough"
+	if err := s.(BoltStore).ChangePassword(newPassword(next)); err != nil {
+		t.Fatal(err)
+	}
+	// The store keeps working with the new keys
+	assertValue(t, s, "A", "1")
+	mustSet(t, s, "C", "3")
+
+	s = newTestBoltStoreAt(t, "bolt")
+	if _, err := s.Get("A"); !errors.Is(err, ErrBoltPassword) {
+		t.Errorf("old password: got %v, want ErrBoltPassword", err)
+	}
+	usePassword(t, next)
+	s = newTestBoltStoreAt(t, "bolt")
+	assertValue(t, s, "A", "1")
+	assertValue(t, s, "B", "2")
+	assertValue(t, s, "C", "3")
+}
+
+// updateBolt changes the database of s directly
+func updateBolt(t *testing.T, s Store, fn func(tx *bolt.Tx) error) {
+	t.Helper()
+	db, err := bolt.Open(s.(BoltStore).path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Update(fn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltStoreTamperedRecords(t *testing.T) {
+	s := newTestBoltStore(t, "bolt")
+	mustSet(t, s, "A", "1")
+	mustSet(t, s, "B", "2")
+
+	// Swapping the values of two keys fails authentication
+	updateBolt(t, s, func(tx *bolt.Tx) error {
+		values := tx.Bucket(boltValuesBucket)
+		var ids, sealed [][]byte
+		if err := values.ForEach(func(id, v []byte) error {
+			ids = append(ids, append([]byte(nil), id...))
+			sealed = append(sealed, append([]byte(nil), v...))
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := values.Put(ids[0], sealed[1]); err != nil {
+			return err
+		}
+		return values.Put(ids[1], sealed[0])
+	})
+	s = newTestBoltStoreAt(t, "bolt")
+	for _, key := range []string{"A", "B"} {
+		if _, err := s.Get(key); !errors.Is(err, ErrInvalidEnvelope) {
+			t.Errorf("swapped value of %s: got %v, want ErrInvalidEnvelope", key, err)
+		}
+	}
+
+	// Weakening the key derivation fails authentication of the data key
+	updateBolt(t, s, func(tx *bolt.Tx) error {
+		meta := tx.Bucket(boltMetaBucket)
+		var kdf kdfParams
+		if err := json.Unmarshal(meta.Get([]byte("kdf")), &kdf); err != nil {
+			return err
+		}
+		kdf.Time++
+		b, err := json.Marshal(kdf)
+		if err != nil {
+			return err
+		}
+		return meta.Put([]byte("kdf"), b)
+	})
+	s = newTestBoltStoreAt(t, "bolt")
+	if _, err := s.Keys(); !errors.Is(err, ErrBoltPassword) {
+		t.Errorf("changed key derivation: got %v, want ErrBoltPassword", err)
+	}
+}
@@ -4,12 +4,11 @@ Copyright © 2022 Zander Hill <zander@xargs.io>
 package cmd
 
 import (
-	"errors"
 	"fmt"
 	"os"
-	"path"
 	"strconv"
 
+	"filippo.io/age"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -18,12 +17,30 @@ import (
 
 // createKeysCmd represents the createKeys command
 var createKeysCmd = &cobra.Command{
-	Use:   "create-keys keychain keyCount",
+	Use:   "create-keys keychain [keyCount]",
 	Short: "Create keys which will be used with AGE backends",
 	Long: `
 	chain create-keys [keychain] [keyCount]
+
+	Generates keyCount age keys and prints the private keys.
+
+	Existing ssh keys can be added as recipients, decrypt using the
+	matching private key with CHAIN_SSH_IDENTITY=~/.ssh/id_ed25519
+	chain create-keys [keychain] --ssh-recipient ~/.ssh/id_ed25519.pub
+
+	Or the chain can be decrypted using a passphrase, which is entered
+	at the same prompt as an age private key
+	chain create-keys [keychain] --passphrase
+
+	With --seed the keys are derived from a single seed which is printed
+	as a 24 word mnemonic, only the public keys are stored. Enter the
+	mnemonic at the private key prompt to decrypt, the next unused key
+	is derived from it, see chain keys list
+	chain create-keys [keychain] [keyCount] --seed
 `,
-	Args: cobra.ExactArgs(2),
+	Args:    cobra.RangeArgs(1, 2),
+	PreRun:  lockChainPreRun(exclusiveLock),
+	PostRun: unlockChainPostRun,
 	Run: func(cmd *cobra.Command, args []string) {
 		if !(viper.GetInt(StoreBackendTypeName) == int(chainv1.StorageType_STORAGE_TYPE_AGE_STORE) ||
 			viper.GetInt(StoreBackendTypeName) == int(chainv1.StorageType_STORAGE_TYPE_AGE_OTP_STORE)) {
@@ -32,39 +49,130 @@ var createKeysCmd = &cobra.Command{
 		}
 
 		chain := args[0]
-		amount, err := strconv.Atoi(args[1])
-		if err != nil {
-			log.Fatal().Err(err).Msg("failed to parse input for amount")
+		amount := 0
+		if len(args) == 2 {
+			var err error
+			amount, err = strconv.Atoi(args[1])
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to parse input for amount")
+			}
 		}
-		outputPath := path.Join(filePath(chain), publicKeyFile)
-		if _, err := os.Stat(outputPath); errors.Is(err, os.ErrNotExist) {
-			err = os.MkdirAll(filePath(chain), 0700)
+		if amount == 0 && len(createKeysSSHRecipients) == 0 && !createKeysPassphrase {
+			log.Fatal().Msg("create-keys requires a keyCount, --ssh-recipient or --passphrase")
+		}
+		if createKeysSeed && amount == 0 {
+			log.Fatal().Msg("create-keys --seed requires a keyCount")
+		}
+
+		dir := filePath(chain)
+		if !recipientsExist(dir) {
+			err := os.MkdirAll(dir, 0700)
 			if err != nil && !os.IsExist(err) {
 				log.Fatal().Err(err).Msg("")
 			}
-			ids := createIdentities(amount)
+			registry := &recipientRegistry{Version: 1}
 
-			var recipients []string
-			for _, r := range ids {
-				recipients = append(recipients, r.Recipient().String())
+			var ids []*age.X25519Identity
+			var mnemonic string
+			if createKeysSeed {
+				seed, err := newSeed()
+				if err != nil {
+					log.Fatal().Err(err).Msg("")
+				}
+				mnemonic, err = seedToMnemonic(seed)
+				if err != nil {
+					log.Fatal().Err(err).Msg("")
+				}
+				err = addSeedRecipients(registry, seed, amount, createKeysLabel)
+				if err != nil {
+					log.Fatal().Err(err).Msg("")
+				}
+			} else {
+				ids = createIdentities(amount)
+			}
+
+			for i, r := range ids {
+				_, err := registry.Add(r.Recipient().String(), fmt.Sprintf("%s-%d", createKeysLabel, i+1))
+				if err != nil {
+					log.Fatal().Err(err).Msg("")
+				}
+			}
+			for _, r := range createKeysSSHRecipients {
+				recipient, err := readSSHRecipient(r)
+				if err != nil {
+					log.Fatal().Err(err).Msg("")
+				}
+				_, err = registry.Add(recipient, r)
+				if err != nil {
+					log.Fatal().Err(err).Msg("")
+				}
 			}
 
-			err = setPublicKeys(recipients, outputPath)
+			err = registry.Save(dir)
 			if err != nil {
 				log.Fatal().Err(err).Msg("")
 			}
+
+			if createKeysPassphrase {
+				err = setPassphrase(chain)
+				if err != nil {
+					log.Fatal().Err(err).Msg("")
+				}
+			}
+
+			if mnemonic != "" {
+				fmt.Printf("# Write down this mnemonic and store it safely, it is the only way to decrypt the chain.\n# Enter it at the private key prompt, each use expires one of the %d keys derived from it.\n%s\n", amount, mnemonic)
+				return
+			}
+			if len(ids) == 0 {
+				return
+			}
+			// Printed in the age identity file format
 			privateKeys := ""
-			for _, id := range ids {
-				privateKeys += id.Recipient().String()[:10] + ":" + id.String() + "\n"
+			for i, id := range ids {
+				privateKeys += formatIdentity(registry.Recipients[i], id)
 			}
 
-			fmt.Printf("# Store these keys for decryption.\nIf using age-otp-store, each one will be expired upon use.\n%s\n", privateKeys)
+			fmt.Printf("# Store these keys for decryption, the output can be used as an identity file.\n# If using age-otp-store, each one will be expired upon use.\n%s\n", privateKeys)
 		} else {
-			log.Fatal().Str("outputPath", outputPath).Msg("Exiting because .PUBLIC_KEY already exists. Delete and re-run")
+			log.Fatal().Str("dir", dir).Msg("Exiting because the chain already has public keys. Delete and re-run")
 		}
 	},
 }
 
+var createKeysSSHRecipients []string
+var createKeysPassphrase bool
+var createKeysLabel string
+var createKeysSeed bool
+
 func init() {
+	createKeysCmd.Flags().StringVar(&createKeysLabel, "label", "key", "label for generated keys, numbered from 1")
+	createKeysCmd.Flags().StringArrayVar(&createKeysSSHRecipients, "ssh-recipient", nil, "ssh-ed25519 or ssh-rsa public key, or a path to one, to encrypt to (repeatable)")
+	createKeysCmd.Flags().BoolVar(&createKeysSeed, "seed", false, "derive the keys from a seed printed as a mnemonic instead of printing each private key")
+	createKeysCmd.Flags().BoolVar(&createKeysPassphrase, "passphrase", false, "allow decrypting with a passphrase")
 	RootCmd.AddCommand(createKeysCmd)
 }
+
+// setPassphrase creates the data key for a new chain and encrypts it
+// with a passphrase as well as with the chain's public keys
+func setPassphrase(chain string) error {
+	passphrase, err := getPassword("")
+	if err != nil {
+		return err
+	}
+
+	s := newAgeStore(chain)
+	dataKey, err := newDataKey()
+	if err != nil {
+		return err
+	}
+	if err := s.writePassphraseKey(dataKey, passphrase); err != nil {
+		return err
+	}
+	return s.writeDataKey(dataKey)
+}
+
+// formatIdentity renders a private key in the age identity file format
+func formatIdentity(e recipientEntry, identity *age.X25519Identity) string {
+	return fmt.Sprintf("# label: %s\n# id: %s\n# public key: %s\n%s\n", e.Label, e.ID, e.Recipient, identity.String())
+}
@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// dotenvEntry is a single KEY=VALUE assignment parsed from dotenv input
+type dotenvEntry struct {
+	Key   string
+	Value string
+	Line  int
+}
+
+// dotenvError reports the line on which dotenv parsing failed
+type dotenvError struct {
+	Line int
+	Msg  string
+}
+
+func (e *dotenvError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// parseDotenv reads dotenv formatted input:
+//
+//	# comments and blank lines are ignored
+//	export KEY=value        # "export " prefixes are dropped
+//	KEY=unquoted value      # surrounding whitespace and trailing comments are trimmed
+//	KEY='literal $value'    # single quotes are taken literally
+//	KEY="line\nbreak"       # double quotes support \n \r \t \" \\ and \$ escapes
+//	KEY="first line
+//	second line"            # quoted values may span multiple lines
+func parseDotenv(r io.Reader) ([]dotenvEntry, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimSuffix(scanner.Text(), "\r"))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var entries []dotenvEntry
+	for i := 0; i < len(lines); i++ {
+		lineNumber := i + 1
+		line := strings.TrimSpace(lines[i])
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "export ") || strings.HasPrefix(line, "export\t") {
+			line = strings.TrimSpace(line[len("export"):])
+		}
+
+		key, rest, found := strings.Cut(line, "=")
+		if !found {
+			return nil, &dotenvError{Line: lineNumber, Msg: "expected KEY=VALUE"}
+		}
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return nil, &dotenvError{Line: lineNumber, Msg: "missing key before ="}
+		}
+		rest = strings.TrimLeft(rest, " \t")
+
+		var value string
+		if rest != "" && (rest[0] == '"' || rest[0] == '\'') {
+			var consumed int
+			var err error
+			value, consumed, err = parseDotenvQuoted(lines[i:], rest, lineNumber)
+			if err != nil {
+				return nil, err
+			}
+			i += consumed
+		} else {
+			value = stripDotenvComment(rest)
+		}
+
+		entries = append(entries, dotenvEntry{Key: key, Value: value, Line: lineNumber})
+	}
+
+	return entries, nil
+}
+
+// parseDotenvQuoted parses a quoted value starting at the opening quote in
+// first, continuing onto following lines until the closing quote. It returns
+// the value and how many additional lines were consumed.
+func parseDotenvQuoted(lines []string, first string, lineNumber int) (string, int, error) {
+	quote := first[0]
+	text := first[1:]
+	var value strings.Builder
+
+	for consumed := 0; ; {
+		for j := 0; j < len(text); j++ {
+			c := text[j]
+			switch {
+			case c == quote:
+				trailing := strings.TrimSpace(text[j+1:])
+				if trailing != "" && !strings.HasPrefix(trailing, "#") {
+					return "", 0, &dotenvError{Line: lineNumber + consumed, Msg: "unexpected characters after closing quote"}
+				}
+				return value.String(), consumed, nil
+			case c == '\\' && quote == '"' && j+1 < len(text):
+				j++
+				switch text[j] {
+				case 'n':
+					value.WriteByte('\n')
+				case 'r':
+					value.WriteByte('\r')
+				case 't':
+					value.WriteByte('\t')
+				case '"', '\\', '$':
+					value.WriteByte(text[j])
+				default:
+					value.WriteByte('\\')
+					value.WriteByte(text[j])
+				}
+			default:
+				value.WriteByte(c)
+			}
+		}
+
+		consumed++
+		if consumed >= len(lines) {
+			return "", 0, &dotenvError{Line: lineNumber, Msg: fmt.Sprintf("unterminated %c quoted value", quote)}
+		}
+		value.WriteByte('\n')
+		text = lines[consumed]
+	}
+}
+
+// stripDotenvComment removes a trailing " # comment" from an unquoted value
+func stripDotenvComment(value string) string {
+	for i := 0; i < len(value); i++ {
+		if value[i] == '#' && (i == 0 || value[i-1] == ' ' || value[i-1] == '\t') {
+			value = value[:i]
+			break
+		}
+	}
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,179 @@
+package cmd
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDotenv(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []dotenvEntry
+	}{
+		{
+			name:  "unquoted",
+			input: "A=1\nB = two words \n",
+			want:  []dotenvEntry{{Key: "A", Value: "1", Line: 1}, {Key: "B", Value: "two words", Line: 2}},
+		},
+		{
+			name:  "blank lines and comments",
+			input: "\n# comment\n  # indented comment\n\r\nA=1 # trailing comment\nB=x#not-a-comment\nC=#\n",
+			want: []dotenvEntry{
+				{Key: "A", Value: "1", Line: 5},
+				{Key: "B", Value: "x#not-a-comment", Line: 6},
+				{Key: "C", Value: "", Line: 7},
+			},
+		},
+		{
+			name:  "export prefix",
+			input: "export A=1\nexport\tB=2\nexporter=3\n",
+			want: []dotenvEntry{
+				{Key: "A", Value: "1", Line: 1},
+				{Key: "B", Value: "2", Line: 2},
+				{Key: "exporter", Value: "3", Line: 3},
+			},
+		},
+		{
+			name:  "quoted values keep #",
+			input: `A="a # b" # comment` + "\n" + `B='c # d'` + "\n",
+			want:  []dotenvEntry{{Key: "A", Value: "a # b", Line: 1}, {Key: "B", Value: "c # d", Line: 2}},
+		},
+		{
+			name:  "double quote escapes",
+			input: `A="n\n r\r t\t q\" b\\ d\$ x\y"` + "\n",
+			want:  []dotenvEntry{{Key: "A", Value: "n\n r\r t\t q\" b\\ d$ x\\y", Line: 1}},
+		},
+		{
+			name:  "single quotes are literal",
+			input: `A='$HOME\n "x"'` + "\n",
+			want:  []dotenvEntry{{Key: "A", Value: `$HOME\n "x"`, Line: 1}},
+		},
+		{
+			name:  "multi-line double quoted value",
+			input: "A=\"first\n  second\n\"\nB=after\n",
+			want:  []dotenvEntry{{Key: "A", Value: "first\n  second\n", Line: 1}, {Key: "B", Value: "after", Line: 4}},
+		},
+		{
+			name:  "crlf line endings",
+			input: "A=1\r\nB=\"x\r\ny\"\r\n",
+			want:  []dotenvEntry{{Key: "A", Value: "1", Line: 1}, {Key: "B", Value: "x\ny", Line: 2}},
+		},
+		{
+			name:  "empty input",
+			input: "",
+			want:  nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDotenv(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDotenvErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		line  int
+	}{
+		{"unterminated double quote", "A=1\nB=\"open\nstill open\n", 2},
+		{"unterminated single quote", "A='open", 1},
+		{"characters after closing quote", "A=\"x\" y", 1},
+		{"missing =", "A=1\nB\n", 2},
+		{"missing key", "=1", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseDotenv(strings.NewReader(tt.input))
+			var dErr *dotenvError
+			if !errors.As(err, &dErr) {
+				t.Fatalf("got %v, want a dotenvError", err)
+			}
+			if dErr.Line != tt.line {
+				t.Errorf("error on line %d, want %d: %v", dErr.Line, tt.line, err)
+			}
+		})
+	}
+}
+
+func TestStripDotenvComment(t *testing.T) {
+	for value, want := range map[string]string{
+		"value":            "value",
+		"value # comment":  "value",
+		"value\t# comment": "value",
+		"a#b":              "a#b",
+		"# comment":        "",
+		"  padded  ":       "padded",
+	} {
+		if got := stripDotenvComment(value); got != want {
+			t.Errorf("stripDotenvComment(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+// newTestBoltStore opens chain in a bolt store in a temporary directory
+func newTestBoltStore(t *testing.T, chain string) Store {
+	t.Helper()
+	useTestBoltStore(t)
+	store, err := NewStore(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestProcessStdinEntryKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		raw   bool
+		input string
+		keys  []string
+		err   bool
+	}{
+		{name: "normalized", input: "  export  A_1 = x\n", keys: []string{"A_1"}},
+		{name: "invalid env name", input: "my.key=x\n", err: true},
+		{name: "raw keys", raw: true, input: "my.key=x\n1st=y\n", keys: []string{"1st", "my.key"}},
+		{name: "raw keys still refuse paths", raw: true, input: "../x=y\n", err: true},
+		{name: "raw keys still refuse dot files", raw: true, input: ".MANIFEST=y\n", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestBoltStore(t, "keys")
+			rawKeys := setRawKeys
+			setRawKeys = tt.raw
+			t.Cleanup(func() { setRawKeys = rawKeys })
+			setStdin(t, tt.input)
+
+			err := processStdinEntry(store)
+			if tt.err {
+				if !errors.Is(err, ErrInvalidKey) {
+					t.Fatalf("got %v, want ErrInvalidKey", err)
+				}
+				if keys, _ := store.Keys(); len(keys) != 0 {
+					t.Errorf("saved %v after refusing input", keys)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys, err := store.Keys()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(keys, tt.keys) {
+				t.Errorf("saved keys %v, want %v", keys, tt.keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+
+	"filippo.io/age"
+	"github.com/rotisserie/eris"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Envelope encryption for the age stores
+//
+// Each chain has one random data key. Items are encrypted with the data key
+// using XChaCha20-Poly1305 and only the data key is encrypted with age to the
+// chain's recipients in dataKeyFile. Changing recipients, eg expiring an
+// AgeOTPStore key, rewrites dataKeyFile rather than every item, and reading
+// a chain requires a single age decryption.
+//
+// Envelope file layout: envelopeMagic | JSON envelopeHeader | "\n" | nonce | ciphertext
+//
+// Everything before the nonce is authenticated as additional data, binding
+// the ciphertext to its chain and key. A file copied to another key or
+// chain fails to open instead of being injected under the wrong name.
+//
+// Version 1 envelopes had no header and, like items encrypted directly with
+// age before envelope encryption, are only read by chain migrate, see
+// AgeStore.Migrate.
+
+var dataKeyFile = ".DATA_KEY"
+var envelopeMagic = []byte("chain-envelope/v2\n")
+var envelopeMagicV1 = []byte("chain-envelope/v1\n")
+var ageMagic = []byte("age-encryption.org/")
+
+var ErrInvalidEnvelope = errors.New("invalid envelope")
+var ErrEnvelopeMismatch = errors.New("envelope belongs to a different chain or key")
+var ErrUnboundValue = errors.New("value is not bound to its key and chain, upgrade it with chain migrate")
+
+// envelopeHeader identifies where an envelope belongs. Items scoped to a
+// recipient group are encrypted with that group's data key. Modified is when
+// the value was set in unix nanoseconds, used to resolve conflicts by sync.
+type envelopeHeader struct {
+	Chain    string `json:"chain"`
+	Key      string `json:"key"`
+	Group    string `json:"group,omitempty"`
+	Modified int64  `json:"modified,omitempty"`
+}
+
+func (h envelopeHeader) matches(expected envelopeHeader) bool {
+	return h.Chain == expected.Chain && h.Key == expected.Key && h.Group == expected.Group
+}
+
+func newDataKey() ([]byte, error) {
+	key := secretAlloc(chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, eris.Wrap(err, "Unable to generate data key")
+	}
+	return key, nil
+}
+
+// wrapDataKey encrypts the data key to recipients with age
+func wrapDataKey(dataKey []byte, recipients ...age.Recipient) ([]byte, error) {
+	out := &bytes.Buffer{}
+	w, err := age.Encrypt(out, recipients...)
+	if err != nil {
+		return nil, eris.Wrap(err, "Unable to encrypt data key")
+	}
+	if _, err := w.Write(dataKey); err != nil {
+		return nil, eris.Wrap(err, "Unable to encrypt data key")
+	}
+	if err := w.Close(); err != nil {
+		return nil, eris.Wrap(err, "Unable to encrypt data key")
+	}
+	return out.Bytes(), nil
+}
+
+func sealEnvelope(dataKey []byte, header envelopeHeader, plaintext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	ad := append(append(append([]byte{}, envelopeMagic...), h...), '\n')
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, eris.Wrap(err, "Unable to generate nonce")
+	}
+
+	out := make([]byte, 0, len(ad)+len(nonce)+len(plaintext)+aead.Overhead())
+	out = append(out, ad...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, ad), nil
+}
+
+// openEnvelope decrypts sealed and verifies that it was written for the
+// expected chain, key and group
+func openEnvelope(dataKey []byte, expected envelopeHeader, sealed []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(sealed, envelopeMagicV1) {
+		return openEnvelopeV1(aead, sealed)
+	}
+	if !bytes.HasPrefix(sealed, envelopeMagic) {
+		return nil, ErrInvalidEnvelope
+	}
+
+	header, body, err := readEnvelopeHeader(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidEnvelope
+	}
+	if !header.matches(expected) {
+		return nil, eris.Wrapf(ErrEnvelopeMismatch, "expected chain %q key %q group %q but found chain %q key %q group %q",
+			expected.Chain, expected.Key, expected.Group, header.Chain, header.Key, header.Group)
+	}
+
+	ad := sealed[:len(sealed)-len(body)]
+	nonce, ciphertext := body[:aead.NonceSize()], body[aead.NonceSize():]
+	dst := secretAlloc(len(ciphertext) - aead.Overhead())
+	plaintext, err := aead.Open(dst[:0], nonce, ciphertext, ad)
+	if err != nil {
+		return nil, eris.Wrap(ErrInvalidEnvelope, err.Error())
+	}
+	return plaintext, nil
+}
+
+// readEnvelopeHeader returns the unauthenticated header of a current
+// envelope along with the remaining nonce and ciphertext
+func readEnvelopeHeader(sealed []byte) (envelopeHeader, []byte, error) {
+	var header envelopeHeader
+	if !isCurrentEnvelope(sealed) {
+		return header, nil, ErrInvalidEnvelope
+	}
+
+	h, body, found := bytes.Cut(sealed[len(envelopeMagic):], []byte("\n"))
+	if !found {
+		return header, nil, ErrInvalidEnvelope
+	}
+	if err := json.Unmarshal(h, &header); err != nil {
+		return header, nil, eris.Wrap(ErrInvalidEnvelope, err.Error())
+	}
+	return header, body, nil
+}
+
+func openEnvelopeV1(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < len(envelopeMagicV1)+aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidEnvelope
+	}
+	body := sealed[len(envelopeMagicV1):]
+	nonce, ciphertext := body[:aead.NonceSize()], body[aead.NonceSize():]
+
+	dst := secretAlloc(len(ciphertext) - aead.Overhead())
+	plaintext, err := aead.Open(dst[:0], nonce, ciphertext, envelopeMagicV1)
+	if err != nil {
+		return nil, eris.Wrap(ErrInvalidEnvelope, err.Error())
+	}
+	return plaintext, nil
+}
+
+// isCurrentEnvelope reports whether b uses the current envelope format
+func isCurrentEnvelope(b []byte) bool {
+	return bytes.HasPrefix(b, envelopeMagic)
+}
+
+// isAgeFile reports whether b is an item encrypted directly with age,
+// the format used before envelope encryption
+func isAgeFile(b []byte) bool {
+	return bytes.HasPrefix(b, ageMagic)
+}
@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	key, err := newDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := envelopeHeader{Chain: "aws", Key: "TOKEN", Group: "oncall", Modified: 1}
+	sealed, err := sealEnvelope(key, header, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("secret")) {
+		t.Fatal("value is not encrypted")
+	}
+
+	// Modified is informational and not part of the expected header
+	plaintext, err := openEnvelope(key, envelopeHeader{Chain: "aws", Key: "TOKEN", Group: "oncall"}, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "secret" {
+		t.Errorf("opened %q, want %q", plaintext, "secret")
+	}
+
+	for _, expected := range []envelopeHeader{
+		{Chain: "aws", Key: "OTHER", Group: "oncall"},
+		{Chain: "gcp", Key: "TOKEN", Group: "oncall"},
+		{Chain: "aws", Key: "TOKEN"},
+	} {
+		if _, err := openEnvelope(key, expected, sealed); !errors.Is(err, ErrEnvelopeMismatch) {
+			t.Errorf("opened as %+v: got %v, want ErrEnvelopeMismatch", expected, err)
+		}
+	}
+}
+
+// TestEnvelopeHeaderIsAuthenticated rewrites the header of an envelope to
+// name another key and chain, which must fail to decrypt
+func TestEnvelopeHeaderIsAuthenticated(t *testing.T) {
+	key, err := newDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sealEnvelope(key, envelopeHeader{Chain: "aws", Key: "A"}, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, forged := range map[string][]byte{
+		"key":      bytes.Replace(sealed, []byte(`"key":"A"`), []byte(`"key":"B"`), 1),
+		"chain":    bytes.Replace(sealed, []byte(`"chain":"aws"`), []byte(`"chain":"gcp"`), 1),
+		"modified": bytes.Replace(sealed, []byte(`"key":"A"`), []byte(`"key":"A","modified":1`), 1),
+	} {
+		if bytes.Equal(forged, sealed) {
+			t.Fatalf("%s: header was not rewritten", name)
+		}
+		header, _, err := readEnvelopeHeader(forged)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header.Modified = 0
+		if _, err := openEnvelope(key, header, forged); !errors.Is(err, ErrInvalidEnvelope) {
+			t.Errorf("%s: opened a rewritten header: %v", name, err)
+		}
+	}
+}
+
+// TestEnvelopeCopiedToAnotherKey copies stored values to another key name
+// and another chain, neither of which may read them
+func TestEnvelopeCopiedToAnotherKey(t *testing.T) {
+	useTestAgeStore(t)
+	s, identity := newTestAgeChain(t, "aws")
+	mustSet(t, s, "A", "secret")
+	mustSet(t, s, "B", "other")
+
+	b, err := os.ReadFile(s.FilePath("A"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.FilePath("B"), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateManifest(); err != nil {
+		t.Fatal(err)
+	}
+	s = asIdentity(t, "aws", identity)
+	if _, err := s.Get("B"); !errors.Is(err, ErrEnvelopeMismatch) {
+		t.Errorf("value copied to another key: got %v, want ErrEnvelopeMismatch", err)
+	}
+
+	// A chain sharing the data key, eg a copy of the directory
+	if err := os.Rename(s.Config.FileDir, filePath("gcp")); err != nil {
+		t.Fatal(err)
+	}
+	other := asIdentity(t, "gcp", identity)
+	if err := other.UpdateManifest(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Get("A"); !errors.Is(err, ErrEnvelopeMismatch) {
+		t.Errorf("value copied to another chain: got %v, want ErrEnvelopeMismatch", err)
+	}
+}
+
+func TestUnboundValuesAreRefused(t *testing.T) {
+	useTestAgeStore(t)
+	s, identity := newTestAgeChain(t, "aws")
+	mustSet(t, s, "A", "secret")
+
+	dataKey, err := s.getDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A version 1 envelope, which any holder of the data key could write
+	v1 := sealEnvelopeV1(t, dataKey, []byte("forged"))
+	if plaintext, err := openEnvelope(dataKey, envelopeHeader{}, v1); err != nil || string(plaintext) != "forged" {
+		t.Fatalf("invalid version 1 envelope: %v", err)
+	}
+	if err := os.WriteFile(s.FilePath("A"), v1, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateManifest(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = asIdentity(t, "aws", identity)
+	if _, err := s.Get("A"); !errors.Is(err, ErrUnboundValue) {
+		t.Errorf("got %v, want ErrUnboundValue", err)
+	}
+}
+
+func sealEnvelopeV1(t *testing.T, dataKey []byte, plaintext []byte) []byte {
+	t.Helper()
+	aead, err := chacha20poly1305.NewX(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	out := append(append([]byte{}, envelopeMagicV1...), nonce...)
+	return aead.Seal(out, nonce, plaintext, envelopeMagicV1)
+}
@@ -4,10 +4,14 @@ Copyright © 2022 Zander Hill <zander@xargs.io>
 package cmd
 
 import (
+	"errors"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strconv"
 	"syscall"
 
+	"github.com/rotisserie/eris"
 	"github.com/rs/zerolog/log"
 
 	"github.com/spf13/cobra"
@@ -23,30 +27,132 @@ var execCmd = &cobra.Command{
 	eg:
 	# Fetch from aws-creds keychain use aws commandline tool in that context
 	chain exec aws-creds -- aws s3 ls...
+
+	# Write multiline values such as credential files to a temporary file
+	# and expose its path as <KEY>_FILE, the file is removed when the command exits
+	chain exec gcp --file GCP_CREDENTIALS -- sh -c 'cat $GCP_CREDENTIALS_FILE'
+
+	# Write the value to a temporary file and replace the value of the
+	# env var with the file's path, for tools that only accept a path
+	chain exec gcp --path GOOGLE_APPLICATION_CREDENTIALS -- gcloud auth list
+	chain exec k8s --path KUBECONFIG -- kubectl get pods
+
+	Temporary files are written with 0600 permissions to a private directory
+	on tmpfs ($XDG_RUNTIME_DIR or /dev/shm when available). Files left behind
+	by a crashed invocation are removed the next time exec writes files.
+
+	Values in the environment can be read from /proc/<pid>/environ and are
+	inherited by every process the command starts. Tools which read secrets
+	from a file descriptor, a file or stdin can be given them without the
+	environment. --fd passes the value on a pipe which can be read once,
+	--fd-path passes it on a descriptor which can be opened like a file,
+	a sealed memfd on Linux. --no-env leaves the remaining values out of
+	the environment.
+	chain exec gpg --fd PASSPHRASE -- sh -c 'gpg --passphrase-fd $PASSPHRASE_FD ...'
+	chain exec k8s --no-env --fd-path KUBECONFIG -- kubectl get pods
+	chain exec registry --no-env --stdin TOKEN -- docker login --password-stdin -u me registry.example.com
 `,
-	Args: cobra.MinimumNArgs(2),
+	Args:   cobra.MinimumNArgs(2),
+	PreRun: lockChainPreRun(readLock),
 	Run: func(cmd *cobra.Command, args []string) {
 		chain := args[0]
 		command := args[1]
 		commandArgs := args[2:]
 
-		err := execute(cmd, chain, command, commandArgs)
+		code, err := execute(cmd, chain, command, commandArgs)
 		if err != nil {
-			log.Fatal().Err(err).Str("command", command).Msgf("failed to run syscall %+v with args: %+v", command, commandArgs)
+			log.Fatal().Err(err).Str("command", command).Msgf("failed to run %+v with args: %+v", command, commandArgs)
 			os.Exit(1)
 		}
+		os.Exit(code)
 	},
 }
 
+var execFileKeys []string
+var execPathKeys []string
+var execFDKeys []string
+var execFDPathKeys []string
+var execStdinKey string
+var execNoEnv bool
+
 func init() {
+	execCmd.Flags().StringArrayVar(&execFileKeys, "file", nil, "write the value of KEY to a temporary file and set KEY_FILE to its path (repeatable)")
+	execCmd.Flags().StringArrayVar(&execPathKeys, "path", nil, "write the value of KEY to a temporary file and set KEY to its path (repeatable)")
+	execCmd.Flags().StringArrayVar(&execFDKeys, "fd", nil, "pass the value of KEY on an inherited pipe and set KEY_FD to its file descriptor (repeatable)")
+	execCmd.Flags().StringArrayVar(&execFDPathKeys, "fd-path", nil, "pass the value of KEY on an inherited file descriptor and set KEY to its /dev/fd path (repeatable)")
+	execCmd.Flags().StringVar(&execStdinKey, "stdin", "", "write the value of KEY to the command's stdin")
+	execCmd.Flags().BoolVar(&execNoEnv, "no-env", false, "only pass the keys requested with --fd, --fd-path, --stdin, --file or --path, leaving values out of the environment")
 	RootCmd.AddCommand(execCmd)
 }
 
-func execute(cmd *cobra.Command, chain string, command string, commandArgs []string) error {
-	lines, err := getKVAsEnvLines(cmd, chain)
+func execute(cmd *cobra.Command, chain string, command string, commandArgs []string) (int, error) {
+	argv0, err := exec.LookPath(command)
+	if err != nil {
+		log.Fatal().Msgf("Unable to find command: %s\n", command)
+
+		cmd.Help()
+		os.Exit(1)
+	}
+
+	items, err := getItems(chain)
 	if err != nil {
 		log.Fatal().Msgf("Error getting env lines: %+v", err)
 	}
+	// The command may run for a long time, don't block writers to the chain
+	unlockChainPostRun(cmd, nil)
+
+	deliveries, err := execDeliveries()
+	if err != nil {
+		return 1, err
+	}
+
+	var lines []string
+	var files *secretFiles
+	if len(execFileKeys)+len(execPathKeys) > 0 {
+		removeStaleSecretFiles()
+		files, err = newSecretFiles()
+		if err != nil {
+			return 1, err
+		}
+		defer files.Remove()
+	}
+	// Released by runChild once the command has them
+	fds := &secretFDs{}
+	for _, item := range items {
+		d, ok := deliveries[item.Key]
+		if !ok {
+			if !execNoEnv {
+				lines = append(lines, item.Key+"="+string(item.Data))
+			}
+			continue
+		}
+		delete(deliveries, item.Key)
+
+		var value string
+		switch d.flag {
+		case "--file", "--path":
+			value, err = files.Write(item.Key, item.Data)
+		case "--fd":
+			var fd int
+			fd, err = fds.AddFD(item.Data)
+			value = strconv.Itoa(fd)
+		case "--fd-path":
+			value, err = fds.AddPath(item.Key, item.Data)
+		case "--stdin":
+			err = fds.SetStdin(item.Data)
+		}
+		if err != nil {
+			fds.Release()
+			return 1, err
+		}
+		if d.env != "" {
+			lines = append(lines, d.env+"="+value)
+		}
+	}
+	for k, d := range deliveries {
+		fds.Release()
+		return 1, eris.Errorf("Key requested with %s not found in chain: %+v", d.flag, k)
+	}
 
 	/*
 		See https://github.com/zph/chain/issues/3
@@ -70,19 +176,101 @@ func execute(cmd *cobra.Command, chain string, command string, commandArgs []str
 	kvLines := kvToLines(kvs)
 
 	env = kvLines
-	argv0, err := exec.LookPath(command)
-	if err != nil {
-		log.Fatal().Msgf("Unable to find command: %s\n", command)
+	log.Debug().Str("command", command).Strs("args", commandArgs).Object("env", SecretEnv(env)).Msg("executing command")
+	return runChild(argv0, commandArgs, env, fds)
+}
 
-		cmd.Help()
-		os.Exit(1)
+// execDelivery is how a key requested with one of exec's flags is passed
+// to the command, env is the variable holding its path or descriptor
+type execDelivery struct {
+	flag string
+	env  string
+}
+
+// execDeliveries maps each key requested with --file, --path, --fd,
+// --fd-path or --stdin to how it is passed to the command
+func execDeliveries() (map[string]execDelivery, error) {
+	deliveries := make(map[string]execDelivery)
+	add := func(flag string, keys []string, env func(string) string) error {
+		for _, k := range keys {
+			if d, ok := deliveries[k]; ok {
+				return eris.Errorf("Key requested with both %s and %s: %+v", d.flag, flag, k)
+			}
+			deliveries[k] = execDelivery{flag: flag, env: env(k)}
+		}
+		return nil
+	}
+
+	var stdinKeys []string
+	if execStdinKey != "" {
+		stdinKeys = []string{execStdinKey}
 	}
+	requests := []struct {
+		flag string
+		keys []string
+		env  func(string) string
+	}{
+		{"--file", execFileKeys, func(k string) string { return k + "_FILE" }},
+		{"--path", execPathKeys, func(k string) string { return k }},
+		{"--fd", execFDKeys, func(k string) string { return k + "_FD" }},
+		{"--fd-path", execFDPathKeys, func(k string) string { return k }},
+		{"--stdin", stdinKeys, func(k string) string { return "" }},
+	}
+	for _, r := range requests {
+		if err := add(r.flag, r.keys, r.env); err != nil {
+			return nil, err
+		}
+	}
+	return deliveries, nil
+}
 
-	// Credit: https://raw.githubusercontent.com/99designs/aws-vault/master/cli/exec.go
-	argv := make([]string, 0, 1+len(commandArgs))
-	argv = append(argv, argv0)
-	argv = append(argv, commandArgs...)
+// runChild runs the command as a child process rather than replacing chain
+// via syscall.Exec so that chain can clean up after the command exits.
+// Signals received by chain are forwarded to the child. runChild releases
+// fds once the command has started or failed to.
+func runChild(argv0 string, commandArgs []string, env []string, fds *secretFDs) (int, error) {
+	c := exec.Command(argv0, commandArgs...)
+	c.Env = env
+	c.Stdin = os.Stdin
+	if fds.stdin != nil {
+		c.Stdin = fds.stdin
+	}
+	c.ExtraFiles = fds.files
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	defer signal.Stop(sigs)
 
-	log.Debug().Str("command", command).Strs("args", argv).Strs("env", env).Msg("executing syscall")
-	return syscall.Exec(argv0, argv, env)
+	if err := c.Start(); err != nil {
+		fds.Release()
+		return 1, err
+	}
+	// The command may run for a long time, once it has the values chain
+	// no longer needs them. Values registered for redaction are kept as
+	// chain still logs.
+	released := make(chan struct{})
+	go func() {
+		defer close(released)
+		fds.Release()
+		wipeSecretValues()
+	}()
+
+	go func() {
+		for sig := range sigs {
+			_ = c.Process.Signal(sig)
+		}
+	}()
+
+	err := c.Wait()
+	<-released
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return 1, err
+	}
+	return 0, nil
 }
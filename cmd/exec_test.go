@@ -0,0 +1,176 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/99designs/keyring"
+)
+
+// execTestChain creates a chain holding a value for each of the keys
+func execTestChain(t *testing.T, keys ...string) map[string]string {
+	t.Helper()
+	store := newTestBoltStore(t, "exec")
+	values := make(map[string]string)
+	for _, k := range keys {
+		values[k] = "value-of-" + strings.ToLower(k)
+		if err := store.Set(keyring.Item{Key: k, Data: []byte(values[k])}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return values
+}
+
+// execFlags sets the exec flags for the rest of the test
+func execFlags(t *testing.T, file, path, fd, fdPath []string, stdin string, noEnv bool) {
+	t.Helper()
+	f, p, d, dp, s, n := execFileKeys, execPathKeys, execFDKeys, execFDPathKeys, execStdinKey, execNoEnv
+	t.Cleanup(func() {
+		execFileKeys, execPathKeys, execFDKeys, execFDPathKeys, execStdinKey, execNoEnv = f, p, d, dp, s, n
+	})
+	execFileKeys, execPathKeys, execFDKeys, execFDPathKeys, execStdinKey, execNoEnv = file, path, fd, fdPath, stdin, noEnv
+}
+
+// runExec runs script with sh in the chain and returns what it printed
+func runExec(t *testing.T, script string) string {
+	t.Helper()
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	code, err := execute(execCmd, "exec", "sh", []string{"-c", script})
+	os.Stdout = stdout
+	if err != nil || code != 0 {
+		t.Fatalf("exec exited %d: %v", code, err)
+	}
+
+	b, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestExecDeliveries(t *testing.T) {
+	if !canInheritFDs {
+		t.Skip("file descriptors can't be inherited on this platform")
+	}
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	values := execTestChain(t, "FD", "FD_PATH", "STDIN", "FILE", "PATH_KEY", "ENV")
+	execFlags(t, []string{"FILE"}, []string{"PATH_KEY"}, []string{"FD"}, []string{"FD_PATH"}, "STDIN", false)
+
+	out := runExec(t, `
+		echo "fd=$(cat <&$FD_FD)"
+		echo "fd-path=$(cat $FD_PATH)"
+		echo "fd-path-again=$(cat $FD_PATH)"
+		echo "stdin=$(cat)"
+		echo "file=$(cat $FILE_FILE)"
+		echo "path=$(cat $PATH_KEY)"
+		echo "env=$ENV"
+		echo "fd-env=$FD"
+	`)
+	want := []string{
+		"fd=" + values["FD"],
+		"fd-path=" + values["FD_PATH"],
+		"stdin=" + values["STDIN"],
+		"file=" + values["FILE"],
+		"path=" + values["PATH_KEY"],
+		"env=" + values["ENV"],
+		// Values passed some other way are left out of the environment
+		"fd-env=\n",
+	}
+	if runtime.GOOS == "linux" {
+		// A memfd can be re-read like a file, unlike a pipe
+		want = append(want, "fd-path-again="+values["FD_PATH"])
+	}
+	for _, w := range want {
+		if !strings.Contains(out, w) {
+			t.Errorf("output is missing %q:\n%s", w, out)
+		}
+	}
+
+	// Files are removed when the command exits
+	base, err := secretFilesBaseDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(base); len(entries) != 0 {
+		t.Errorf("secret files left behind in %s", base)
+	}
+}
+
+func TestExecNoEnv(t *testing.T) {
+	if !canInheritFDs {
+		t.Skip("file descriptors can't be inherited on this platform")
+	}
+	values := execTestChain(t, "TOKEN", "OTHER")
+	execFlags(t, nil, nil, []string{"TOKEN"}, nil, "", true)
+
+	out := runExec(t, `cat <&$TOKEN_FD; echo; env`)
+	if !strings.HasPrefix(out, values["TOKEN"]+"\n") {
+		t.Errorf("value not passed on its descriptor:\n%s", out)
+	}
+	env := strings.TrimPrefix(out, values["TOKEN"]+"\n")
+	if !strings.Contains(env, "TOKEN_FD=3\n") {
+		t.Errorf("TOKEN_FD not set:\n%s", env)
+	}
+	for k, v := range values {
+		if strings.Contains(env, v) || strings.Contains(env, "\n"+k+"=") {
+			t.Errorf("%s is in the environment with --no-env:\n%s", k, env)
+		}
+	}
+}
+
+func TestExecMissingDeliveryKey(t *testing.T) {
+	execTestChain(t, "TOKEN")
+	execFlags(t, nil, nil, []string{"MISSING"}, nil, "", false)
+
+	code, err := execute(execCmd, "exec", "true", nil)
+	if err == nil || code == 0 || !strings.Contains(err.Error(), "MISSING") {
+		t.Errorf("got %d, %v, want an error naming the missing key", code, err)
+	}
+}
+
+func TestRemoveStaleSecretFiles(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	base, err := secretFilesBaseDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The pid of a process which has exited
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	dirs := map[int]bool{
+		exited.Process.Pid: false,
+		os.Getpid():        true,
+		os.Getppid():       true,
+	}
+	for pid := range dirs {
+		writeTestFiles(t, filepath.Join(base, fmt.Sprintf("%s%d", secretFilesDirPrefix, pid)), map[string]string{"KEY": "value"})
+	}
+	writeTestFiles(t, filepath.Join(base, "unrelated"), nil)
+
+	removeStaleSecretFiles()
+	for pid, kept := range dirs {
+		_, err := os.Stat(filepath.Join(base, fmt.Sprintf("%s%d", secretFilesDirPrefix, pid)))
+		if kept && err != nil {
+			t.Errorf("removed the files of running process %d", pid)
+		} else if !kept && !os.IsNotExist(err) {
+			t.Errorf("kept the files of exited process %d", pid)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(base, "unrelated")); err != nil {
+		t.Error("removed a directory which doesn't hold secret files")
+	}
+}
@@ -4,9 +4,9 @@ Copyright © 2022 Zander Hill <zander@xargs.io>
 package cmd
 
 import (
-	"fmt"
-	"strings"
+	"os"
 
+	"github.com/rotisserie/eris"
 	"github.com/rs/zerolog/log"
 	chainv1 "github.com/zph/chain/gen/go/chain/v1"
 
@@ -24,6 +24,9 @@ var getCmd = &cobra.Command{
 	eg:
 	# Fetch aws-creds previously set using "chain set aws-creds"
 	chain get aws-creds
+
+	# With age-otp-store, add 10 one-time keys when running low
+	chain get aws-creds --replenish 10
 `,
 	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
@@ -31,23 +34,40 @@ var getCmd = &cobra.Command{
 
 		get(cmd, chain)
 	},
+	PreRun:  lockChainPreRun(readLock),
 	PostRun: getPostRun,
 }
 
 func init() {
+	getCmd.Flags().Int("replenish", 0, "with age-otp-store, number of one-time keys to add when fewer than CHAIN_OTP_WARN_THRESHOLD remain")
+	viper.BindPFlag(OTPReplenishKey, getCmd.Flags().Lookup("replenish"))
 	RootCmd.AddCommand(getCmd)
 }
 
 func get(cmd *cobra.Command, chain string) {
-	lines, err := getKVAsEnvLines(cmd, chain)
+	items, err := getItems(chain)
 	if err != nil {
 		log.Fatal().Msgf("Error getting env lines: %+v", err)
 	}
 
-	fmt.Println(strings.Join(lines, "\n"))
+	store, err := NewStore(chain)
+	if err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	if otp, ok := store.(AgeOTPStore); ok {
+		if err := otp.CheckOneTimeKeys(); err != nil {
+			log.Fatal().Msgf(eris.ToString(err, false))
+		}
+	}
+
+	if err := writeEnvLines(os.Stdout, items); err != nil {
+		log.Fatal().Err(err).Msg("Unable to write values")
+	}
 }
 
 func getPostRun(cmd *cobra.Command, args []string) {
+	defer unlockChainPostRun(cmd, args)
+
 	chain := args[0]
 	store, err := NewStore(chain)
 	if err != nil {
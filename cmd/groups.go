@@ -0,0 +1,356 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/rotisserie/eris"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Recipient groups
+//
+// Items can be scoped to a recipient group, eg "oncall", so that only the
+// members in that group can read them. Each group has its own data key
+// stored in groupKeyFile(group) and encrypted only to the group's active
+// recipients. Members are put in groups with chain members add --group and
+// items with chain set --group.
+//
+// Every member of the chain can edit recipientsFile and re-sign the
+// manifest, so the recipients granted each group are also authenticated
+// with a MAC keyed by the group's data key, see groupMembersMAC. A group's
+// key is only re-encrypted to recipients the MAC vouches for, and only
+// users holding the key can change who it vouches for.
+//
+//	mac = HMAC-SHA256(HKDF-SHA256(group key, info=groupMembersInfo), group | "\n" | grants)
+//
+// grants being the lines "ID public key\n" of each recipient in the group
+// which isn't revoked, sorted.
+
+var groupKeyFilePrefix = dataKeyFile + "."
+
+var groupPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+var groupMembersInfo = []byte("chain-group-members/v1")
+
+var ErrInvalidGroup = errors.New("invalid group name")
+var ErrNotInGroup = errors.New("identity is not a member of the group")
+var ErrGroupMembersChanged = errors.New("group members were changed without the group's key")
+
+func validateGroup(group string) error {
+	if !groupPattern.MatchString(group) {
+		return eris.Wrapf(ErrInvalidGroup, "%q must only contain letters, digits, '_' and '-'", group)
+	}
+	return nil
+}
+
+func groupKeyFile(group string) string {
+	return groupKeyFilePrefix + group
+}
+
+func (e recipientEntry) InGroup(group string) bool {
+	for _, g := range e.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// AddGroup puts the recipient in group
+func (e *recipientEntry) AddGroup(group string) {
+	if !e.InGroup(group) {
+		e.Groups = append(e.Groups, group)
+		sort.Strings(e.Groups)
+	}
+}
+
+// GroupRecipients returns the active recipients in group
+func (r *recipientRegistry) GroupRecipients(group string) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, e := range r.Active() {
+		if !e.InGroup(group) {
+			continue
+		}
+		recipient, err := parseRecipient(e.Recipient)
+		if err != nil {
+			return nil, eris.Wrapf(err, "invalid public key for recipient %s", e.ID)
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, nil
+}
+
+// groupMembers returns the IDs of the active members of each group
+func (r *recipientRegistry) groupMembers() map[string]string {
+	members := make(map[string]string)
+	for _, e := range r.Active() {
+		for _, g := range e.Groups {
+			members[g] += e.ID + " "
+		}
+	}
+	return members
+}
+
+// groupGrants returns the recipients granted group which aren't revoked,
+// as authenticated by groupMembersMAC
+func (r *recipientRegistry) groupGrants(group string) []string {
+	var grants []string
+	for _, e := range r.Recipients {
+		if e.InGroup(group) && e.State != recipientRevoked {
+			grants = append(grants, e.ID+" "+e.Recipient)
+		}
+	}
+	sort.Strings(grants)
+	return grants
+}
+
+func groupMembersMAC(key []byte, group string, grants []string) ([]byte, error) {
+	macKey := secretAlloc(32)
+	defer wipe(macKey)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, groupMembersInfo), macKey); err != nil {
+		return nil, err
+	}
+	m := hmac.New(sha256.New, macKey)
+	m.Write([]byte(group + "\n"))
+	for _, g := range grants {
+		m.Write([]byte(g + "\n"))
+	}
+	return m.Sum(nil), nil
+}
+
+// signGroupMembers vouches for the recipients currently granted group with
+// the group's key
+func (r *recipientRegistry) signGroupMembers(group string, key []byte) error {
+	mac, err := groupMembersMAC(key, group, r.groupGrants(group))
+	if err != nil {
+		return err
+	}
+	if r.GroupMACs == nil {
+		r.GroupMACs = make(map[string][]byte)
+	}
+	r.GroupMACs[group] = mac
+	return nil
+}
+
+// verifyGroupMembers fails with ErrGroupMembersChanged unless the
+// recipients granted group were signed with the group's key
+func (r *recipientRegistry) verifyGroupMembers(group string, key []byte) error {
+	mac, err := groupMembersMAC(key, group, r.groupGrants(group))
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, r.GroupMACs[group]) {
+		return eris.Wrapf(ErrGroupMembersChanged, "%s in %s", group, recipientsFile)
+	}
+	return nil
+}
+
+// checkGroupChanges fails when the members of a group would change without
+// the user holding its data key, as only its members may grant it. The
+// members of the groups the user holds the key of are verified as they
+// were and signed as they will be.
+func (s AgeStore) checkGroupChanges(before, after *recipientRegistry) error {
+	groups, err := s.groups()
+	if err != nil {
+		return err
+	}
+
+	b, a := before.groupMembers(), after.groupMembers()
+	for _, group := range groups {
+		key, err := s.getGroupKey(group)
+		if errors.Is(err, ErrNotInGroup) {
+			if b[group] != a[group] || strings.Join(before.groupGrants(group), "\n") != strings.Join(after.groupGrants(group), "\n") {
+				return eris.Wrapf(err, "only a member of group %s can change its members", group)
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := before.verifyGroupMembers(group, key); err != nil {
+			return err
+		}
+		if err := after.signGroupMembers(group, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groups lists the groups which have a data key in the chain
+func (s AgeStore) groups() ([]string, error) {
+	entries, err := os.ReadDir(s.Config.FileDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), groupKeyFilePrefix) && !strings.Contains(e.Name(), ".tmp-") {
+			groups = append(groups, strings.TrimPrefix(e.Name(), groupKeyFilePrefix))
+		}
+	}
+	return groups, nil
+}
+
+// getGroupKey decrypts the group's data key, failing with ErrNotInGroup
+// when none of the user's identities are in the group
+func (s AgeStore) getGroupKey(group string) ([]byte, error) {
+	if key, ok := s.cache.groupKeys[group]; ok {
+		return key, nil
+	}
+	if err := validateGroup(group); err != nil {
+		return nil, err
+	}
+
+	wrapped, err := os.ReadFile(s.FilePath(groupKeyFile(group)))
+	if err != nil {
+		return nil, eris.Wrapf(err, "Failed to read data key for group: %+v", group)
+	}
+
+	identities, err := s.getIdentities()
+	if err != nil {
+		return nil, err
+	}
+	// Passphrases only ever decrypt passphraseKeyFile
+	var others []age.Identity
+	for _, identity := range identities {
+		if _, ok := identity.(*age.ScryptIdentity); !ok {
+			others = append(others, identity)
+		}
+	}
+	if len(others) == 0 {
+		return nil, eris.Wrapf(ErrNotInGroup, "%s", group)
+	}
+
+	r, err := age.Decrypt(bytes.NewReader(wrapped), others...)
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		return nil, eris.Wrapf(ErrNotInGroup, "%s", group)
+	} else if err != nil {
+		return nil, eris.Wrapf(err, "Unable to decrypt data key for group: %+v", group)
+	}
+	key, err := readSecret(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != chacha20poly1305.KeySize {
+		return nil, eris.New("Unable to decrypt data key: unexpected length")
+	}
+
+	s.cache.groupKeys[group] = key
+	return key, nil
+}
+
+// ensureGroupKey returns the group's data key, creating one encrypted to
+// the group's members when the group has no items yet
+func (s AgeStore) ensureGroupKey(group string) ([]byte, error) {
+	if err := validateGroup(group); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(s.FilePath(groupKeyFile(group))); err == nil {
+		return s.getGroupKey(group)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := newDataKey()
+	if err != nil {
+		return nil, err
+	}
+	registry, err := loadRecipients(s.Config.FileDir)
+	if err != nil {
+		return nil, err
+	}
+	// Signed before the key is written, which is what makes it a group
+	if err := registry.signGroupMembers(group, key); err != nil {
+		return nil, err
+	}
+	if err := registry.Save(s.Config.FileDir); err != nil {
+		return nil, err
+	}
+	if err := s.writeGroupKey(registry, group, key); err != nil {
+		return nil, err
+	}
+	s.cache.groupKeys[group] = key
+	return key, nil
+}
+
+func (s AgeStore) writeGroupKey(registry *recipientRegistry, group string, key []byte) error {
+	recipients, err := registry.GroupRecipients(group)
+	if err != nil {
+		return err
+	}
+	if len(recipients) == 0 {
+		return eris.Errorf("group %s has no active members, add one with chain members add --group %s", group, group)
+	}
+
+	wrapped, err := wrapDataKey(key, recipients...)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.FilePath(groupKeyFile(group)), wrapped, secureFSPerm)
+}
+
+// groupKeysToWrite returns the data keys of the groups the user is a member
+// of, failing with ErrGroupMembersChanged when the members registry grants
+// weren't signed with the group's key
+func (s AgeStore) groupKeysToWrite(registry *recipientRegistry) (map[string][]byte, error) {
+	groups, err := s.groups()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string][]byte)
+	for _, group := range groups {
+		key, err := s.getGroupKey(group)
+		if errors.Is(err, ErrNotInGroup) {
+			log.Debug().Str("group", group).Msg("Not a member of group, leaving its members unchanged")
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if err := registry.verifyGroupMembers(group, key); err != nil {
+			return nil, err
+		}
+		keys[group] = key
+	}
+	return keys, nil
+}
+
+// writeGroupKeys re-encrypts the data keys returned by groupKeysToWrite to
+// each group's current members
+func (s AgeStore) writeGroupKeys(registry *recipientRegistry, keys map[string][]byte) error {
+	for group, key := range keys {
+		if err := s.writeGroupKey(registry, group, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// itemGroup returns the group of a stored item, "" when it has none
+func (s AgeStore) itemGroup(key string) (string, error) {
+	b, err := os.ReadFile(s.FilePath(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if !isCurrentEnvelope(b) {
+		return "", nil
+	}
+
+	header, _, err := readEnvelopeHeader(b)
+	return header.Group, err
+}
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"errors"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/99designs/keyring"
+)
+
+// newTestGroupChain creates chain with a value in group "oncall", which
+// only its owner is a member of, and bob who is only a member of the chain
+func newTestGroupChain(t *testing.T) (owner *age.X25519Identity, bob *age.X25519Identity) {
+	t.Helper()
+	useTestAgeStore(t)
+	s, owner := newTestAgeChain(t, "aws")
+	bob = newTestIdentity(t)
+	if err := s.UpdateRecipients(func(r *recipientRegistry) error {
+		o, err := r.Find("owner")
+		if err != nil {
+			return err
+		}
+		o.AddGroup("oncall")
+		_, err = r.Add(bob.Recipient().String(), "bob")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, s, "A", "1")
+	if err := s.SetInGroup(keyring.Item{Key: "DB", Data: []byte("secret")}, "oncall"); err != nil {
+		t.Fatal(err)
+	}
+	return owner, bob
+}
+
+// editRecipients changes the registry as a member of the chain, re-signing
+// the manifest with the chain's data key
+func editRecipients(t *testing.T, s AgeStore, edit func(r *recipientRegistry)) {
+	t.Helper()
+	dataKey, err := s.getDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, err := loadRecipients(s.Config.FileDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit(registry)
+	if err := registry.Save(s.Config.FileDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeManifest(s.Config.FileDir, s.Config.ServiceName, dataKey); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGroupMembersNeedGroupKey(t *testing.T) {
+	owner, bob := newTestGroupChain(t)
+
+	s := asIdentity(t, "aws", bob)
+	if _, err := s.Get("DB"); !errors.Is(err, ErrNotInGroup) {
+		t.Fatalf("non-member reading a group value: got %v, want ErrNotInGroup", err)
+	}
+	err := s.UpdateRecipients(func(r *recipientRegistry) error {
+		e, err := r.Find("bob")
+		if err == nil {
+			e.AddGroup("oncall")
+		}
+		return err
+	})
+	if !errors.Is(err, ErrNotInGroup) {
+		t.Errorf("non-member joining a group: got %v, want ErrNotInGroup", err)
+	}
+
+	// Editing the registry directly isn't enough either
+	editRecipients(t, s, func(r *recipientRegistry) {
+		e, err := r.Find("bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.AddGroup("oncall")
+	})
+	s = asIdentity(t, "aws", owner)
+	dataKey, err := s.getDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.writeDataKey(dataKey); !errors.Is(err, ErrGroupMembersChanged) {
+		t.Errorf("re-encrypting the group key: got %v, want ErrGroupMembersChanged", err)
+	}
+	err = s.UpdateRecipients(func(r *recipientRegistry) error { return nil })
+	if !errors.Is(err, ErrGroupMembersChanged) {
+		t.Errorf("updating the registry: got %v, want ErrGroupMembersChanged", err)
+	}
+	if _, err := asIdentity(t, "aws", bob).Get("DB"); !errors.Is(err, ErrNotInGroup) {
+		t.Errorf("group key was re-encrypted to a non-member: %v", err)
+	}
+}
+
+func TestGroupMembersAddedByMember(t *testing.T) {
+	owner, bob := newTestGroupChain(t)
+
+	s := asIdentity(t, "aws", owner)
+	if err := s.UpdateRecipients(func(r *recipientRegistry) error {
+		e, err := r.Find("bob")
+		if err == nil {
+			e.AddGroup("oncall")
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assertValue(t, asIdentity(t, "aws", bob), "DB", "secret")
+
+	// Removing bob rotates the group key, which a revoked member can't get
+	// back by reactivating themselves
+	if _, _, err := asIdentity(t, "aws", owner).RemoveRecipient("bob"); err != nil {
+		t.Fatal(err)
+	}
+	editRecipients(t, asIdentity(t, "aws", owner), func(r *recipientRegistry) {
+		if _, err := r.SetState("bob", recipientActive); err != nil {
+			t.Fatal(err)
+		}
+	})
+	s = asIdentity(t, "aws", owner)
+	assertValue(t, s, "DB", "secret")
+	dataKey, err := s.getDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.writeDataKey(dataKey); !errors.Is(err, ErrGroupMembersChanged) {
+		t.Errorf("re-encrypting the group key: got %v, want ErrGroupMembersChanged", err)
+	}
+}
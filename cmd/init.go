@@ -27,13 +27,23 @@ var initCmd = &cobra.Command{
 			log.Fatal().Msg(err.Error())
 		}
 		configFile := "." + ConfigPrefix + "/.chain.hcl"
-		// Setting one empty, which will be rejected as invalid for safety
-		viper.Set(KeyringPassword, "")
+		// Passwords are never written to the config file, which is
+		// plaintext, password_command is written in their place
+		settings := viper.AllSettings()
+		delete(settings, KeyringPassword)
+		delete(settings, NewPasswordKey)
+		delete(settings, PasswordFDKey)
+		settings[PasswordCommandKey] = viper.GetString(PasswordCommandKey)
 
 		// Removing these because they're currently not used
-		viper.Set(KeyringServiceKey, "")
-		viper.Set(KeyringUserKey, "")
-		err = viper.SafeWriteConfigAs(configFile)
+		settings[KeyringServiceKey] = ""
+		settings[KeyringUserKey] = ""
+
+		config := viper.New()
+		for k, v := range settings {
+			config.Set(k, v)
+		}
+		err = config.SafeWriteConfigAs(configFile)
 		if err != nil {
 			log.Fatal().Msgf("Unable write file %+v\n", err)
 		}
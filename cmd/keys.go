@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/rotisserie/eris"
+)
+
+var ErrInvalidKey = errors.New("invalid key name")
+
+// POSIX portable environment variable names
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// normalizeKey trims surrounding whitespace from key and validates it.
+//
+// By default keys must be valid POSIX environment variable names. With raw
+// set any name is accepted which is safe to use as a single file name
+// within a chain directory, see validateKeyPath.
+func normalizeKey(key string, raw bool) (string, error) {
+	key = strings.TrimSpace(key)
+
+	if err := validateKeyPath(key); err != nil {
+		return "", err
+	}
+
+	if !raw && !envKeyPattern.MatchString(key) {
+		return "", eris.Wrapf(ErrInvalidKey, "%q is not a valid environment variable name, use --raw-keys to allow it", key)
+	}
+
+	return key, nil
+}
+
+// validateKeyPath rejects keys that could resolve outside of the chain
+// directory or collide with chain's own files when used as a file name
+func validateKeyPath(key string) error {
+	switch {
+	case key == "":
+		return eris.Wrap(ErrInvalidKey, "key must not be empty")
+	case strings.ContainsAny(key, "/\\\x00"):
+		return eris.Wrapf(ErrInvalidKey, "%q must not contain path separators or NUL", key)
+	case strings.HasPrefix(key, "."):
+		return eris.Wrapf(ErrInvalidKey, "%q must not start with '.'", key)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+/*
+Copyright © 2022 Zander Hill <zander@xargs.io>
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rotisserie/eris"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// keysCmd represents the keys command
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage the public keys an AGE chain is encrypted to",
+	Long: `
+	Manage the public keys an AGE chain is encrypted to
+
+	Each public key has a stable ID (the SHA-256 of the key), a label and
+	a state: active keys are encrypted to, used keys are one-time keys
+	which were expired by age-otp-store and revoked keys were removed.
+
+	eg:
+	chain keys list aws-creds
+	chain keys status aws-creds
+	chain keys revoke aws-creds key-3
+`,
+}
+
+var keysListCmd = &cobra.Command{
+	Use:     "list [keychain]",
+	Short:   "List public keys with their ID, state and label",
+	Args:    cobra.ExactArgs(1),
+	PreRun:  lockChainPreRun(sharedLock),
+	PostRun: unlockChainPostRun,
+	Run: func(cmd *cobra.Command, args []string) {
+		manager, err := newRecipientManager(args[0])
+		if err != nil {
+			log.Fatal().Msgf(eris.ToString(err, true))
+		}
+
+		registry, err := manager.Recipients()
+		if err != nil {
+			log.Fatal().Msgf(eris.ToString(err, true))
+		}
+		fmt.Println(recipientsReport(registry.Recipients))
+		if indexes := registry.SeedIndexes(); len(indexes) > 0 {
+			fmt.Printf("Next seed index: %d\n", indexes[0])
+		}
+	},
+}
+
+var keysStatusCmd = &cobra.Command{
+	Use:     "status [keychain]",
+	Short:   "Show how many one-time keys remain",
+	Args:    cobra.ExactArgs(1),
+	PreRun:  lockChainPreRun(sharedLock),
+	PostRun: unlockChainPostRun,
+	Run: func(cmd *cobra.Command, args []string) {
+		chain := args[0]
+		manager, err := newRecipientManager(chain)
+		if err != nil {
+			log.Fatal().Msgf(eris.ToString(err, true))
+		}
+
+		registry, err := manager.Recipients()
+		if err != nil {
+			log.Fatal().Msgf(eris.ToString(err, true))
+		}
+
+		active, used := registry.OneTimeKeys()
+		others := len(registry.Active()) - active
+		_, err = os.Stat(filepath.Join(filePath(chain), passphraseKeyFile))
+		threshold := viper.GetInt(OTPWarnThresholdKey)
+
+		fmt.Printf("one-time keys remaining: %d\n", active)
+		fmt.Printf("one-time keys used: %d\n", used)
+		fmt.Printf("other public keys: %d\n", others)
+		fmt.Printf("passphrase: %t\n", err == nil)
+		if indexes := registry.SeedIndexes(); len(indexes) > 0 {
+			fmt.Printf("next seed index: %d\n", indexes[0])
+		}
+		if _, ok := manager.(AgeOTPStore); ok && active < threshold {
+			fmt.Printf("LOW: fewer than %d one-time keys remain, add more with chain get %s --replenish N\n", threshold, chain)
+		}
+	},
+}
+
+var keysRevokeCmd = &cobra.Command{
+	Use:     "revoke [keychain] [id|label]",
+	Short:   "Stop encrypting to a public key",
+	Args:    cobra.ExactArgs(2),
+	PreRun:  lockChainPreRun(exclusiveLock),
+	PostRun: unlockChainPostRun,
+	Run: func(cmd *cobra.Command, args []string) {
+		manager, err := newRecipientManager(args[0])
+		if err != nil {
+			log.Fatal().Msgf(eris.ToString(err, true))
+		}
+
+		err = manager.UpdateRecipients(func(r *recipientRegistry) error {
+			_, err := r.SetState(args[1], recipientRevoked)
+			return err
+		})
+		if err != nil {
+			log.Fatal().Msgf(eris.ToString(err, true))
+		}
+	},
+}
+
+func init() {
+	keysCmd.AddCommand(keysListCmd)
+	keysCmd.AddCommand(keysStatusCmd)
+	keysCmd.AddCommand(keysRevokeCmd)
+	RootCmd.AddCommand(keysCmd)
+}
+
+// recipientManager is implemented by stores which encrypt to a recipient registry
+type recipientManager interface {
+	Recipients() (*recipientRegistry, error)
+	UpdateRecipients(func(*recipientRegistry) error) error
+}
+
+func newRecipientManager(chain string) (recipientManager, error) {
+	store, err := NewStore(chain)
+	if err != nil {
+		return nil, eris.Wrapf(err, "Unable to open keyring for chain: %+v", chain)
+	}
+
+	manager, ok := store.(recipientManager)
+	if !ok {
+		return nil, eris.Errorf("keys is only supported for AGE backends, not %s", store.Name())
+	}
+	return manager, nil
+}
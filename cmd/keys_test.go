@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateKeyPath(t *testing.T) {
+	for _, key := range []string{"API_TOKEN", "my.key", "a..b", "1st", "-"} {
+		if err := validateKeyPath(key); err != nil {
+			t.Errorf("%q refused: %v", key, err)
+		}
+	}
+	for _, key := range []string{"", "../x", "..", ".", "a/b", "/abs", `a\b`, `..\x`, "a\x00b", ".MANIFEST", ".hidden"} {
+		if err := validateKeyPath(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("%q returned %v, want ErrInvalidKey", key, err)
+		}
+	}
+}
+
+func TestNormalizeKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		raw  bool
+		want string
+		err  bool
+	}{
+		{key: " API_TOKEN\t", want: "API_TOKEN"},
+		{key: "_x1", want: "_x1"},
+		{key: "1st", err: true},
+		{key: "my.key", err: true},
+		{key: "my.key", raw: true, want: "my.key"},
+		{key: " ", raw: true, err: true},
+		{key: " ../x", raw: true, err: true},
+		{key: ".x", raw: true, err: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeKey(tt.key, tt.raw)
+		if tt.err {
+			if !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("normalizeKey(%q, %v) returned %q, %v, want ErrInvalidKey", tt.key, tt.raw, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeKey(%q, %v) = %q, %v, want %q", tt.key, tt.raw, got, err, tt.want)
+		}
+	}
+}
@@ -1,34 +1,82 @@
 package cmd
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/rs/zerolog/log"
 
-	"github.com/manifoldco/promptui"
+	"github.com/99designs/keyring"
 	"github.com/rotisserie/eris"
-	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
-// TODO: use XDG config dir
-func filePath(name string) string {
-	dir := viper.GetString(ChainDirKey)
-	var path string
+var ErrInvalidChainName = errors.New("invalid chain name")
+
+// Chain names are one or more "/" separated segments, eg "aws" or
+// "team/aws/prod". Segments may not start with "." which rules out
+// "." and ".." along with hidden files used by the stores.
+var chainSegmentPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+func validateChainName(name string) error {
+	if name == "" {
+		return eris.Wrap(ErrInvalidChainName, "chain name must not be empty")
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if !chainSegmentPattern.MatchString(segment) {
+			return eris.Wrapf(ErrInvalidChainName, "%q must be '/' separated segments of letters, digits, '_', '-' or '.' not starting with '.'", name)
+		}
+	}
+	return nil
+}
 
-	if dir != "" {
-		path = filepath.Join(dir, name)
-	} else {
+// chainDataDir returns the directory in which chains are stored.
+//
+// In order of precedence that is CHAIN_DIR (or dir in the config file),
+// a .chain directory in the working directory, or $XDG_DATA_HOME/chain
+// which defaults to ~/.local/share/chain
+func chainDataDir() string {
+	if dir := viper.GetString(ChainDirKey); dir != "" {
+		return dir
+	}
+
+	local := "." + ConfigPrefix
+	if info, err := os.Stat(local); err == nil && info.IsDir() {
+		return local
+	}
+
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" || !filepath.IsAbs(dataHome) {
 		home, err := os.UserHomeDir()
 		if err != nil {
 			log.Fatal().Msg(err.Error())
 		}
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+
+	return filepath.Join(dataHome, ConfigPrefix)
+}
+
+func filePath(name string) string {
+	if err := validateChainName(name); err != nil {
+		log.Fatal().Msg(err.Error())
+	}
 
-		path = filepath.Join(home, dir, name)
+	dir := chainDataDir()
+	path := filepath.Join(dir, filepath.FromSlash(name))
+
+	// Defense in depth on top of validateChainName
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		log.Fatal().Str("chain", name).Msg("chain path resolves outside of the chain directory")
 	}
 
 	return path
@@ -56,61 +104,296 @@ func kvToLines(kvs map[string]string) []string {
 
 }
 
+func validatePassword(input string) error {
+	if len(input) < viper.GetInt(PasswordValidationLength) {
+		return errors.New("password must have more than 20 characters")
+	}
+	return nil
+}
+
+// Password sources
+//
+// The chain password is read from the first of these which is configured
+// and then reused for the rest of the run:
+//
+//	CHAIN_PASSWORD_FD       an inherited file descriptor, eg 3 with 3< <(pass show chain)
+//	password_command        the first line of the output of a shell command,
+//	                        eg "pass show chain", which gets the chain in CHAIN_NAME
+//	CHAIN_PASSWORD          the environment or the config file, discouraged since
+//	                        child processes inherit the environment and the
+//	                        config file is plaintext
+//	pinentry                a pinentry program, eg pinentry-curses, see pinentry.go
+//	a prompt on the terminal
+
+// passwordCache holds passwords already read in this run by chain, "" for
+// passwords which are not for a single chain. The passwords are kept in
+// secret memory, see memory.go.
+var passwordCache = map[string][]byte{}
+
+// fdPassword is the password read from CHAIN_PASSWORD_FD, which can only
+// be read once, in secret memory
+var fdPassword []byte
+
+var warnedPasswordSources = map[string]bool{}
+
 func getPassword(_s string) (string, error) {
-	validate := func(input string) error {
-		if len(input) < viper.GetInt(PasswordValidationLength) {
-			return errors.New("password must have more than 20 characters")
+	return acquirePassword("")
+}
+
+func acquirePassword(chain string) (string, error) {
+	if p, ok := passwordCache[chain]; ok {
+		return string(p), nil
+	}
+	p, err := readPassword(chain)
+	if err != nil {
+		return "", err
+	}
+	b := []byte(p)
+	defer wipe(b)
+	registerSecret(b)
+	if err := validatePassword(p); err != nil {
+		return "", err
+	}
+	passwordCache[chain] = secretCopy(b)
+	return p, nil
+}
+
+func readPassword(chain string) (string, error) {
+	if fd := viper.GetString(PasswordFDKey); fd != "" {
+		return readPasswordFD(fd)
+	}
+	if command := viper.GetString(PasswordCommandKey); command != "" {
+		return runPasswordCommand(command, chain)
+	}
+	if p := viper.GetString(KeyringPassword); p != "" {
+		if os.Getenv("CHAIN_PASSWORD") != "" {
+			warnPasswordSource("CHAIN_PASSWORD", envPasswordRisk)
+		} else {
+			warnPasswordSource("the config file "+viper.ConfigFileUsed(), "where it is stored in plaintext")
 		}
-		return nil
+		return p, nil
+	}
+	if program := viper.GetString(PinentryKey); program != "" {
+		return pinentry(program, passwordDescription(chain), "Password:")
 	}
-	p := viper.GetString(KeyringPassword)
-	if p == "" {
-		prompt := promptui.Prompt{
-			Label:    "Password",
-			Validate: validate,
-			Mask:     '*',
+
+	return promptForInput("Password:", true, validatePassword)
+}
+
+func passwordDescription(chain string) string {
+	if chain == "" {
+		return "Enter the chain password"
+	}
+	return fmt.Sprintf("Enter the password for chain %s", chain)
+}
+
+var envPasswordRisk = "which every child process inherits"
+
+// warnPasswordSource warns once per source that a password was read from
+// the environment or the config file
+func warnPasswordSource(source string, risk string) {
+	if warnedPasswordSources[source] {
+		return
+	}
+	warnedPasswordSources[source] = true
+	log.Warn().Msgf("INSECURE: password read from %s, %s. Use CHAIN_PASSWORD_FD, CHAIN_PASSWORD_COMMAND or CHAIN_PINENTRY instead", source, risk)
+}
+
+func readPasswordFD(fd string) (string, error) {
+	if fdPassword != nil {
+		return string(fdPassword), nil
+	}
+	n, err := strconv.Atoi(fd)
+	if err != nil || n < 0 {
+		return "", eris.Errorf("CHAIN_PASSWORD_FD must be a file descriptor number, not %q", fd)
+	}
+	f := os.NewFile(uintptr(n), "password-fd")
+	if f == nil {
+		return "", eris.Errorf("invalid CHAIN_PASSWORD_FD %d", n)
+	}
+	defer f.Close()
+	b, err := readSecret(f)
+	defer wipe(b)
+	if err != nil {
+		return "", eris.Wrapf(err, "Unable to read password from file descriptor %d", n)
+	}
+	fdPassword = secretCopy(bytes.TrimSuffix(bytes.TrimSuffix(b, []byte("\n")), []byte("\r")))
+	return string(fdPassword), nil
+}
+
+// runPasswordCommand returns the first line of the command's output, so
+// pass entries with extra lines work unchanged
+func runPasswordCommand(command string, chain string) (string, error) {
+	c := shellCommand(command)
+	c.Env = append(os.Environ(), "CHAIN_NAME="+chain)
+	// The command may prompt on the terminal, but not read stdin which may
+	// be carrying piped data, eg echo K=V | chain set x
+	if in, out, err := openTTY(); err == nil {
+		defer in.Close()
+		if out != in {
+			out.Close()
 		}
+		c.Stdin = in
+	}
+	c.Stderr = os.Stderr
+	out, err := c.Output()
+	defer wipe(out)
+	if err != nil {
+		return "", eris.Wrapf(err, "password_command failed: %+v", command)
+	}
+	line, _, _ := bytes.Cut(out, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if len(line) == 0 {
+		return "", eris.Errorf("password_command printed no password: %+v", command)
+	}
+	return string(line), nil
+}
 
-		result, err := prompt.Run()
+// chainPasswordEnv is the environment variable holding the password of a
+// single chain, eg CHAIN_PASSWORD_TEAM_AWS for "team/aws"
+func chainPasswordEnv(chain string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(chain))
+	return strings.ToUpper(ConfigPrefix) + "_PASSWORD_" + name
+}
 
+// getChainPassword returns the password of chain, preferring its own
+// CHAIN_PASSWORD_<CHAIN> over the password sources shared by every chain.
+// Chains named "fd" or "command" can't use it, nor can chains whose names
+// only differ in case or punctuation, eg "a-b" and "a_b". Without the
+// environment, password_command gets the chain's name in CHAIN_NAME and
+// can print a different password for each chain.
+func getChainPassword(chain string) (string, error) {
+	env := chainPasswordEnv(chain)
+	if p := os.Getenv(env); p != "" && env != "CHAIN_PASSWORD_FD" && env != "CHAIN_PASSWORD_COMMAND" {
+		shared, err := chainsSharingPasswordEnv(chain)
 		if err != nil {
-			log.Warn().Msgf("Prompt failed %v\n", err)
 			return "", err
 		}
+		if len(shared) > 0 {
+			return "", eris.Errorf("%s is ambiguous, it is the password of chains %s and %s. Use CHAIN_PASSWORD_COMMAND instead, which gets the chain's name in CHAIN_NAME", env, chain, strings.Join(shared, ", "))
+		}
+		warnPasswordSource(env, envPasswordRisk)
+		registerSecret([]byte(p))
+		return p, validatePassword(p)
+	}
+	return acquirePassword(chain)
+}
+
+// passwordEnvChains maps each CHAIN_PASSWORD_<CHAIN> to the chains in dir
+// whose password it is. The data directory is only walked when one of them
+// is set and once per process.
+var passwordEnvChains struct {
+	dir    string
+	chains map[string][]string
+}
+
+// chainsSharingPasswordEnv returns the other chains whose password would
+// be read from the same CHAIN_PASSWORD_<CHAIN> as chain
+func chainsSharingPasswordEnv(chain string) ([]string, error) {
+	dir := chainDataDir()
+	if passwordEnvChains.chains == nil || passwordEnvChains.dir != dir {
+		chains, err := listPasswordEnvChains(dir)
+		if err != nil {
+			return nil, err
+		}
+		passwordEnvChains.dir, passwordEnvChains.chains = dir, chains
+	}
+
+	var shared []string
+	for _, name := range passwordEnvChains.chains[chainPasswordEnv(chain)] {
+		if name != chain {
+			shared = append(shared, name)
+		}
+	}
+	return shared, nil
+}
 
-		// Set in viper in case other parts of process require the password
-		// thus avoiding multiple requests for it
-		// In particular this is used for age-otp to expire after run
-		viper.Set(KeyringPassword, result)
+func listPasswordEnvChains(dir string) (map[string][]string, error) {
+	chains := make(map[string][]string)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !d.IsDir() || path == dir {
+			return nil
+		}
+		// Staging directories of the stores, eg .passwd
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		env := chainPasswordEnv(name)
+		chains[env] = append(chains[env], name)
+		return nil
+	})
+	return chains, err
+}
+
+// chainPasswordFunc is getChainPassword as a keyring.Config FilePasswordFunc
+func chainPasswordFunc(chain string) keyring.PromptFunc {
+	return func(string) (string, error) {
+		return getChainPassword(chain)
+	}
+}
+
+// getNewPassword returns CHAIN_NEW_PASSWORD or asks for a new password
+// twice to confirm it, with pinentry when it is configured
+func getNewPassword() (string, error) {
+	if p := viper.GetString(NewPasswordKey); p != "" {
+		warnPasswordSource("CHAIN_NEW_PASSWORD", envPasswordRisk)
+		registerSecret([]byte(p))
+		return p, validatePassword(p)
+	}
 
-		return result, nil
-	} else {
-		if err := validate(p); err != nil {
+	ask := func(label string) (string, error) {
+		if program := viper.GetString(PinentryKey); program != "" {
+			return pinentry(program, "Enter the new chain password", label+":")
+		}
+		return promptForInput(label+":", true, nil)
+	}
+	for {
+		p, err := ask("New password")
+		if err != nil {
 			return "", err
-		} else {
+		}
+		registerSecret([]byte(p))
+		if err := validatePassword(p); err != nil {
+			log.Warn().Msg(err.Error())
+			continue
+		}
+		confirm, err := ask("Confirm new password")
+		if err != nil {
+			return "", err
+		}
+		if p == confirm {
 			return p, nil
 		}
+		log.Warn().Msg("Passwords did not match, try again")
 	}
-
 }
 
 func promptForString(title string) (string, error) {
-	p := promptui.Prompt{
-		Label: title,
-	}
-	return promptForInput(p)
+	return promptForInput(title, false, nil)
 }
 
 func promptForPassword(title string) (string, error) {
-	p := promptui.Prompt{
-		Label: title,
-		Mask:  '*',
-	}
-	return promptForInput(p)
+	return promptForInput(title, true, nil)
 }
 
-func promptForInput(prompt promptui.Prompt) (string, error) {
-	result, err := prompt.Run()
+// promptForInput prompts on the terminal, see promptTTY
+func promptForInput(title string, masked bool, validate func(string) error) (string, error) {
+	result, err := promptTTY(title, masked, validate)
 
 	if err != nil {
 		log.Warn().Msgf("Prompt failed %v\n", err)
@@ -120,28 +403,76 @@ func promptForInput(prompt promptui.Prompt) (string, error) {
 	return result, nil
 }
 
-func getKVAsEnvLines(cmd *cobra.Command, chain string) ([]string, error) {
+// writeEnvLines writes items to w as KEY=VALUE lines, building the output
+// in secret memory rather than as strings
+func writeEnvLines(w io.Writer, items []keyring.Item) error {
+	size := 0
+	for _, item := range items {
+		size += len(item.Key) + len(item.Data) + 2
+	}
+	out := secretAlloc(size)[:0]
+	defer wipe(out)
+	for _, item := range items {
+		out = append(append(append(append(out, item.Key...), '='), item.Data...), '\n')
+	}
+	_, err := w.Write(out)
+	return err
+}
+
+// getItems fetches every item in the chain, in the order reported by the store
+func getItems(chain string) ([]keyring.Item, error) {
 	ring, err := NewStore(chain)
 
 	if err != nil {
 		return nil, eris.Wrap(err, "Unable to open keyring")
 	}
 
-	var lines []string
-
 	var keys []string
 	keys, err = ring.Keys()
 	if err != nil {
 		return nil, eris.Wrap(err, "Unable to get keys for keyring\n")
 	}
+
+	var items []keyring.Item
 	for _, k := range keys {
-		value, err := ring.Get(k)
-		if err != nil {
+		item, err := ring.Get(k)
+		if errors.Is(err, ErrNotInGroup) {
+			log.Debug().Str("key", k).Msg("Skipping key scoped to a recipient group the identity is not in")
+			continue
+		} else if err != nil {
 			return nil, eris.Wrapf(err, "Unable to get key: %+v", k)
 		}
-		line := fmt.Sprintf("%s=%s", k, value.Data)
-		lines = append(lines, line)
+		registerSecret(item.Data)
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory
+// and renames it over path so readers never observe a partial write
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return eris.Wrapf(err, "Unable to write file: %+v", path)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return eris.Wrapf(err, "Unable to write file: %+v", path)
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return eris.Wrapf(err, "Unable to write file: %+v", path)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return eris.Wrapf(err, "Unable to write file: %+v", path)
+	}
+	if err := f.Close(); err != nil {
+		return eris.Wrapf(err, "Unable to write file: %+v", path)
 	}
 
-	return lines, err
+	return eris.Wrapf(os.Rename(f.Name(), path), "Unable to write file: %+v", path)
 }
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestValidateChainName(t *testing.T) {
+	for _, name := range []string{"aws", "team/aws/prod", "a.b", "a-b_c", "1"} {
+		if err := validateChainName(name); err != nil {
+			t.Errorf("%q refused: %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "..", "../x", "a/../../x", "a/", "/a", "a//b", ".hidden", "a/.b", `a\b`, `..\x`, "a\x00b", "a b"} {
+		if err := validateChainName(name); !errors.Is(err, ErrInvalidChainName) {
+			t.Errorf("%q returned %v, want ErrInvalidChainName", name, err)
+		}
+	}
+}
+
+func TestFilePath(t *testing.T) {
+	dir := t.TempDir()
+	viper.Set(ChainDirKey, dir)
+	t.Cleanup(viper.Reset)
+
+	for name, want := range map[string]string{
+		"aws":           filepath.Join(dir, "aws"),
+		"team/aws/prod": filepath.Join(dir, "team", "aws", "prod"),
+	} {
+		if got := filePath(name); got != want {
+			t.Errorf("filePath(%q) = %s, want %s", name, got, want)
+		}
+	}
+}
+
+// chdir changes the working directory for the rest of the test
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+}
+
+func TestChainDataDirPrecedence(t *testing.T) {
+	work := t.TempDir()
+	chdir(t, work)
+	dataHome := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", dataHome)
+	t.Cleanup(viper.Reset)
+
+	if got, want := chainDataDir(), filepath.Join(dataHome, ConfigPrefix); got != want {
+		t.Errorf("without CHAIN_DIR or .chain got %s, want %s", got, want)
+	}
+
+	// A relative XDG_DATA_HOME is ignored as the spec requires
+	t.Setenv("XDG_DATA_HOME", "relative")
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := chainDataDir(), filepath.Join(home, ".local", "share", ConfigPrefix); got != want {
+		t.Errorf("with relative XDG_DATA_HOME got %s, want %s", got, want)
+	}
+
+	if err := os.Mkdir("."+ConfigPrefix, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := chainDataDir(), "."+ConfigPrefix; got != want {
+		t.Errorf("with .chain got %s, want %s", got, want)
+	}
+
+	// CHAIN_DIR takes precedence over .chain
+	chainDir := t.TempDir()
+	t.Setenv("CHAIN_DIR", chainDir)
+	viper.SetEnvPrefix(ConfigPrefix)
+	if err := viper.BindEnv(ChainDirKey); err != nil {
+		t.Fatal(err)
+	}
+	if got := chainDataDir(); got != chainDir {
+		t.Errorf("with CHAIN_DIR got %s, want %s", got, chainDir)
+	}
+}
+
+func TestChainPasswordEnv(t *testing.T) {
+	for chain, want := range map[string]string{
+		"aws":      "CHAIN_PASSWORD_AWS",
+		"team/aws": "CHAIN_PASSWORD_TEAM_AWS",
+		"a-b.c":    "CHAIN_PASSWORD_A_B_C",
+	} {
+		if got := chainPasswordEnv(chain); got != want {
+			t.Errorf("chainPasswordEnv(%q) = %s, want %s", chain, got, want)
+		}
+	}
+}
+
+// TestChainPasswordEnvCollision checks a CHAIN_PASSWORD_<CHAIN> shared by
+// several chains is refused rather than used for all of them
+func TestChainPasswordEnvCollision(t *testing.T) {
+	useTestChainDir(t)
+	password := "correct horse battery staple"
+	t.Setenv("CHAIN_PASSWORD_A_B", password)
+	t.Cleanup(func() { passwordEnvChains.chains = nil })
+	if err := os.MkdirAll(filePath("a-b"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if p, err := getChainPassword("a-b"); err != nil || p != password {
+		t.Fatalf("got %q, %v, want the password of a-b", p, err)
+	}
+
+	// As in a new process, the data directory is only walked once per process
+	passwordEnvChains.chains = nil
+	for _, chain := range []string{"a_b", "a/b"} {
+		if err := os.MkdirAll(filePath(chain), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, chain := range []string{"a-b", "a_b", "a/b"} {
+		if _, err := getChainPassword(chain); err == nil || !strings.Contains(err.Error(), "ambiguous") {
+			t.Errorf("%s: got %v, want CHAIN_PASSWORD_A_B refused as ambiguous", chain, err)
+		}
+	}
+}
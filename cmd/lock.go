@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rotisserie/eris"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	chainv1 "github.com/zph/chain/gen/go/chain/v1"
+)
+
+// Chain locking
+//
+// Commands take an advisory lock on lockFile in the chain's directory
+// before touching the chain and hold it until their PostRun. Readers share
+// the lock, anything which writes to the chain, including get with
+// age-otp-store which expires keys, holds it exclusively. Waiting for the
+// lock gives up after CHAIN_LOCK_TIMEOUT.
+
+var lockFile = ".lock"
+
+var ErrLockTimeout = errors.New("timed out waiting for chain lock")
+var ErrChainNotFound = errors.New("chain not found")
+
+type lockMode int
+
+const (
+	lockShared lockMode = iota
+	lockExclusive
+)
+
+func (m lockMode) String() string {
+	if m == lockExclusive {
+		return "exclusive"
+	}
+	return "shared"
+}
+
+const lockPollInterval = 50 * time.Millisecond
+
+type chainLock struct {
+	f     *os.File
+	chain string
+	mode  lockMode
+}
+
+// heldLock is the lock taken by the running command, see lockChainPreRun
+var heldLock *chainLock
+
+// lockChain waits up to timeout for a lock on the chain's directory. Only
+// writers create the directory of a new chain, readers of a chain which
+// doesn't exist fail with ErrChainNotFound.
+func lockChain(chain string, mode lockMode, timeout time.Duration) (*chainLock, error) {
+	dir := filePath(chain)
+	if mode == lockExclusive {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	} else if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return nil, eris.Wrapf(ErrChainNotFound, "%s in %s", chain, chainDataDir())
+	} else if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_CREATE|os.O_RDWR, secureFSPerm)
+	if err != nil {
+		return nil, eris.Wrap(err, "Unable to open lock file")
+	}
+
+	deadline := time.Now().Add(timeout)
+	logged := false
+	for {
+		ok, err := tryLockFile(f, mode)
+		if err != nil {
+			f.Close()
+			return nil, eris.Wrap(err, "Unable to lock chain")
+		}
+		if ok {
+			return &chainLock{f: f, chain: chain, mode: mode}, nil
+		}
+
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, eris.Wrapf(ErrLockTimeout, "%s held by another chain process after %s", chain, timeout)
+		}
+		if !logged {
+			log.Info().Str("chain", chain).Str("mode", mode.String()).Msg("Waiting for another chain process to release the chain")
+			logged = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+func (l *chainLock) Unlock() error {
+	if err := unlockFile(l.f); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+// lockChainPreRun returns a PreRun which locks the chain named by the
+// first argument, released by unlockChainPostRun. A lock left held when
+// the process exits, eg after log.Fatal, is released by the OS.
+func lockChainPreRun(mode func() lockMode) func(*cobra.Command, []string) {
+	return func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			return
+		}
+
+		l, err := lockChain(args[0], mode(), viper.GetDuration(LockTimeoutKey))
+		if err != nil {
+			log.Fatal().Msgf(eris.ToString(err, false))
+		}
+		heldLock = l
+	}
+}
+
+func unlockChainPostRun(cmd *cobra.Command, args []string) {
+	if heldLock == nil {
+		return
+	}
+	if err := heldLock.Unlock(); err != nil {
+		log.Warn().Err(err).Msg("Unable to release chain lock")
+	}
+	heldLock = nil
+}
+
+// lockedExclusively reports whether the running command holds the lock on
+// chain exclusively
+func lockedExclusively(chain string) bool {
+	return heldLock != nil && heldLock.chain == chain && heldLock.mode == lockExclusive
+}
+
+func sharedLock() lockMode    { return lockShared }
+func exclusiveLock() lockMode { return lockExclusive }
+
+// readLock is shared except for age-otp-store where reading a chain
+// expires the key which was used
+func readLock() lockMode {
+	if viper.GetInt(StoreBackendTypeName) == int(chainv1.StorageType_STORAGE_TYPE_AGE_OTP_STORE) {
+		return lockExclusive
+	}
+	return lockShared
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func useTestChainDir(t *testing.T) {
+	t.Helper()
+	viper.Set(ChainDirKey, t.TempDir())
+	t.Cleanup(viper.Reset)
+}
+
+func mustLock(t *testing.T, chain string, mode lockMode) *chainLock {
+	t.Helper()
+	l, err := lockChain(chain, mode, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestExclusiveLocksSerialize(t *testing.T) {
+	useTestChainDir(t)
+	first := mustLock(t, "aws", lockExclusive)
+
+	acquired := make(chan *chainLock)
+	go func() {
+		l, err := lockChain("aws", lockExclusive, 10*time.Second)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- l
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("second exclusive lock acquired while the first was held")
+	case <-time.After(5 * lockPollInterval):
+	}
+	if err := first.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case second := <-acquired:
+		if second != nil {
+			second.Unlock()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second exclusive lock not acquired after the first was released")
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	useTestChainDir(t)
+	exclusive := mustLock(t, "aws", lockExclusive)
+
+	for _, mode := range []lockMode{lockExclusive, lockShared} {
+		start := time.Now()
+		_, err := lockChain("aws", mode, 2*lockPollInterval)
+		if !errors.Is(err, ErrLockTimeout) {
+			t.Errorf("%s lock: got %v, want ErrLockTimeout", mode, err)
+		}
+		if elapsed := time.Since(start); elapsed < 2*lockPollInterval {
+			t.Errorf("%s lock gave up after %s", mode, elapsed)
+		}
+	}
+	if err := exclusive.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers share the lock but exclude writers
+	first := mustLock(t, "aws", lockShared)
+	second := mustLock(t, "aws", lockShared)
+	if _, err := lockChain("aws", lockExclusive, 0); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("exclusive lock while shared: got %v, want ErrLockTimeout", err)
+	}
+	first.Unlock()
+	second.Unlock()
+	mustLock(t, "aws", lockExclusive).Unlock()
+}
+
+// TestSharedLockOfMissingChain checks readers don't create a chain, eg
+// get with a misspelt chain name
+func TestSharedLockOfMissingChain(t *testing.T) {
+	useTestChainDir(t)
+	if _, err := lockChain("typo", lockShared, time.Second); !errors.Is(err, ErrChainNotFound) {
+		t.Errorf("got %v, want ErrChainNotFound", err)
+	}
+	if _, err := os.Stat(filePath("typo")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("shared lock created the chain's directory")
+	}
+
+	mustLock(t, "new", lockExclusive).Unlock()
+	if _, err := os.Stat(filePath("new")); err != nil {
+		t.Errorf("exclusive lock didn't create the chain's directory: %v", err)
+	}
+}
+
+func TestReadLock(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	viper.Set(StoreBackendTypeName, 4)
+	if readLock() != lockShared {
+		t.Error("age store reads should share the lock")
+	}
+	// Reading expires the one-time key which was used
+	viper.Set(StoreBackendTypeName, 5)
+	if readLock() != lockExclusive {
+		t.Error("age-otp-store reads should hold the lock exclusively")
+	}
+}
+
+// holdLock locks chain as lockChainPreRun does for the rest of the test
+func holdLock(t *testing.T, chain string, mode lockMode) {
+	t.Helper()
+	heldLock = mustLock(t, chain, mode)
+	t.Cleanup(func() { unlockChainPostRun(nil, nil) })
+}
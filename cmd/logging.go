@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+var redacted = "[REDACTED]"
+
+// Secret is a sensitive value which always renders as [REDACTED] whether it
+// is logged as a zerolog field, formatted with fmt or marshalled to JSON.
+//
+// Log secret-bearing fields with Secret rather than string or []byte, eg:
+//
+//	log.Debug().Stringer("value", Secret(item.Data)).Msg("")
+type Secret []byte
+
+func (s Secret) String() string { return redacted }
+
+func (s Secret) GoString() string { return redacted }
+
+func (s Secret) Format(f fmt.State, verb rune) { io.WriteString(f, redacted) }
+
+func (s Secret) MarshalJSON() ([]byte, error) { return json.Marshal(redacted) }
+
+func (s Secret) MarshalText() ([]byte, error) { return []byte(redacted), nil }
+
+// SecretEnv logs KEY=VALUE lines as an object of keys with Secret values
+type SecretEnv []string
+
+func (e SecretEnv) MarshalZerologObject(event *zerolog.Event) {
+	for _, line := range e {
+		key, value, _ := strings.Cut(line, "=")
+		event.Stringer(key, Secret(value))
+	}
+}
+
+// redactingWriter receives every log event as JSON before it is formatted.
+// As a safety net for values which were not typed as Secret it replaces any
+// value registered with registerSecret within the event's fields. The
+// timestamp, level and JSON syntax are left alone so that a short secret,
+// eg a PIN of "1", can't mangle the output.
+type redactingWriter struct {
+	mu      sync.Mutex
+	out     io.Writer
+	secrets [][]byte
+}
+
+var logSink = &redactingWriter{}
+
+// registerSecret marks value as sensitive so that it is scrubbed
+// from log output, call it as soon as a secret is read or decrypted.
+// Values of any length are scrubbed, a short PIN is as sensitive as a
+// long token.
+func registerSecret(value []byte) {
+	if len(value) == 0 {
+		return
+	}
+	logSink.mu.Lock()
+	defer logSink.mu.Unlock()
+
+	logSink.secrets = append(logSink.secrets, redactionMemory.copy(value))
+	// Log writers escape values when formatting them
+	if !needsJSONEscape(value) {
+		return
+	}
+	if escaped, err := json.Marshal(string(value)); err == nil {
+		logSink.secrets = append(logSink.secrets, redactionMemory.copy(escaped[1:len(escaped)-1]))
+		wipe(escaped)
+	}
+}
+
+// needsJSONEscape reports whether json.Marshal could change value, which
+// avoids copying most secrets into a string
+func needsJSONEscape(value []byte) bool {
+	for _, c := range value {
+		if c < 0x20 || c >= 0x80 || c == '"' || c == '\\' || c == '<' || c == '>' || c == '&' {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	out := p
+	if w.containsSecret(p) {
+		out = w.redactEvent(p)
+	}
+
+	if _, err := w.out.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *redactingWriter) containsSecret(p []byte) bool {
+	for _, s := range w.secrets {
+		if bytes.Contains(p, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactEvent redacts the fields of a JSON event, falling back to
+// redacting the raw bytes of anything else
+func (w *redactingWriter) redactEvent(p []byte) []byte {
+	var event map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(p))
+	d.UseNumber()
+	if err := d.Decode(&event); err != nil {
+		return w.redact(p)
+	}
+	for k, v := range event {
+		if k != zerolog.TimestampFieldName && k != zerolog.LevelFieldName {
+			event[k] = w.redactValue(v)
+		}
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		return w.redact(p)
+	}
+	return append(b, '\n')
+}
+
+func (w *redactingWriter) redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return string(w.redact([]byte(v)))
+	case []interface{}:
+		for i := range v {
+			v[i] = w.redactValue(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = w.redactValue(v[k])
+		}
+	}
+	return v
+}
+
+func (w *redactingWriter) redact(b []byte) []byte {
+	for _, s := range w.secrets {
+		if bytes.Contains(b, s) {
+			b = bytes.ReplaceAll(b, s, []byte(redacted))
+		}
+	}
+	return b
+}
@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// logSinks are the formats log output can be written in
+var logSinks = map[string]func(io.Writer) io.Writer{
+	"console": func(w io.Writer) io.Writer { return zerolog.ConsoleWriter{Out: w, NoColor: true} },
+	"json":    func(w io.Writer) io.Writer { return w },
+}
+
+// captureLogs runs f with debug logging to every sink, calling check with
+// the output of each. Each sink is checked both written to directly, which
+// tests that secret fields are typed, and through logSink, which also
+// redacts registered values.
+func captureLogs(t *testing.T, f func(t *testing.T), check func(t *testing.T, out string)) {
+	logger, level := log.Logger, zerolog.GlobalLevel()
+	sinkOut := logSink.out
+	t.Cleanup(func() {
+		log.Logger = logger
+		zerolog.SetGlobalLevel(level)
+		logSink.out = sinkOut
+	})
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+
+	for name, newSink := range logSinks {
+		t.Run(name+"/direct", func(t *testing.T) {
+			var buf bytes.Buffer
+			log.Logger = zerolog.New(newSink(&buf)).With().Timestamp().Logger()
+			f(t)
+			check(t, buf.String())
+		})
+		t.Run(name+"/logSink", func(t *testing.T) {
+			var buf bytes.Buffer
+			logSink.out = newSink(&buf)
+			log.Logger = zerolog.New(logSink).With().Timestamp().Logger()
+			f(t)
+			check(t, buf.String())
+		})
+	}
+}
+
+func assertNoSecrets(secrets ...string) func(t *testing.T, out string) {
+	return func(t *testing.T, out string) {
+		t.Helper()
+		if out == "" {
+			t.Fatal("nothing was logged")
+		}
+		for _, s := range secrets {
+			if strings.Contains(out, s) {
+				t.Errorf("secret %q reached the log:\n%s", s, out)
+			}
+		}
+	}
+}
+
+func TestSecretIsRedacted(t *testing.T) {
+	secret := "hunter2-correct-horse"
+	captureLogs(t, func(t *testing.T) {
+		s := Secret(secret)
+		log.Debug().Stringer("stringer", s).Msg("")
+		log.Debug().Interface("interface", s).Msg("")
+		log.Debug().Object("env", SecretEnv{"TOKEN=" + secret}).Msg("")
+		log.Debug().Msgf("%s %v %+v %#v %q %x", s, s, s, s, s, s)
+	}, assertNoSecrets(secret))
+}
+
+// TestSecretsNeverReachLogSinks sets and execs a chain with debug logging
+// and fails if any value it holds appears in the log
+func TestSecretsNeverReachLogSinks(t *testing.T) {
+	values := map[string]string{
+		"API_TOKEN": "tok-9f8e7d6c5b4a",
+		"PIN":       "Zq",
+		"MULTILINE": "first\nsecond",
+	}
+
+	useTestBoltStore(t)
+
+	var input strings.Builder
+	for k, v := range values {
+		input.WriteString(k + "=\"" + strings.ReplaceAll(v, "\n", `\n`) + "\"\n")
+	}
+
+	secrets := []string{"correct horse battery staple"}
+	for _, v := range values {
+		secrets = append(secrets, v)
+	}
+
+	captureLogs(t, func(t *testing.T) {
+		setStdin(t, input.String())
+		ring, err := NewStore("leak")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := processStdinEntry(ring); err != nil {
+			t.Fatal(err)
+		}
+		if code, err := execute(execCmd, "leak", "true", nil); err != nil || code != 0 {
+			t.Fatalf("exec exited %d: %v", code, err)
+		}
+	}, assertNoSecrets(secrets...))
+}
+
+// useTestBoltStore stores chains in a bolt store in a temporary directory,
+// with a KDF cheap enough for tests
+func useTestBoltStore(t *testing.T) {
+	viper.Set(ChainDirKey, t.TempDir())
+	viper.Set(StoreBackendTypeName, 6)
+	viper.Set(KeyringPassword, "correct horse battery staple")
+	viper.Set(VaultKDFTimeKey, 1)
+	viper.Set(VaultKDFMemoryKey, 8)
+	viper.Set(VaultKDFThreadsKey, 1)
+	t.Cleanup(viper.Reset)
+}
+
+func setStdin(t *testing.T, input string) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer w.Close()
+		_, _ = io.WriteString(w, input)
+	}()
+	stdin := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() {
+		os.Stdin = stdin
+		r.Close()
+	})
+}
+
+// TestShortSecretsKeepLogsReadable checks that redacting a one character
+// secret leaves the timestamp, level and formatting of events intact
+func TestShortSecretsKeepLogsReadable(t *testing.T) {
+	logger, sinkOut, secrets := log.Logger, logSink.out, logSink.secrets
+	t.Cleanup(func() {
+		log.Logger = logger
+		logSink.out, logSink.secrets = sinkOut, secrets
+	})
+	registerSecret([]byte("1"))
+
+	var buf bytes.Buffer
+	logSink.out = &buf
+	log.Logger = zerolog.New(logSink).With().Timestamp().Logger()
+	log.Warn().Str("value", "1").Int("count", 1).Msg("PIN 1 saved")
+
+	var event map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
+		t.Fatalf("redacted event is not JSON: %v\n%s", err, buf.String())
+	}
+	if event["value"] != redacted || event[zerolog.MessageFieldName] != "PIN "+redacted+" saved" {
+		t.Errorf("secret was not redacted: %s", buf.String())
+	}
+	if event[zerolog.LevelFieldName] != "warn" || event["count"] != float64(1) {
+		t.Errorf("event was mangled: %s", buf.String())
+	}
+	if _, err := time.Parse(zerolog.TimeFieldFormat, event[zerolog.TimestampFieldName].(string)); err != nil {
+		t.Errorf("timestamp was mangled: %s", buf.String())
+	}
+}
+
+// TestRedactionOutlivesWipedValues checks that secrets are still redacted
+// after exec wipes the values it handed to a command
+func TestRedactionOutlivesWipedValues(t *testing.T) {
+	logger, sinkOut, secrets := log.Logger, logSink.out, logSink.secrets
+	t.Cleanup(func() {
+		log.Logger = logger
+		logSink.out, logSink.secrets = sinkOut, secrets
+	})
+	secret := "tok-5a4b3c2d1e0f"
+	registerSecret([]byte(secret))
+	wipeSecretValues()
+
+	var buf bytes.Buffer
+	logSink.out = &buf
+	log.Logger = zerolog.New(logSink)
+	log.Warn().Msgf("command printed %s", secret)
+	if strings.Contains(buf.String(), secret) {
+		t.Errorf("secret reached the log after values were wiped:\n%s", buf.String())
+	}
+}
+
+func TestWipeSecretValuesWipesPasswordsAndSeeds(t *testing.T) {
+	usePassword(t, "correct horse battery staple")
+	t.Cleanup(viper.Reset)
+	if _, err := acquirePassword("wipe"); err != nil {
+		t.Fatal(err)
+	}
+	password := passwordCache["wipe"]
+
+	generated, err := newSeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnemonic, err := seedToMnemonic(generated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, err := mnemonicToSeed(mnemonic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wipeSecretValues()
+	for name, b := range map[string][]byte{"password": password, "seed": generated, "recovered seed": seed} {
+		if !bytes.Equal(b, make([]byte, len(b))) {
+			t.Errorf("%s was not wiped", name)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rotisserie/eris"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Chain manifests
+//
+// Each age chain directory holds manifestFile listing the SHA-256 of every
+// file in the chain and a version which increases on every write. The
+// manifest is authenticated with an HMAC keyed from the chain's data key, so
+// only someone able to decrypt the chain can produce a valid manifest.
+//
+// The highest version seen is also recorded outside of the chain directory,
+// see manifestStatePath, which detects an older but validly signed manifest
+// being restored along with the files it lists.
+
+var manifestFile = ".MANIFEST"
+
+var ErrManifestInvalid = errors.New("manifest signature is invalid")
+var ErrIntegrity = errors.New("chain failed integrity check, run chain verify for details")
+
+type chainManifest struct {
+	Chain   string            `json:"chain"`
+	Version uint64            `json:"version"`
+	Files   map[string]string `json:"files"`
+	MAC     string            `json:"mac,omitempty"`
+}
+
+// manifestReport describes how a chain directory differs from its manifest
+type manifestReport struct {
+	Chain      string
+	Missing    bool // no manifest has been written for the chain yet
+	Version    uint64
+	LastSeen   uint64
+	RolledBack bool
+	Modified   []string
+	Removed    []string
+	Untracked  []string
+}
+
+func (r manifestReport) OK() bool {
+	return !r.Missing && !r.RolledBack && len(r.Modified) == 0 && len(r.Removed) == 0 && len(r.Untracked) == 0
+}
+
+func (r manifestReport) String() string {
+	if r.Missing {
+		return fmt.Sprintf("%s: no manifest", r.Chain)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: manifest version %d (last seen %d)\n", r.Chain, r.Version, r.LastSeen)
+	if r.RolledBack {
+		fmt.Fprintf(&b, "ROLLED BACK: manifest is older than version %d seen previously\n", r.LastSeen)
+	}
+	for _, f := range r.Modified {
+		fmt.Fprintf(&b, "MODIFIED: %s\n", f)
+	}
+	for _, f := range r.Removed {
+		fmt.Fprintf(&b, "REMOVED: %s\n", f)
+	}
+	for _, f := range r.Untracked {
+		fmt.Fprintf(&b, "UNTRACKED: %s\n", f)
+	}
+	if r.OK() {
+		b.WriteString("OK\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func manifestKey(dataKey []byte) ([]byte, error) {
+	key := make([]byte, sha256.Size)
+	_, err := io.ReadFull(hkdf.New(sha256.New, dataKey, nil, []byte("chain-manifest/v1")), key)
+	return key, err
+}
+
+func (m chainManifest) mac(key []byte) ([]byte, error) {
+	m.MAC = ""
+	// Map keys are marshalled in sorted order so the encoding is stable
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(b)
+	return h.Sum(nil), nil
+}
+
+// manifestIgnored reports files which are not part of a chain's contents
+func manifestIgnored(name string) bool {
+	return name == manifestFile || name == lockFile || strings.Contains(name, ".tmp-")
+}
+
+// hashChainFiles returns the SHA-256 of each file in dir, skipping
+// directories which hold namespaced chains
+func hashChainFiles(dir string) (map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[string]string)
+	for _, e := range entries {
+		if e.IsDir() || manifestIgnored(e.Name()) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(b)
+		hashes[e.Name()] = hex.EncodeToString(sum[:])
+	}
+	return hashes, nil
+}
+
+func readManifest(dir string) (*chainManifest, error) {
+	b, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var m chainManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, eris.Wrap(ErrManifestInvalid, err.Error())
+	}
+	return &m, nil
+}
+
+// checkManifest compares the files in dir with the chain's signed manifest
+func checkManifest(dir string, chain string, dataKey []byte) (manifestReport, error) {
+	report := manifestReport{Chain: chain}
+
+	m, err := readManifest(dir)
+	if err != nil {
+		return report, err
+	}
+	lastSeen, err := readManifestVersion(dir)
+	if err != nil {
+		return report, err
+	}
+	report.LastSeen = lastSeen
+	if m == nil {
+		report.Missing = true
+		// A deleted manifest is a rollback once one has been seen
+		report.RolledBack = lastSeen > 0
+		return report, nil
+	}
+
+	key, err := manifestKey(dataKey)
+	if err != nil {
+		return report, err
+	}
+	expected, err := m.mac(key)
+	if err != nil {
+		return report, err
+	}
+	actual, err := hex.DecodeString(m.MAC)
+	if err != nil || !hmac.Equal(expected, actual) || m.Chain != chain {
+		return report, ErrManifestInvalid
+	}
+
+	report.Version = m.Version
+	report.RolledBack = m.Version < lastSeen
+
+	hashes, err := hashChainFiles(dir)
+	if err != nil {
+		return report, err
+	}
+	for name, sum := range m.Files {
+		current, ok := hashes[name]
+		if !ok {
+			report.Removed = append(report.Removed, name)
+		} else if current != sum {
+			report.Modified = append(report.Modified, name)
+		}
+	}
+	for name := range hashes {
+		if _, ok := m.Files[name]; !ok {
+			report.Untracked = append(report.Untracked, name)
+		}
+	}
+	sort.Strings(report.Modified)
+	sort.Strings(report.Removed)
+	sort.Strings(report.Untracked)
+
+	return report, nil
+}
+
+// writeManifest records the current contents of dir in a new manifest
+// version signed with a key derived from dataKey
+func writeManifest(dir string, chain string, dataKey []byte) error {
+	previous, err := readManifest(dir)
+	if err != nil && !errors.Is(err, ErrManifestInvalid) {
+		return err
+	}
+	lastSeen, err := readManifestVersion(dir)
+	if err != nil {
+		return err
+	}
+
+	version := lastSeen
+	if previous != nil && previous.Version > version {
+		version = previous.Version
+	}
+
+	hashes, err := hashChainFiles(dir)
+	if err != nil {
+		return err
+	}
+	m := chainManifest{Chain: chain, Version: version + 1, Files: hashes}
+
+	key, err := manifestKey(dataKey)
+	if err != nil {
+		return err
+	}
+	mac, err := m.mac(key)
+	if err != nil {
+		return err
+	}
+	m.MAC = hex.EncodeToString(mac)
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(filepath.Join(dir, manifestFile), b, secureFSPerm)
+	if err != nil {
+		return err
+	}
+
+	return writeManifestVersion(dir, m.Version)
+}
+
+// manifestStatePath is where the highest manifest version seen for the
+// chain in dir is recorded, $XDG_STATE_HOME/chain/manifests/<hash of dir>
+func manifestStatePath(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	stateDir, err := chainStateDir()
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(stateDir, "manifests", hex.EncodeToString(sum[:16])), nil
+}
+
+// chainStateDir is where chain keeps local state, $XDG_STATE_HOME/chain
+func chainStateDir() (string, error) {
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" || !filepath.IsAbs(stateHome) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		stateHome = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(stateHome, ConfigPrefix), nil
+}
+
+func readManifestVersion(dir string) (uint64, error) {
+	p, err := manifestStatePath(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	b, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var version uint64
+	_, err = fmt.Sscanf(string(b), "%d", &version)
+	return version, eris.Wrapf(err, "Unable to parse manifest state: %+v", p)
+}
+
+func writeManifestVersion(dir string, version uint64) error {
+	p, err := manifestStatePath(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(p, []byte(fmt.Sprintf("%d\n", version)), secureFSPerm)
+}
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// readChainFiles returns the contents of the named files of s
+func readChainFiles(t *testing.T, s AgeStore, names ...string) map[string][]byte {
+	t.Helper()
+	files := make(map[string][]byte)
+	for _, name := range names {
+		b, err := os.ReadFile(s.FilePath(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[name] = b
+	}
+	return files
+}
+
+func writeChainFiles(t *testing.T, s AgeStore, files map[string][]byte) {
+	t.Helper()
+	for name, b := range files {
+		if err := os.WriteFile(s.FilePath(name), b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestManifestDetectsChanges(t *testing.T) {
+	useTestAgeStore(t)
+	s, identity := newTestAgeChain(t, "aws")
+	mustSet(t, s, "A", "1")
+	mustSet(t, s, "B", "2")
+
+	report, err := s.VerifyIntegrity()
+	if err != nil || !report.OK() {
+		t.Fatalf("fresh chain is not OK: %v %v", report, err)
+	}
+
+	b := readChainFiles(t, s, "B")
+	if err := os.WriteFile(s.FilePath("A"), b["B"], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(s.FilePath("B")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.FilePath("C"), b["B"], 0600); err != nil {
+		t.Fatal(err)
+	}
+	report, err = s.VerifyIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Modified) != 1 || len(report.Removed) != 1 || len(report.Untracked) != 1 {
+		t.Errorf("got %+v, want A modified, B removed and C untracked", report)
+	}
+
+	s = asIdentity(t, "aws", identity)
+	if _, err := s.Get("A"); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("get from a modified chain: got %v, want ErrIntegrity", err)
+	}
+}
+
+func TestManifestSignedWithDataKey(t *testing.T) {
+	useTestAgeStore(t)
+	s, _ := newTestAgeChain(t, "aws")
+	mustSet(t, s, "A", "1")
+
+	other, err := newDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeManifest(s.Config.FileDir, "aws", other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.VerifyIntegrity(); !errors.Is(err, ErrManifestInvalid) {
+		t.Errorf("manifest signed with another key: got %v, want ErrManifestInvalid", err)
+	}
+}
+
+// TestManifestRollback restores an older but validly signed manifest and
+// data key along with the values they list
+func TestManifestRollback(t *testing.T) {
+	useTestAgeStore(t)
+	s, identity := newTestAgeChain(t, "aws")
+	mustSet(t, s, "A", "old")
+	old := readChainFiles(t, s, manifestFile, dataKeyFile, "A")
+	mustSet(t, s, "A", "new")
+
+	writeChainFiles(t, s, old)
+	report, err := s.VerifyIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.RolledBack || report.Version >= report.LastSeen {
+		t.Errorf("got %+v, want RolledBack", report)
+	}
+
+	s = asIdentity(t, "aws", identity)
+	if _, err := s.Get("A"); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("get from a rolled back chain: got %v, want ErrIntegrity", err)
+	}
+}
+
+// TestDeletedManifestIsRefused checks a chain whose manifest was deleted
+// after one was seen isn't trusted again on first use
+func TestDeletedManifestIsRefused(t *testing.T) {
+	useTestAgeStore(t)
+	s, identity := newTestAgeChain(t, "aws")
+	mustSet(t, s, "A", "1")
+	if err := os.Remove(s.FilePath(manifestFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.VerifyIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Missing || !report.RolledBack {
+		t.Errorf("got %+v, want a missing manifest reported as RolledBack", report)
+	}
+
+	s = asIdentity(t, "aws", identity)
+	if _, err := s.Get("A"); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("got %v, want ErrIntegrity", err)
+	}
+	if _, err := os.Stat(s.FilePath(manifestFile)); !errors.Is(err, os.ErrNotExist) {
+		t.Error("a new manifest was written for the chain")
+	}
+}
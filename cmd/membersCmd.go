@@ -0,0 +1,198 @@
+/*
+Copyright © 2022 Zander Hill <zander@xargs.io>
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/rotisserie/eris"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+// membersCmd represents the members command
+var membersCmd = &cobra.Command{
+	Use:   "members",
+	Short: "Share an AGE chain with other people",
+	Long: `
+	Share an AGE chain with other people by encrypting it to their public keys
+
+	Members are named public keys, either an age public key (age1...) or an
+	ssh-ed25519 / ssh-rsa public key or the path of one. Adding a member
+	encrypts the chain to their key as well, the chain directory can then
+	be committed to a shared repository.
+
+	Removing a member re-encrypts every value with a new key and flags the
+	values they could read as needing rotation, setting a value again
+	clears its flag.
+
+	Members can be put in recipient groups with --group, values set with
+	chain set --group are only readable by members of that group.
+
+	eg:
+	chain members add team/aws alice age1...
+	chain members add team/aws bob ~/bob_id_ed25519.pub
+	chain members add team/aws carol age1... --group oncall
+	chain members list team/aws
+	chain members remove team/aws bob
+`,
+}
+
+var membersAddCmd = &cobra.Command{
+	Use:     "add [keychain] [name] [public key]",
+	Short:   "Encrypt the chain to a member's public key",
+	Args:    cobra.ExactArgs(3),
+	PreRun:  lockChainPreRun(exclusiveLock),
+	PostRun: unlockChainPostRun,
+	Run: func(cmd *cobra.Command, args []string) {
+		name := args[1]
+		recipient, err := readMemberRecipient(args[2])
+		if err != nil {
+			log.Fatal().Msgf(eris.ToString(err, true))
+		}
+		for _, group := range membersAddGroups {
+			if err := validateGroup(group); err != nil {
+				log.Fatal().Msgf(eris.ToString(err, true))
+			}
+		}
+
+		manager, err := newMemberManager(args[0])
+		if err != nil {
+			log.Fatal().Msgf(eris.ToString(err, true))
+		}
+
+		err = manager.UpdateRecipients(func(r *recipientRegistry) error {
+			if e, err := r.Find(name); err == nil && e.Recipient != recipient {
+				return eris.Errorf("%q is already used for another public key", name)
+			}
+
+			e, err := r.Add(recipient, name)
+			if err != nil {
+				return err
+			}
+			e.Member = true
+			e.Label = name
+			for _, group := range membersAddGroups {
+				e.AddGroup(group)
+			}
+			if e.State != recipientActive {
+				_, err = r.SetState(e.ID, recipientActive)
+			}
+			return err
+		})
+		if err != nil {
+			log.Fatal().Msgf(eris.ToString(err, true))
+		}
+	},
+}
+
+var membersRemoveCmd = &cobra.Command{
+	Use:     "remove [keychain] [name]",
+	Short:   "Stop encrypting to a member and re-encrypt every value",
+	Args:    cobra.ExactArgs(2),
+	PreRun:  lockChainPreRun(exclusiveLock),
+	PostRun: unlockChainPostRun,
+	Run: func(cmd *cobra.Command, args []string) {
+		manager, err := newMemberManager(args[0])
+		if err != nil {
+			log.Fatal().Msgf(eris.ToString(err, true))
+		}
+
+		removed, flagged, err := manager.RemoveRecipient(args[1])
+		if err != nil {
+			log.Fatal().Msgf(eris.ToString(err, true))
+		}
+
+		fmt.Printf("Removed %s, re-encrypted %d value(s)\n", removed.Label, len(flagged))
+		if len(flagged) > 0 {
+			fmt.Printf("These values were readable by %s and should be rotated:\n%s\n", removed.Label, strings.Join(flagged, "\n"))
+		}
+	},
+}
+
+var membersListCmd = &cobra.Command{
+	Use:     "list [keychain]",
+	Short:   "List members and values needing rotation",
+	Args:    cobra.ExactArgs(1),
+	PreRun:  lockChainPreRun(sharedLock),
+	PostRun: unlockChainPostRun,
+	Run: func(cmd *cobra.Command, args []string) {
+		chain := args[0]
+		manager, err := newMemberManager(chain)
+		if err != nil {
+			log.Fatal().Msgf(eris.ToString(err, true))
+		}
+
+		registry, err := manager.Recipients()
+		if err != nil {
+			log.Fatal().Msgf(eris.ToString(err, true))
+		}
+		flags, err := loadRotationFlags(filePath(chain))
+		if err != nil {
+			log.Fatal().Msgf(eris.ToString(err, true))
+		}
+
+		fmt.Println(membersReport(registry, flags))
+	},
+}
+
+var membersAddGroups []string
+
+func init() {
+	membersAddCmd.Flags().StringArrayVar(&membersAddGroups, "group", nil, "recipient group to add the member to (repeatable)")
+	membersCmd.AddCommand(membersAddCmd)
+	membersCmd.AddCommand(membersRemoveCmd)
+	membersCmd.AddCommand(membersListCmd)
+	RootCmd.AddCommand(membersCmd)
+}
+
+// memberManager is implemented by stores which can share a chain
+type memberManager interface {
+	recipientManager
+	RemoveRecipient(ref string) (recipientEntry, []string, error)
+}
+
+func newMemberManager(chain string) (memberManager, error) {
+	store, err := NewStore(chain)
+	if err != nil {
+		return nil, eris.Wrapf(err, "Unable to open keyring for chain: %+v", chain)
+	}
+
+	manager, ok := store.(memberManager)
+	if !ok {
+		return nil, eris.Errorf("members is only supported for AGE backends, not %s", store.Name())
+	}
+	return manager, nil
+}
+
+// readMemberRecipient accepts an age or ssh public key, or the path of an
+// ssh public key file
+func readMemberRecipient(pathOrKey string) (string, error) {
+	if strings.HasPrefix(pathOrKey, "age1") {
+		_, err := parseRecipient(pathOrKey)
+		return pathOrKey, eris.Wrap(err, "invalid public key")
+	}
+	return readSSHRecipient(pathOrKey)
+}
+
+// membersReport renders the chain's members and the values which
+// need rotating after members were removed
+func membersReport(registry *recipientRegistry, flags rotationFlags) string {
+	var b bytes.Buffer
+	for _, e := range registry.Recipients {
+		if e.Member {
+			groups := strings.Join(e.Groups, ",")
+			if groups == "" {
+				groups = "-"
+			}
+			b.WriteString(e.Label + "  " + string(e.State) + "  " + groups + "  " + e.Recipient + "\n")
+		}
+	}
+	for _, k := range flags.Keys() {
+		b.WriteString("ROTATE: " + k + " (readable by " + strings.Join(flags.Members(k), ", ") + ")\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
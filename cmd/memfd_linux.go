@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"io"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+// secretMemfd returns a memfd holding value, sealed so the command can't
+// change it, or nil when the kernel doesn't support memfds
+func secretMemfd(name string, value []byte) (*os.File, error) {
+	fd, err := unix.MemfdCreate(ConfigPrefix+"-"+name, unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		log.Debug().Err(err).Msg("Unable to create memfd, falling back to a pipe")
+		return nil, nil
+	}
+	f := os.NewFile(uintptr(fd), name)
+	if _, err := f.Write(value); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	seals := unix.F_SEAL_SHRINK | unix.F_SEAL_GROW | unix.F_SEAL_WRITE | unix.F_SEAL_SEAL
+	if _, err := unix.FcntlInt(f.Fd(), unix.F_ADD_SEALS, seals); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// Memory hardening
+//
+// Decrypted values, data keys and passwords are kept out of swap, core
+// dumps and other processes where the platform allows:
+//
+//   - hardenProcess, called before any secret is read, disables core dumps
+//     with RLIMIT_CORE=0 and on Linux sets PR_SET_DUMPABLE=0, which also
+//     stops other processes of the same user from attaching with ptrace
+//   - secrets are allocated with secretAlloc from memory mapped outside the
+//     Go heap, so the garbage collector never leaves copies behind, which
+//     is mlock'd so it is never swapped and on Linux excluded from core dumps
+//   - wipe zeroes a buffer once the secret in it is no longer needed,
+//     wipeSecretValues zeroes all secret memory once exec has handed the
+//     values over to a command and wipeSecrets also zeroes the values kept
+//     for log redaction before chain exits
+//
+// Strings can't be zeroed so secrets are kept as []byte wherever the
+// libraries in use allow it.
+
+// secretChunkSize is how much memory is locked at a time, mlock works on
+// whole pages so secrets are packed into chunks
+const secretChunkSize = 64 * 1024
+
+// lockedMemory hands out locked memory which is zeroed all at once
+type lockedMemory struct {
+	sync.Mutex
+	chunks [][]byte
+	free   []byte
+}
+
+// secretMemory holds decrypted values, keys and passwords
+var secretMemory lockedMemory
+
+// redactionMemory holds the copies of secrets logSink redacts, which must
+// outlive the values as chain may log after wiping them
+var redactionMemory lockedMemory
+
+// alloc returns n zeroed bytes of locked memory
+func (m *lockedMemory) alloc(n int) []byte {
+	m.Lock()
+	defer m.Unlock()
+
+	if n > len(m.free) {
+		size := secretChunkSize
+		if n > size {
+			page := os.Getpagesize()
+			size = (n + page - 1) / page * page
+		}
+		chunk := allocLocked(size)
+		m.chunks = append(m.chunks, chunk)
+		m.free = chunk
+	}
+	b := m.free[:n:n]
+	m.free = m.free[n:]
+	return b
+}
+
+// copy copies b into locked memory
+func (m *lockedMemory) copy(b []byte) []byte {
+	c := m.alloc(len(b))
+	copy(c, b)
+	return c
+}
+
+// wipe zeroes all memory handed out, which must not be used afterwards
+func (m *lockedMemory) wipe() {
+	m.Lock()
+	defer m.Unlock()
+	for _, chunk := range m.chunks {
+		wipe(chunk)
+	}
+}
+
+// secretAlloc returns n zeroed bytes of locked memory
+func secretAlloc(n int) []byte {
+	return secretMemory.alloc(n)
+}
+
+// secretCopy copies b into locked memory
+func secretCopy(b []byte) []byte {
+	return secretMemory.copy(b)
+}
+
+// readSecret reads r to the end into locked memory, wiping the smaller
+// buffers it outgrows
+func readSecret(r io.Reader) ([]byte, error) {
+	b := secretAlloc(512)[:0]
+	for {
+		if len(b) == cap(b) {
+			grown := secretAlloc(2 * cap(b))
+			copy(grown, b)
+			wipe(b)
+			b = grown[:len(b)]
+		}
+		n, err := r.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+		if err == io.EOF {
+			return b, nil
+		} else if err != nil {
+			return b, err
+		}
+	}
+}
+
+// wipe zeroes b up to its capacity
+func wipe(b []byte) {
+	b = b[:cap(b)]
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// wipeSecretValues zeroes all secret memory and forgets the cached
+// passwords, leaving the values registered for log redaction. Secrets read
+// before it was called must not be used afterwards.
+func wipeSecretValues() {
+	passwordCache = map[string][]byte{}
+	fdPassword = nil
+	secretMemory.wipe()
+}
+
+// wipeSecrets zeroes all secrets including the values registered for log
+// redaction, after which nothing may be logged
+func wipeSecrets() {
+	wipeSecretValues()
+
+	logSink.mu.Lock()
+	logSink.secrets = nil
+	logSink.mu.Unlock()
+	redactionMemory.wipe()
+}
@@ -0,0 +1,18 @@
+package cmd
+
+import (
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+func setNotDumpable() {
+	if err := unix.Prctl(unix.PR_SET_DUMPABLE, 0, 0, 0, 0); err != nil {
+		log.Debug().Err(err).Msg("Unable to mark the process as not dumpable")
+	}
+}
+
+func excludeFromCoreDump(b []byte) {
+	if err := unix.Madvise(b, unix.MADV_DONTDUMP); err != nil {
+		log.Debug().Err(err).Msg("Unable to exclude secrets from core dumps")
+	}
+}
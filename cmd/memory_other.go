@@ -0,0 +1,9 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package cmd
+
+// setNotDumpable is Linux only, RLIMIT_CORE still disables core dumps
+func setNotDumpable() {}
+
+func excludeFromCoreDump(b []byte) {}
@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+// hardenProcess disables core dumps and, on Linux, ptrace and /proc access
+// by other processes, see memory.go
+func hardenProcess() {
+	if err := unix.Setrlimit(unix.RLIMIT_CORE, &unix.Rlimit{}); err != nil {
+		log.Debug().Err(err).Msg("Unable to disable core dumps")
+	}
+	setNotDumpable()
+}
+
+// allocLocked maps size bytes outside the Go heap and locks them into RAM,
+// the memory is still used unlocked when RLIMIT_MEMLOCK is exhausted
+func allocLocked(size int) []byte {
+	b, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		log.Debug().Err(err).Msg("Unable to map memory for secrets")
+		return make([]byte, size)
+	}
+	if err := unix.Mlock(b); err != nil {
+		log.Debug().Err(err).Msg("Unable to lock memory for secrets, they may be swapped to disk")
+	}
+	excludeFromCoreDump(b)
+	return b
+}
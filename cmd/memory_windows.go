@@ -0,0 +1,25 @@
+//go:build windows
+// +build windows
+
+package cmd
+
+import (
+	"unsafe"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/windows"
+)
+
+// hardenProcess does nothing on Windows, which doesn't write core dumps
+// unless configured to
+func hardenProcess() {}
+
+// allocLocked locks size bytes into RAM, Go's garbage collector doesn't
+// move allocations so the locked pages stay with the slice
+func allocLocked(size int) []byte {
+	b := make([]byte, size)
+	if err := windows.VirtualLock(uintptr(unsafe.Pointer(&b[0])), uintptr(size)); err != nil {
+		log.Debug().Err(err).Msg("Unable to lock memory for secrets, they may be swapped to disk")
+	}
+	return b
+}
@@ -55,7 +55,7 @@ func (s MetadataEncodedStore) ensureData() error {
 	if errors.Is(err, keyring.ErrKeyNotFound) {
 		idx := make(map[string]*chainv1.IndexEntry)
 		meta = chainv1.Storage{Type: chainv1.StorageType_STORAGE_TYPE_METADATA_ENCODED_STORE, ReverseIndex: idx}
-		log.Debug().Msgf("Metadata after init: %+v", meta)
+		log.Debug().Int("entries", len(meta.ReverseIndex)).Msg("Metadata after init")
 	} else {
 		proto.Unmarshal(item.Data, &meta)
 	}
@@ -91,7 +91,7 @@ func (s MetadataEncodedStore) Set(item keyring.Item) error {
 	uuid := uuid.New()
 	itemWithUUID := item
 	itemWithUUID.Key = uuid.String()
-	log.Printf("METADATA: %+v", meta)
+	log.Debug().Int("entries", len(meta.ReverseIndex)).Msg("Metadata")
 
 	meta.ReverseIndex[item.Key] = &chainv1.IndexEntry{Key: uuid.String(), Value: item.Data}
 	b, err := proto.Marshal(&meta)
@@ -0,0 +1,79 @@
+/*
+Copyright © 2022 Zander Hill <zander@xargs.io>
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/rotisserie/eris"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate [keychain]",
+	Short: "Bind the values of an age chain written by older versions to their key and chain",
+	Long: `
+	Re-encrypt values of an age chain written before values were bound to
+	their key and chain. Values in those formats are refused by get and exec
+	because anyone with the chain's public keys could have written them.
+
+	The chain is first verified against its signed manifest. Chains written
+	before manifests have nothing to verify against and are only migrated
+	with --trust, after checking nobody else could have written to them.
+
+	eg:
+	chain migrate aws-creds
+	chain migrate aws-creds --trust
+`,
+	Args:    cobra.ExactArgs(1),
+	PreRun:  lockChainPreRun(exclusiveLock),
+	PostRun: unlockChainPostRun,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := migrate(args[0]); err != nil {
+			log.Fatal().Msgf(eris.ToString(err, true))
+		}
+	},
+}
+
+var migrateTrust bool
+
+func init() {
+	migrateCmd.Flags().BoolVar(&migrateTrust, "trust", false, "migrate a chain which has no signed manifest to verify its values against")
+	RootCmd.AddCommand(migrateCmd)
+}
+
+// migrator is implemented by stores which can upgrade values written in
+// older formats
+type migrator interface {
+	Store
+	Migrate(trust bool) ([]string, error)
+}
+
+func migrate(chain string) error {
+	store, err := NewStore(chain)
+	if err != nil {
+		return eris.Wrapf(err, "Unable to open keyring for chain: %+v", chain)
+	}
+	m, ok := store.(migrator)
+	if !ok {
+		return eris.Errorf("migrate is only supported for AGE backends, not %s", store.Name())
+	}
+
+	keys, err := m.Migrate(migrateTrust)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		fmt.Printf("Chain %s has no values to migrate\n", chain)
+		return nil
+	}
+	// Expires the one-time key used to decrypt the chain
+	if err := m.PostRunHook(); err != nil {
+		return err
+	}
+	fmt.Printf("Migrated %d value(s)\n", len(keys))
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright © 2022 Zander Hill <zander@xargs.io>
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rotisserie/eris"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+// passwdCmd represents the passwd command
+var passwdCmd = &cobra.Command{
+	Use:   "passwd [keychain]",
+	Short: "Change the password of a chain",
+	Long: `
+	Change the password of a chain
+
+	The current password is verified before prompting for the new one,
+	then every value is re-encrypted under the new password. The change is
+	atomic, if it is interrupted the chain keeps either the old or the new
+	password.
+
+	Each chain can have its own password. CHAIN_PASSWORD_COMMAND gets the
+	chain's name in CHAIN_NAME and can print a different password for each
+	chain. CHAIN_PASSWORD_<CHAIN>, the chain's name in upper case with other
+	characters replaced by '_', takes precedence over CHAIN_PASSWORD but is
+	refused when it would match several chains, eg a-b and a_b. Scripts
+	can supply the new password with CHAIN_NEW_PASSWORD.
+
+	eg:
+	chain passwd aws-creds
+	CHAIN_PASSWORD_COMMAND='pass show chain/$CHAIN_NAME' chain get aws-creds
+	CHAIN_PASSWORD_AWS_CREDS=... chain get aws-creds
+`,
+	Args:    cobra.ExactArgs(1),
+	PreRun:  lockChainPreRun(exclusiveLock),
+	PostRun: unlockChainPostRun,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := changePassword(args[0]); err != nil {
+			log.Fatal().Msgf(eris.ToString(err, true))
+		}
+	},
+}
+
+// passwordChanger is implemented by stores encrypted with the chain's
+// password. ChangePassword verifies the current password before calling
+// newPassword.
+type passwordChanger interface {
+	Store
+	ChangePassword(newPassword func() (string, error)) error
+}
+
+func init() {
+	RootCmd.AddCommand(passwdCmd)
+}
+
+func changePassword(chain string) error {
+	ring, err := NewStore(chain)
+	if err != nil {
+		return eris.Wrapf(err, "Unable to open keyring for chain: %+v", chain)
+	}
+	changer, ok := ring.(passwordChanger)
+	if !ok {
+		return eris.Errorf("%s chains are not encrypted with a chain password", ring.Name())
+	}
+
+	if err := changer.ChangePassword(getNewPassword); err != nil {
+		return err
+	}
+	fmt.Printf("Changed password for chain %s\n", chain)
+
+	env := chainPasswordEnv(chain)
+	if os.Getenv(env) != "" {
+		log.Warn().Msgf("Update %s with the new password", env)
+	} else if os.Getenv("CHAIN_PASSWORD") != "" {
+		log.Warn().Msgf("CHAIN_PASSWORD no longer unlocks chain %s, have CHAIN_PASSWORD_COMMAND print its new password when CHAIN_NAME=%s", chain, chain)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/rotisserie/eris"
+)
+
+// Pinentry client
+//
+// pinentry programs, eg pinentry-curses, pinentry-gnome3 or pinentry-mac,
+// ask for a password in a terminal or GUI dialog. chain talks to them with
+// the Assuan protocol, one command per line answered by data lines and a
+// final OK or ERR:
+//
+//	-> SETPROMPT Password:
+//	<- OK
+//	-> GETPIN
+//	<- D correct%25horse
+//	<- OK
+//
+// See: https://www.gnupg.org/documentation/manuals/assuan/
+
+var ErrPinentryCancelled = errors.New("password entry was cancelled")
+
+// Assuan error code of a cancelled GETPIN, GPG_ERR_CANCELED in the pinentry source
+const pinentryCancelledCode = 83886179
+
+type pinentryConn struct {
+	w io.Writer
+	r *bufio.Reader
+}
+
+// pinentry asks for a password with program, showing description above
+// the prompt
+func pinentry(program string, description string, prompt string) (string, error) {
+	c := exec.Command(program)
+	in, err := c.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	out, err := c.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := c.Start(); err != nil {
+		return "", eris.Wrapf(err, "Unable to start pinentry: %+v", program)
+	}
+	defer func() {
+		in.Close()
+		_ = c.Wait()
+	}()
+
+	p := pinentryConn{w: in, r: bufio.NewReader(out)}
+	// The greeting
+	if _, err := p.response(); err != nil {
+		return "", err
+	}
+
+	commands := []string{
+		"SETTITLE " + ConfigPrefix,
+		"SETDESC " + assuanEscape(description),
+		"SETPROMPT " + assuanEscape(prompt),
+	}
+	if tty := pinentryTTY(); tty != "" {
+		commands = append(commands, "OPTION ttyname="+tty)
+	}
+	if term := os.Getenv("TERM"); term != "" {
+		commands = append(commands, "OPTION ttytype="+term)
+	}
+	for _, command := range commands {
+		if _, err := p.command(command); err != nil {
+			return "", err
+		}
+	}
+
+	pin, err := p.command("GETPIN")
+	if err != nil {
+		return "", err
+	}
+	_, _ = p.command("BYE")
+	return pin, nil
+}
+
+// command sends one command and returns the data of its response
+func (p pinentryConn) command(command string) (string, error) {
+	if _, err := fmt.Fprintf(p.w, "%s\n", command); err != nil {
+		return "", eris.Wrap(err, "Unable to write to pinentry")
+	}
+	data, err := p.response()
+	if err != nil {
+		verb, _, _ := strings.Cut(command, " ")
+		return "", eris.Wrapf(err, "pinentry %s failed", verb)
+	}
+	return data, nil
+}
+
+// response reads lines up to an OK or ERR, collecting data lines
+func (p pinentryConn) response() (string, error) {
+	var data strings.Builder
+	for {
+		line, err := p.r.ReadString('\n')
+		if err != nil {
+			return "", eris.Wrap(err, "Unable to read from pinentry")
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return data.String(), nil
+		case strings.HasPrefix(line, "ERR "):
+			code, message, _ := strings.Cut(strings.TrimPrefix(line, "ERR "), " ")
+			if n, _ := strconv.Atoi(code); n == pinentryCancelledCode {
+				return "", ErrPinentryCancelled
+			}
+			return "", eris.Errorf("pinentry error %s: %s", code, message)
+		case strings.HasPrefix(line, "D "):
+			data.WriteString(assuanUnescape(strings.TrimPrefix(line, "D ")))
+		case strings.HasPrefix(line, "INQUIRE "):
+			return "", eris.Errorf("unexpected pinentry inquiry: %s", line)
+		}
+		// Status (S) and comment (#) lines are ignored
+	}
+}
+
+// pinentryTTY is the terminal curses pinentries should draw on, GPG_TTY if
+// set like gpg-agent, otherwise the controlling terminal prompts use, as
+// stdin may be carrying piped data
+func pinentryTTY() string {
+	if tty := os.Getenv("GPG_TTY"); tty != "" {
+		return tty
+	}
+	in, out, err := openTTY()
+	if err != nil {
+		return ""
+	}
+	in.Close()
+	if out != in {
+		out.Close()
+	}
+	return in.Name()
+}
+
+// assuanEscape percent encodes the characters which can't appear in a line
+func assuanEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+func assuanUnescape(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -1,42 +1,88 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/99designs/keyring"
+	"github.com/rotisserie/eris"
 	chainv1 "github.com/zph/chain/gen/go/chain/v1"
 )
 
+// passwdStagingDir holds the re-encrypted files of a password change on
+// the file backend until they are moved into place, see ChangePassword
+var passwdStagingDir = ".passwd"
+var passwdCommitFile = ".COMMIT"
+
+var ErrPasswordChangePending = errors.New("an interrupted password change of the chain must be completed first")
+
 type KeychainByPlatformStore struct {
 	keyring.Keyring
+	chain   string
+	dir     string
+	backend keyring.BackendType
 }
 
 func NewKeychainByPlatform(chain string) (Store, error) {
-	s := KeychainByPlatformStore{}
+	s := KeychainByPlatformStore{chain: chain, dir: filePath(chain)}
+	// Only a command holding the chain's exclusive lock moves files in the
+	// chain, readers would race it
+	if !lockedExclusively(chain) {
+		if passwordChangeCommitted(s.dir) {
+			return nil, eris.Wrapf(ErrPasswordChangePending, "%s, complete it with a command which writes to the chain, eg chain set %s </dev/null", chain, chain)
+		}
+	} else if err := finishPasswordChange(s.dir); err != nil {
+		return nil, eris.Wrapf(err, "Unable to recover an interrupted password change for chain: %+v", chain)
+	}
+
 	namespacedChain := fmt.Sprintf("%s:%s", ConfigPrefix, chain)
-	// Available backends are used in descending order by Operating system
-	// which requires supplying config for many variants
-	// See: https://github.com/99designs/keyring/blob/master/keyring.go#L27-L39
-	k, err := keyring.Open(keyring.Config{
-		AllowedBackends:          keyring.AvailableBackends(),
+	config := keyring.Config{
 		ServiceName:              chain,
 		KeychainName:             namespacedChain,
 		KeychainTrustApplication: true,
-		FilePasswordFunc:         getPassword,
-		FileDir:                  filePath(chain),
+		FilePasswordFunc:         chainPasswordFunc(chain),
+		FileDir:                  s.dir,
 		// KeyCtlScope is the scope of the kernel keyring (either "user", "session", "process" or "thread")
 		KeyCtlScope: "session",
 
 		// KeyCtlPerm is the permission mask to use for new keys
 		// KeyCtlPerm uint32
 
-	})
+	}
+	// Available backends are used in descending order by Operating system
+	// which requires supplying config for many variants, the first one
+	// which opens is used and recorded so passwd knows if it is the file
+	// backend
+	// See: https://github.com/99designs/keyring/blob/master/keyring.go#L27-L39
+	for _, backend := range keyring.AvailableBackends() {
+		config.AllowedBackends = []keyring.BackendType{backend}
+		k, err := keyring.Open(config)
+		if err == nil {
+			s.Keyring, s.backend = k, backend
+			return s, nil
+		}
+	}
+	return nil, keyring.ErrNoAvailImpl
+}
+
+// Keys skips the chain's hidden files, such as the lock file, which are
+// listed as keys when the platform falls back to the file backend
+func (s KeychainByPlatformStore) Keys() ([]string, error) {
+	keys, err := s.Keyring.Keys()
 	if err != nil {
 		return nil, err
 	}
 
-	s.Keyring = k
-	return s, nil
+	var output []string
+	for _, k := range keys {
+		if !strings.HasPrefix(k, ".") {
+			output = append(output, k)
+		}
+	}
+	return output, nil
 }
 
 func (s KeychainByPlatformStore) PostRunHook() error { return nil }
@@ -44,3 +90,98 @@ func (s KeychainByPlatformStore) PostRunHook() error { return nil }
 func (s KeychainByPlatformStore) Name() string {
 	return chainv1.StorageType_STORAGE_TYPE_KEYCHAIN_BY_PLATFORM.String()
 }
+
+// ChangePassword re-encrypts every key when the platform fell back to the
+// file backend. The new files are written to passwdStagingDir, which is
+// committed by writing passwdCommitFile and then moved into place. A change
+// interrupted before the commit is discarded and one interrupted after it
+// is completed by finishPasswordChange when the chain is next opened.
+func (s KeychainByPlatformStore) ChangePassword(newPassword func() (string, error)) error {
+	if s.backend != keyring.FileBackend {
+		return eris.Errorf("chain %s is stored in the %s backend which is protected by the operating system, not a chain password", s.chain, s.backend)
+	}
+
+	keys, err := s.Keys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return eris.Errorf("chain %s has no values", s.chain)
+	}
+	var items []keyring.Item
+	for _, k := range keys {
+		item, err := s.Get(k)
+		if err != nil {
+			return eris.Wrapf(err, "Unable to get key: %+v", k)
+		}
+		registerSecret(item.Data)
+		items = append(items, item)
+	}
+
+	password, err := newPassword()
+	if err != nil {
+		return err
+	}
+
+	staging := filepath.Join(s.dir, passwdStagingDir)
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(staging, 0700); err != nil {
+		return err
+	}
+	k, err := keyring.Open(keyring.Config{
+		AllowedBackends:  []keyring.BackendType{keyring.FileBackend},
+		ServiceName:      s.chain,
+		FilePasswordFunc: keyring.FixedStringPrompt(password),
+		FileDir:          staging,
+	})
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := k.Set(item); err != nil {
+			return eris.Wrapf(err, "Unable to set key: %+v", item.Key)
+		}
+	}
+
+	if err := writeFileAtomic(filepath.Join(staging, passwdCommitFile), nil, secureFSPerm); err != nil {
+		return err
+	}
+	return finishPasswordChange(s.dir)
+}
+
+// passwordChangeCommitted reports whether dir holds a committed password
+// change which hasn't been moved into place
+func passwordChangeCommitted(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, passwdStagingDir, passwdCommitFile))
+	return err == nil
+}
+
+// finishPasswordChange completes a committed password change in dir by
+// moving the staged files into place, or discards an uncommitted one
+func finishPasswordChange(dir string) error {
+	staging := filepath.Join(dir, passwdStagingDir)
+	if _, err := os.Stat(filepath.Join(staging, passwdCommitFile)); errors.Is(err, os.ErrNotExist) {
+		return os.RemoveAll(staging)
+	} else if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(staging)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Name() == passwdCommitFile {
+			continue
+		}
+		if err := os.Rename(filepath.Join(staging, e.Name()), filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(filepath.Join(staging, passwdCommitFile)); err != nil {
+		return err
+	}
+	return os.RemoveAll(staging)
+}
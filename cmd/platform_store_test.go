@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestFinishPasswordChange(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{"A": "old A", "B": "old B", lockFile: ""})
+	writeTestFiles(t, filepath.Join(dir, passwdStagingDir), map[string]string{
+		"A":              "new A",
+		"B":              "new B",
+		passwdCommitFile: "",
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := finishPasswordChange(dir); err != nil {
+			t.Fatal(err)
+		}
+		assertFiles(t, dir, map[string]string{"A": "new A", "B": "new B", lockFile: ""})
+	}
+}
+
+func TestFinishPasswordChangeUncommitted(t *testing.T) {
+	dir := t.TempDir()
+	chain := map[string]string{"A": "old A", "B": "old B"}
+	writeTestFiles(t, dir, chain)
+	writeTestFiles(t, filepath.Join(dir, passwdStagingDir), map[string]string{"A": "new A"})
+
+	if err := finishPasswordChange(dir); err != nil {
+		t.Fatal(err)
+	}
+	assertFiles(t, dir, chain)
+}
+
+// TestPasswordChangeRecoveryNeedsExclusiveLock leaves a committed password
+// change which readers must not move into place
+func TestPasswordChangeRecoveryNeedsExclusiveLock(t *testing.T) {
+	useTestChainDir(t)
+	dir := filePath("aws")
+	writeTestFiles(t, dir, map[string]string{"A": "old A"})
+	writeTestFiles(t, filepath.Join(dir, passwdStagingDir), map[string]string{"A": "new A", passwdCommitFile: ""})
+
+	holdLock(t, "aws", lockShared)
+	if _, err := NewKeychainByPlatform("aws"); !errors.Is(err, ErrPasswordChangePending) {
+		t.Errorf("got %v, want ErrPasswordChangePending", err)
+	}
+	if !passwordChangeCommitted(dir) {
+		t.Fatal("a reader moved the staged files")
+	}
+	unlockChainPostRun(nil, nil)
+
+	// Opening a platform keyring may fail in a test environment, the
+	// password change is completed before
+	holdLock(t, "aws", lockExclusive)
+	_, _ = NewKeychainByPlatform("aws")
+	assertFiles(t, dir, map[string]string{"A": "new A", lockFile: ""})
+}
@@ -0,0 +1,40 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// processAlive reports whether a process with pid exists. A process owned
+// by another user is reported as alive.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// isPrivateDir reports whether only the current user can access the directory
+func isPrivateDir(info fs.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && int(stat.Uid) == os.Getuid() && info.Mode().Perm() == 0700
+}
+
+// shellCommand runs command with sh, as password_command is a shell string
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("sh", "-c", command)
+}
+
+// openTTY opens the controlling terminal for prompts
+func openTTY() (*os.File, *os.File, error) {
+	f, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	return f, f, err
+}
+
+// canInheritFDs reports whether commands can inherit descriptors
+// beyond stdin, stdout and stderr, see exec.Cmd.ExtraFiles
+const canInheritFDs = true
@@ -0,0 +1,49 @@
+//go:build windows
+// +build windows
+
+package cmd
+
+import (
+	"io/fs"
+	"os"
+	"os/exec"
+)
+
+// processAlive reports whether a process with pid exists
+func processAlive(pid int) bool {
+	// On Windows FindProcess opens a handle and fails for missing processes
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	_ = p.Release()
+	return true
+}
+
+// isPrivateDir is always true on Windows where the directory
+// is created inside the user's own temp directory
+func isPrivateDir(info fs.FileInfo) bool {
+	return true
+}
+
+// shellCommand runs command with cmd, as password_command is a shell string
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("cmd", "/C", command)
+}
+
+// openTTY opens the console for prompts
+func openTTY() (*os.File, *os.File, error) {
+	in, err := os.OpenFile("CONIN$", os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	out, err := os.OpenFile("CONOUT$", os.O_WRONLY, 0)
+	if err != nil {
+		in.Close()
+		return nil, nil, err
+	}
+	return in, out, nil
+}
+
+// canInheritFDs is false as exec.Cmd.ExtraFiles is not supported on Windows
+const canInheritFDs = false
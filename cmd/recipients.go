@@ -0,0 +1,383 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/rotisserie/eris"
+)
+
+// Recipient registry
+//
+// recipientsFile lists every public key a chain has been encrypted to along
+// with a stable ID, a label and its state. Only active recipients are used
+// when encrypting. Chains created before the registry kept a plain list of
+// public keys in publicKeyFile, which is imported on load and removed the
+// next time the registry is saved.
+
+var recipientsFile = ".RECIPIENTS"
+
+type recipientState string
+
+const (
+	recipientActive  recipientState = "active"
+	recipientUsed    recipientState = "used"
+	recipientRevoked recipientState = "revoked"
+)
+
+var ErrRecipientNotFound = errors.New("recipient not found")
+
+type recipientEntry struct {
+	ID        string         `json:"id"`
+	Recipient string         `json:"recipient"`
+	Label     string         `json:"label,omitempty"`
+	State     recipientState `json:"state"`
+	Index     *uint32        `json:"index,omitempty"`  // set for keys derived from a seed, see deriveIdentity
+	Member    bool           `json:"member,omitempty"` // added with chain members add, Label is their name
+	Groups    []string       `json:"groups,omitempty"` // recipient groups, see groupKeyFile
+	Created   time.Time      `json:"created"`
+	Updated   time.Time      `json:"updated"`
+}
+
+type recipientRegistry struct {
+	Version    int               `json:"version"`
+	Recipients []recipientEntry  `json:"recipients"`
+	GroupMACs  map[string][]byte `json:"group_macs,omitempty"` // see groupMembersMAC
+}
+
+// recipientID is the hex SHA-256 of the public key, which unlike a prefix of
+// the key itself is unique and has the same length for every key type
+func recipientID(recipient string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(recipient)))
+	return hex.EncodeToString(sum[:])
+}
+
+func loadRecipients(dir string) (*recipientRegistry, error) {
+	b, err := os.ReadFile(filepath.Join(dir, recipientsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return loadLegacyRecipients(dir)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var r recipientRegistry
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, eris.Wrapf(err, "Unable to parse %s", recipientsFile)
+	}
+	return &r, nil
+}
+
+// loadLegacyRecipients imports publicKeyFile, treating every key as active
+func loadLegacyRecipients(dir string) (*recipientRegistry, error) {
+	r := &recipientRegistry{Version: 1}
+
+	b, err := os.ReadFile(filepath.Join(dir, publicKeyFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := r.Add(line, ""); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func recipientsExist(dir string) bool {
+	for _, f := range []string{recipientsFile, publicKeyFile} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *recipientRegistry) Save(dir string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, recipientsFile), b, secureFSPerm); err != nil {
+		return err
+	}
+
+	err = os.Remove(filepath.Join(dir, publicKeyFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Add registers an active recipient, returning the existing entry when
+// the public key is already registered
+func (r *recipientRegistry) Add(recipient string, label string) (*recipientEntry, error) {
+	recipient = strings.TrimSpace(recipient)
+	if _, err := parseRecipient(recipient); err != nil {
+		return nil, eris.Wrap(err, "invalid public key")
+	}
+
+	id := recipientID(recipient)
+	if e, err := r.Find(id); err == nil {
+		return e, nil
+	}
+
+	now := time.Now().UTC()
+	r.Recipients = append(r.Recipients, recipientEntry{
+		ID:        id,
+		Recipient: recipient,
+		Label:     label,
+		State:     recipientActive,
+		Created:   now,
+		Updated:   now,
+	})
+	return &r.Recipients[len(r.Recipients)-1], nil
+}
+
+// Find looks up a recipient by ID, unique ID prefix, label or public key
+func (r *recipientRegistry) Find(ref string) (*recipientEntry, error) {
+	var found *recipientEntry
+	for i := range r.Recipients {
+		e := &r.Recipients[i]
+		if e.ID == ref || e.Recipient == ref {
+			return e, nil
+		}
+		if e.Label == ref || (len(ref) >= 8 && strings.HasPrefix(e.ID, ref)) {
+			if found != nil {
+				return nil, eris.Errorf("%q matches more than one recipient", ref)
+			}
+			found = e
+		}
+	}
+	if found == nil {
+		return nil, eris.Wrapf(ErrRecipientNotFound, "%q", ref)
+	}
+	return found, nil
+}
+
+func (r *recipientRegistry) SetState(ref string, state recipientState) (*recipientEntry, error) {
+	e, err := r.Find(ref)
+	if err != nil {
+		return nil, err
+	}
+	e.State = state
+	e.Updated = time.Now().UTC()
+	return e, nil
+}
+
+func (r *recipientRegistry) Active() []recipientEntry {
+	var active []recipientEntry
+	for _, e := range r.Recipients {
+		if e.State == recipientActive {
+			active = append(active, e)
+		}
+	}
+	return active
+}
+
+// isOneTimeKey reports whether recipient is an age X25519 key, which
+// age-otp-store expires after use unlike ssh keys
+func isOneTimeKey(recipient string) bool {
+	return strings.HasPrefix(recipient, "age1")
+}
+
+// OneTimeKeys counts the active and used one-time keys
+func (r *recipientRegistry) OneTimeKeys() (active int, used int) {
+	for _, e := range r.Recipients {
+		if !isOneTimeKey(e.Recipient) {
+			continue
+		}
+		switch e.State {
+		case recipientActive:
+			active++
+		case recipientUsed:
+			used++
+		}
+	}
+	return active, used
+}
+
+// SeedIndexes returns the indexes of the active seed derived keys in the
+// order they will be used
+func (r *recipientRegistry) SeedIndexes() []uint32 {
+	var indexes []uint32
+	for _, e := range r.Active() {
+		if e.Index != nil {
+			indexes = append(indexes, *e.Index)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	return indexes
+}
+
+// NextSeedIndex returns the index the next derived key should be created at
+func (r *recipientRegistry) NextSeedIndex() uint32 {
+	var next uint32
+	for _, e := range r.Recipients {
+		if e.Index != nil && *e.Index >= next {
+			next = *e.Index + 1
+		}
+	}
+	return next
+}
+
+func (r *recipientRegistry) ActiveRecipients() ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, e := range r.Active() {
+		recipient, err := parseRecipient(e.Recipient)
+		if err != nil {
+			return nil, eris.Wrapf(err, "invalid public key for recipient %s", e.ID)
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, nil
+}
+
+// recipientStatePrecedence orders states so that a key which was used or
+// revoked in any copy of a chain stays used or revoked when merging
+var recipientStatePrecedence = map[recipientState]int{
+	recipientActive:  0,
+	recipientUsed:    1,
+	recipientRevoked: 2,
+}
+
+// recipientsLegacy reports whether the chain in dir only has publicKeyFile
+func recipientsLegacy(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, recipientsFile))
+	return errors.Is(err, os.ErrNotExist) && recipientsExist(dir)
+}
+
+// mergeRecipients combines the registries of two copies of a chain, see
+// chain sync. Registries imported from publicKeyFile only list unused keys,
+// so a key missing from one of those was expired in that copy. Groups are
+// merged against base, see mergeGroups.
+func mergeRecipients(local, remote *recipientRegistry, localLegacy, remoteLegacy bool, base syncBase) *recipientRegistry {
+	merged := &recipientRegistry{Version: local.Version}
+	if remote.Version > merged.Version {
+		merged.Version = remote.Version
+	}
+	merged.Recipients = append(merged.Recipients, local.Recipients...)
+	for i := range merged.Recipients {
+		merged.Recipients[i].Groups = append([]string(nil), merged.Recipients[i].Groups...)
+	}
+	// The MACs of groups with a data key are decided by mergeGroupMembers
+	for _, r := range []*recipientRegistry{remote, local} {
+		for group, mac := range r.GroupMACs {
+			if merged.GroupMACs == nil {
+				merged.GroupMACs = make(map[string][]byte)
+			}
+			merged.GroupMACs[group] = mac
+		}
+	}
+
+	for _, re := range remote.Recipients {
+		e, err := merged.Find(re.ID)
+		if err != nil {
+			merged.Recipients = append(merged.Recipients, re)
+			continue
+		}
+
+		if recipientStatePrecedence[re.State] > recipientStatePrecedence[e.State] {
+			e.State = re.State
+		}
+		if re.Updated.After(e.Updated) {
+			e.Updated = re.Updated
+			e.Label = re.Label
+		}
+		if e.Index == nil {
+			e.Index = re.Index
+		}
+		e.Member = e.Member || re.Member
+		e.Groups = mergeGroups(e.ID, e.Groups, re.Groups, base)
+	}
+
+	for _, side := range []struct {
+		registry *recipientRegistry
+		legacy   bool
+	}{{local, localLegacy}, {remote, remoteLegacy}} {
+		if !side.legacy {
+			continue
+		}
+		for i := range merged.Recipients {
+			e := &merged.Recipients[i]
+			if _, err := side.registry.Find(e.ID); err != nil && e.State == recipientActive {
+				e.State = recipientUsed
+			}
+		}
+	}
+	return merged
+}
+
+// mergeGroups merges the groups of recipient id in two copies of a chain.
+// A group it was added to or removed from in one copy since the last sync
+// follows that copy, before the first sync it is in the groups of both.
+func mergeGroups(id string, local, remote []string, base syncBase) []string {
+	in := make(map[string][2]bool)
+	for i, groups := range [][]string{local, remote} {
+		for _, g := range groups {
+			sides := in[g]
+			sides[i] = true
+			in[g] = sides
+		}
+	}
+
+	var merged []string
+	for g, sides := range in {
+		keep := sides[0] && sides[1]
+		if sides[0] != sides[1] {
+			was := base.inGroup(g, id)
+			// The copy which differs from the last sync changed it
+			keep = was == nil || !*was
+		}
+		if keep {
+			merged = append(merged, g)
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+// identityRecipient returns the public key of an age X25519 identity, the
+// only identity type which is used as a one-time key
+func identityRecipient(identity age.Identity) (string, bool) {
+	switch i := identity.(type) {
+	case *age.X25519Identity:
+		return i.Recipient().String(), true
+	}
+	return "", false
+}
+
+// recipientsReport renders entries for display
+func recipientsReport(entries []recipientEntry) string {
+	var b bytes.Buffer
+	for _, e := range entries {
+		label := e.Label
+		if label == "" {
+			label = "-"
+		}
+		if e.Index != nil {
+			label += fmt.Sprintf(" (index %d)", *e.Index)
+		}
+		if len(e.Groups) > 0 {
+			label += " [" + strings.Join(e.Groups, ",") + "]"
+		}
+		b.WriteString(e.ID + "  " + string(e.State) + "  " + label + "  " + e.Recipient + "\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -37,23 +37,47 @@ chain get chain-name
 # Execute a secondary command in the environment of these variables
 chain exec chain-name -- aws s3 ...
 
+# Chains can be namespaced with "/"
+chain set team/aws/prod
+
 # ENV variables
-CHAIN_PASSWORD=<password used in keychain for storing key>
-CHAIN_DIR=<directory for files stored on disk, default=.chain>
+CHAIN_PASSWORD=<password used in keychain for storing key, discouraged as child processes inherit it>
+CHAIN_PASSWORD_FD=<file descriptor to read the password from, eg 3 with 3< <(pass show chain)>
+CHAIN_PASSWORD_COMMAND=<command printing the password on its first line, eg "pass show chain/$CHAIN_NAME">
+CHAIN_PINENTRY=<pinentry program to ask for the password with, eg pinentry-curses or pinentry-mac>
+CHAIN_PASSWORD_<CHAIN>=<password of a single chain, eg CHAIN_PASSWORD_TEAM_AWS for team/aws, overrides CHAIN_PASSWORD, refused when several chains map to it>
+CHAIN_NEW_PASSWORD=<new password used by chain passwd instead of prompting>
+CHAIN_DIR=<directory for files stored on disk, default=.chain if present otherwise $XDG_DATA_HOME/chain>
+CHAIN_SSH_IDENTITY=<ssh private key used to decrypt AGE chains, eg ~/.ssh/id_ed25519>
+CHAIN_IDENTITY_FILE=<age identity file used to decrypt AGE chains, may be passphrase encrypted>
+CHAIN_OTP_WARN_THRESHOLD=<warn when fewer one-time keys remain in an age-otp-store chain, default=3>
+CHAIN_OTP_REPLENISH=<number of one-time keys to add when below the threshold, default=0>
+CHAIN_LOCK_TIMEOUT=<how long to wait for another chain process using the same chain, default=10s>
+CHAIN_SYNC_REMOTE=<git remote used by chain sync>
+CHAIN_SYNC_BRANCH=<branch used by chain sync, default=main>
+CHAIN_VAULT_KDF_TIME=<Argon2id passes for new vaults and chain vault upgrade, default=3>
+CHAIN_VAULT_KDF_MEMORY=<Argon2id memory in MiB, default=64>
+CHAIN_VAULT_KDF_THREADS=<Argon2id parallelism, default=4>
 
 # Values can be set in a .chain.hcl configuration file
 Use "chain init" to create the init file in .chain/.chain.hcl
 
 Security:
-- Designed to use established tools (99designs/keyring) with the File JWT backend (for portability)
+- Stores chains in a versioned vault file using Argon2id and XChaCha20-Poly1305,
+  chains written with the 99designs/keyring File JWT backend are read until
+  converted with "chain vault upgrade"
 - Requires min password length
 - Offers to generate large secure passwords using "chain password"
 - Never stores env values unencrypted on disk
+- Never writes secret values to logs, including at CHAIN_LOG_LEVEL=debug
+- Disables core dumps and ptrace, keeps decrypted values in locked memory
+  and zeroes it before exiting
 `,
 }
 
 func Execute() {
 	err := RootCmd.Execute()
+	wipeSecrets()
 	if err != nil {
 		os.Exit(1)
 	}
@@ -68,6 +92,20 @@ var PasswordValidationLength = "password_validation_length"
 var KeychainBackend = "keychain_backend"
 var StoreBackendTypeName = "store"
 var LogLevelName = "log_level"
+var SSHIdentityKey = "ssh_identity"
+var IdentityFileKey = "identity_file"
+var OTPWarnThresholdKey = "otp_warn_threshold"
+var OTPReplenishKey = "otp_replenish"
+var LockTimeoutKey = "lock_timeout"
+var SyncRemoteKey = "sync_remote"
+var SyncBranchKey = "sync_branch"
+var NewPasswordKey = "new_password"
+var PasswordFDKey = "password_fd"
+var PasswordCommandKey = "password_command"
+var PinentryKey = "pinentry"
+var VaultKDFTimeKey = "vault_kdf_time"
+var VaultKDFMemoryKey = "vault_kdf_memory"
+var VaultKDFThreadsKey = "vault_kdf_threads"
 
 func init() {
 	viper.SetEnvPrefix(ConfigPrefix)
@@ -75,10 +113,15 @@ func init() {
 	viper.SetDefault(LogLevelName, "info")
 	viper.SetDefault(KeyringServiceKey, ConfigPrefix)
 	viper.SetDefault(KeyringUserKey, ConfigPrefix)
-	viper.SetDefault(ChainDirKey, "."+ConfigPrefix)
 	viper.SetDefault(PasswordValidationLength, 20)
 	viper.SetDefault(PasswordValidationLength, 20)
 	viper.SetDefault(StoreBackendTypeName, 1)
+	viper.SetDefault(OTPWarnThresholdKey, 3)
+	viper.SetDefault(LockTimeoutKey, "10s")
+	viper.SetDefault(SyncBranchKey, "main")
+	viper.SetDefault(VaultKDFTimeKey, 3)
+	viper.SetDefault(VaultKDFMemoryKey, 64)
+	viper.SetDefault(VaultKDFThreadsKey, 4)
 
 	viper.BindEnv(LogLevelName)
 	viper.BindEnv(KeyringServiceKey)
@@ -87,11 +130,28 @@ func init() {
 	viper.BindEnv(KeyringPassword)
 	viper.BindEnv(PasswordValidationLength)
 	viper.BindEnv(StoreBackendTypeName)
+	viper.BindEnv(SSHIdentityKey)
+	viper.BindEnv(IdentityFileKey)
+	viper.BindEnv(OTPWarnThresholdKey)
+	viper.BindEnv(OTPReplenishKey)
+	viper.BindEnv(LockTimeoutKey)
+	viper.BindEnv(SyncRemoteKey)
+	viper.BindEnv(SyncBranchKey)
+	viper.BindEnv(NewPasswordKey)
+	viper.BindEnv(PasswordFDKey)
+	viper.BindEnv(PasswordCommandKey)
+	viper.BindEnv(PinentryKey)
+	viper.BindEnv(VaultKDFTimeKey)
+	viper.BindEnv(VaultKDFMemoryKey)
+	viper.BindEnv(VaultKDFThreadsKey)
+	RootCmd.PersistentFlags().StringP("identity", "i", "", "age identity file used to decrypt AGE chains, overrides CHAIN_IDENTITY_FILE")
+	viper.BindPFlag(IdentityFileKey, RootCmd.PersistentFlags().Lookup("identity"))
 
 	zerolog.TimestampFieldName = "t"
 	zerolog.LevelFieldName = "l"
 	zerolog.MessageFieldName = "m"
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	logSink.out = zerolog.ConsoleWriter{Out: os.Stderr}
+	log.Logger = log.Output(logSink)
 	var logLevel, err = zerolog.ParseLevel(viper.GetString(LogLevelName))
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to parse log level")
@@ -99,6 +159,7 @@ func init() {
 
 	zerolog.SetGlobalLevel(logLevel)
 	zerolog.TimeFieldFormat = time.RFC3339
+	hardenProcess()
 
 	localPath, err := filepath.Abs("./." + ConfigPrefix)
 	if err != nil {
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+// Values needing rotation
+//
+// When a member is removed from a chain they may have kept copies of every
+// value they could decrypt. rotationFile records those keys along with the
+// members who could read them until the value is set again.
+
+var rotationFile = ".ROTATE"
+
+type rotationEntry struct {
+	Member  string    `json:"member"`
+	Removed time.Time `json:"removed"`
+}
+
+type rotationFlags map[string][]rotationEntry
+
+func loadRotationFlags(dir string) (rotationFlags, error) {
+	flags := rotationFlags{}
+	b, err := os.ReadFile(filepath.Join(dir, rotationFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return flags, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &flags); err != nil {
+		return nil, eris.Wrapf(err, "Unable to parse %s", rotationFile)
+	}
+	return flags, nil
+}
+
+// Save writes the flags, removing rotationFile once nothing needs rotating
+func (f rotationFlags) Save(dir string) error {
+	if len(f) == 0 {
+		err := os.Remove(filepath.Join(dir, rotationFile))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, rotationFile), b, secureFSPerm)
+}
+
+// Flag records that member could read the values of keys
+func (f rotationFlags) Flag(keys []string, member string, removed time.Time) {
+	for _, k := range keys {
+		f[k] = append(f[k], rotationEntry{Member: member, Removed: removed})
+	}
+}
+
+// Members returns who could read the value of key, if anyone
+func (f rotationFlags) Members(key string) []string {
+	var members []string
+	for _, e := range f[key] {
+		members = append(members, e.Member)
+	}
+	return members
+}
+
+func (f rotationFlags) Keys() []string {
+	var keys []string
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Merge adds the flags recorded in another copy of the chain
+func (f rotationFlags) Merge(other rotationFlags) {
+	for k, entries := range other {
+		for _, e := range entries {
+			if !f.has(k, e) {
+				f[k] = append(f[k], e)
+			}
+		}
+	}
+}
+
+func (f rotationFlags) has(key string, entry rotationEntry) bool {
+	for _, e := range f[key] {
+		if e.Member == entry.Member && e.Removed.Equal(entry.Removed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClearIfSetAfter drops the flags of key when its value was set after
+// every flagged member was removed
+func (f rotationFlags) ClearIfSetAfter(key string, modified time.Time) {
+	for _, e := range f[key] {
+		if !modified.After(e.Removed) {
+			return
+		}
+	}
+	delete(f, key)
+}
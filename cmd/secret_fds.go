@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/rotisserie/eris"
+)
+
+// secretFDs holds values passed to a command over inherited file
+// descriptors rather than its environment, which the same user can read
+// from /proc/<pid>/environ and every process the command starts inherits.
+//
+// Values read by descriptor number are sent over a pipe, so they can
+// only be read once and nothing is left for processes the command starts.
+// Values read by /dev/fd path are sent in a sealed memfd on Linux, which
+// tools can open, seek and re-read like a file, and over a pipe elsewhere.
+type secretFDs struct {
+	// files become descriptors 3, 4, ... in the command
+	files   []*os.File
+	stdin   *os.File
+	writers sync.WaitGroup
+}
+
+// firstInheritedFD is the descriptor of the first of exec.Cmd.ExtraFiles
+const firstInheritedFD = 3
+
+// AddFD passes value on a pipe, returning its descriptor in the command
+func (s *secretFDs) AddFD(value []byte) (int, error) {
+	f, err := s.pipe(value)
+	if err != nil {
+		return 0, err
+	}
+	return s.inherit(f)
+}
+
+// AddPath passes value on a descriptor, returning its /dev/fd path in the
+// command
+func (s *secretFDs) AddPath(name string, value []byte) (string, error) {
+	f, err := secretMemfd(name, value)
+	if err != nil {
+		return "", err
+	}
+	if f == nil {
+		if f, err = s.pipe(value); err != nil {
+			return "", err
+		}
+	}
+	fd, err := s.inherit(f)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("/dev/fd/%d", fd), nil
+}
+
+// SetStdin passes value as the command's stdin
+func (s *secretFDs) SetStdin(value []byte) error {
+	f, err := s.pipe(value)
+	if err != nil {
+		return err
+	}
+	s.stdin = f
+	return nil
+}
+
+func (s *secretFDs) inherit(f *os.File) (int, error) {
+	if !canInheritFDs {
+		f.Close()
+		return 0, eris.New("passing values on file descriptors is not supported on this platform, use --stdin, --file or --path")
+	}
+	s.files = append(s.files, f)
+	return firstInheritedFD + len(s.files) - 1, nil
+}
+
+// pipe returns the read end of a pipe which value is written to, writes
+// larger than the pipe's buffer finish as the command reads them
+func (s *secretFDs) pipe(value []byte) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, eris.Wrap(err, "Unable to create pipe for secret")
+	}
+	s.writers.Add(1)
+	go func() {
+		defer s.writers.Done()
+		defer w.Close()
+		// A command which exits without reading is not an error
+		_, _ = w.Write(value)
+	}()
+	return r, nil
+}
+
+// Release closes chain's copies of the descriptors, once the command has
+// its own or failed to start, and waits for the values to be written,
+// after which they are no longer needed
+func (s *secretFDs) Release() {
+	for _, f := range s.files {
+		f.Close()
+	}
+	if s.stdin != nil {
+		s.stdin.Close()
+	}
+	s.writers.Wait()
+}
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rotisserie/eris"
+	"github.com/rs/zerolog/log"
+)
+
+var secretFilesDirPrefix = "exec-"
+
+// secretFiles holds values written to disk for commands that
+// expect a file path rather than the value itself.
+//
+// Files are written to a per-process directory inside a private (0700)
+// directory on memory backed storage so values never reach a disk.
+type secretFiles struct {
+	dir string
+}
+
+func newSecretFiles() (*secretFiles, error) {
+	base, err := secretFilesBaseDir()
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(base, fmt.Sprintf("%s%d", secretFilesDirPrefix, os.Getpid()))
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return nil, eris.Wrap(err, "Unable to clear directory for secret files")
+	}
+	err = os.Mkdir(dir, 0700)
+	if err != nil {
+		return nil, eris.Wrap(err, "Unable to create directory for secret files")
+	}
+
+	return &secretFiles{dir: dir}, nil
+}
+
+// secretFilesBaseDir returns a directory owned by and only accessible to
+// the current user, preferring tmpfs locations
+func secretFilesBaseDir() (string, error) {
+	var candidates []string
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		candidates = append(candidates, filepath.Join(runtimeDir, ConfigPrefix))
+	}
+	if info, err := os.Stat("/dev/shm"); err == nil && info.IsDir() {
+		candidates = append(candidates, filepath.Join("/dev/shm", fmt.Sprintf("%s-%d", ConfigPrefix, os.Getuid())))
+	}
+	candidates = append(candidates, filepath.Join(os.TempDir(), fmt.Sprintf("%s-%d", ConfigPrefix, os.Getuid())))
+
+	var lastErr error
+	for _, dir := range candidates {
+		err := os.Mkdir(dir, 0700)
+		if err != nil && !os.IsExist(err) {
+			lastErr = err
+			continue
+		}
+
+		// Refuse directories that someone else could have created or opened up
+		info, err := os.Lstat(dir)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if !info.IsDir() || !isPrivateDir(info) {
+			lastErr = eris.Errorf("directory is not private to the current user: %s", dir)
+			continue
+		}
+		return dir, nil
+	}
+
+	return "", eris.Wrap(lastErr, "Unable to find a private directory for secret files")
+}
+
+// removeStaleSecretFiles deletes directories left behind by earlier
+// invocations which exited without cleaning up, eg from a crash or SIGKILL
+func removeStaleSecretFiles() {
+	base, err := secretFilesBaseDir()
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to check for stale secret files")
+		return
+	}
+
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		log.Warn().Err(err).Str("dir", base).Msg("Unable to check for stale secret files")
+		return
+	}
+
+	for _, e := range entries {
+		pid, err := strconv.Atoi(strings.TrimPrefix(e.Name(), secretFilesDirPrefix))
+		if !strings.HasPrefix(e.Name(), secretFilesDirPrefix) || err != nil {
+			continue
+		}
+		if pid == os.Getpid() || processAlive(pid) {
+			continue
+		}
+
+		stale := filepath.Join(base, e.Name())
+		log.Debug().Str("dir", stale).Msg("Removing stale secret files")
+		err = os.RemoveAll(stale)
+		if err != nil {
+			log.Warn().Err(err).Str("dir", stale).Msg("Unable to remove stale secret files")
+		}
+	}
+}
+
+func (f *secretFiles) Write(key string, data []byte) (string, error) {
+	if err := validateKeyPath(key); err != nil {
+		return "", err
+	}
+
+	p := filepath.Join(f.dir, key)
+	err := os.WriteFile(p, data, secureFSPerm)
+	if err != nil {
+		return "", eris.Wrapf(err, "Unable to write secret file for key: %+v", key)
+	}
+	return p, nil
+}
+
+func (f *secretFiles) Remove() {
+	err := os.RemoveAll(f.dir)
+	if err != nil {
+		log.Warn().Err(err).Str("dir", f.dir).Msg("Unable to remove secret files")
+	}
+}
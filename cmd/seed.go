@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/rotisserie/eris"
+	"github.com/tyler-smith/go-bip39"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Deterministic one-time keys
+//
+// Instead of storing N separate private keys the one-time X25519 identities
+// of an age-otp-store chain can be derived from a single 256 bit seed and
+// an index. The seed is shown once as a 24 word BIP39 mnemonic for paper
+// backup and only the derived public keys are stored in the chain.
+//
+//	scalar(index) = HKDF-SHA256(seed, salt=seedDerivationSalt, info=index as uint32 big endian)
+
+var seedDerivationSalt = []byte("chain-otp-seed/v1")
+
+var ErrInvalidMnemonic = errors.New("invalid mnemonic")
+
+func newSeed() ([]byte, error) {
+	seed := secretAlloc(32)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, eris.Wrap(err, "Unable to generate seed")
+	}
+	return seed, nil
+}
+
+func seedToMnemonic(seed []byte) (string, error) {
+	return bip39.NewMnemonic(seed)
+}
+
+// mnemonicToSeed recovers the seed from its mnemonic. The BIP39 checksum
+// catches most typos in the words.
+func mnemonicToSeed(mnemonic string) ([]byte, error) {
+	entropy, err := bip39.EntropyFromMnemonic(normalizeMnemonic(mnemonic))
+	if err != nil {
+		return nil, eris.Wrap(ErrInvalidMnemonic, err.Error())
+	}
+	defer wipe(entropy)
+	return secretCopy(entropy), nil
+}
+
+func normalizeMnemonic(mnemonic string) string {
+	return strings.Join(strings.Fields(strings.ToLower(mnemonic)), " ")
+}
+
+// looksLikeMnemonic reports whether input is a list of words rather than
+// a key or passphrase, BIP39 mnemonics have 12 to 24 words
+func looksLikeMnemonic(input string) bool {
+	words := strings.Fields(input)
+	return len(words) >= 12 && len(words) <= 24 && bip39.IsMnemonicValid(normalizeMnemonic(input))
+}
+
+// deriveIdentity derives the one-time identity at index from seed
+func deriveIdentity(seed []byte, index uint32) (*age.X25519Identity, error) {
+	info := make([]byte, 4)
+	binary.BigEndian.PutUint32(info, index)
+
+	scalar := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, seed, seedDerivationSalt, info), scalar); err != nil {
+		return nil, err
+	}
+
+	// age only parses identities from their Bech32 encoding
+	encoded, err := bech32Encode("AGE-SECRET-KEY-", scalar)
+	if err != nil {
+		return nil, err
+	}
+	return age.ParseX25519Identity(strings.ToUpper(encoded))
+}
+
+// addSeedRecipients registers count keys derived from seed, continuing from
+// the registry's next index
+func addSeedRecipients(registry *recipientRegistry, seed []byte, count int, label string) error {
+	next := registry.NextSeedIndex()
+	for i := uint32(0); i < uint32(count); i++ {
+		index := next + i
+		identity, err := deriveIdentity(seed, index)
+		if err != nil {
+			return err
+		}
+		e, err := registry.Add(identity.Recipient().String(), fmt.Sprintf("%s-%d", label, index+1))
+		if err != nil {
+			return err
+		}
+		e.Index = &index
+	}
+	return nil
+}
+
+// seedIdentities derives the identities of the registry's active seed keys,
+// lowest index first so that is the one-time key which gets used
+func seedIdentities(registry *recipientRegistry, seed []byte) ([]age.Identity, error) {
+	var identities []age.Identity
+	for _, index := range registry.SeedIndexes() {
+		identity, err := deriveIdentity(seed, index)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	if len(identities) == 0 {
+		return nil, eris.New("chain has no unused keys derived from a seed")
+	}
+	return identities, nil
+}
+
+// bech32Encode encodes data as BIP173 Bech32 with the human readable part hrp
+func bech32Encode(hrp string, data []byte) (string, error) {
+	const charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+	hrp = strings.ToLower(hrp)
+	values, err := convertBits(data, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+
+	polymodValues := make([]byte, 0, len(hrp)*2+1+len(values)+6)
+	for i := 0; i < len(hrp); i++ {
+		polymodValues = append(polymodValues, hrp[i]>>5)
+	}
+	polymodValues = append(polymodValues, 0)
+	for i := 0; i < len(hrp); i++ {
+		polymodValues = append(polymodValues, hrp[i]&31)
+	}
+	polymodValues = append(polymodValues, values...)
+	polymodValues = append(polymodValues, 0, 0, 0, 0, 0, 0)
+	mod := bech32Polymod(polymodValues) ^ 1
+
+	var b strings.Builder
+	b.WriteString(hrp)
+	b.WriteByte('1')
+	for _, v := range values {
+		b.WriteByte(charset[v])
+	}
+	for i := 0; i < 6; i++ {
+		b.WriteByte(charset[(mod>>uint(5*(5-i)))&31])
+	}
+	return b.String(), nil
+}
+
+func bech32Polymod(values []byte) uint32 {
+	generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+func convertBits(data []byte, fromBits, toBits uint8, pad bool) ([]byte, error) {
+	var acc uint32
+	var bits uint8
+	var out []byte
+	maxv := uint32(1)<<toBits - 1
+	for _, b := range data {
+		acc = acc<<fromBits | uint32(b)
+		bits += fromBits
+		for bits >= toBits {
+			bits -= toBits
+			out = append(out, byte(acc>>bits&maxv))
+		}
+	}
+	if pad && bits > 0 {
+		out = append(out, byte(acc<<(toBits-bits)&maxv))
+	} else if !pad && (bits >= fromBits || acc<<(toBits-bits)&maxv != 0) {
+		return nil, eris.New("invalid padding")
+	}
+	return out, nil
+}
@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/curve25519"
+)
+
+// The BIP39 test vector for 256 bits of zero entropy
+var zeroSeedMnemonic = strings.Repeat("abandon ", 23) + "art"
+
+// Recipients derived from the zero seed, changing these breaks every chain
+// whose keys were derived from a seed
+var zeroSeedRecipients = []string{
+	"age1yvwhq3q7yk0jnprpcn20skgv8l2pkfxl7tcw288nxx6vm7g6qy8q3xxwt3",
+	"age1u6dasxq70rmd2xc3aht52vm687zayrgxjq9az3mvduyj9vraqfuq48wx4e",
+}
+
+func TestMnemonicRoundTrip(t *testing.T) {
+	seed := make([]byte, 32)
+	mnemonic, err := seedToMnemonic(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mnemonic != zeroSeedMnemonic {
+		t.Fatalf("mnemonic of zero seed is %q, want %q", mnemonic, zeroSeedMnemonic)
+	}
+
+	// Case and whitespace are normalized
+	recovered, err := mnemonicToSeed("  " + strings.ToUpper(strings.ReplaceAll(zeroSeedMnemonic, " ", "\n ")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(recovered, seed) {
+		t.Fatalf("recovered seed %x, want %x", recovered, seed)
+	}
+	if !looksLikeMnemonic(zeroSeedMnemonic) {
+		t.Error("mnemonic not recognized")
+	}
+
+	// A changed word fails the checksum
+	typo := strings.Replace(zeroSeedMnemonic, "art", "abandon", 1)
+	if _, err := mnemonicToSeed(typo); !errors.Is(err, ErrInvalidMnemonic) {
+		t.Errorf("mnemonic with a typo returned %v, want ErrInvalidMnemonic", err)
+	}
+	if looksLikeMnemonic(typo) {
+		t.Error("mnemonic with a typo recognized")
+	}
+}
+
+func TestDeriveIdentityKnownAnswers(t *testing.T) {
+	seed, err := mnemonicToSeed(zeroSeedMnemonic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range zeroSeedRecipients {
+		identity, err := deriveIdentity(seed, uint32(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := identity.Recipient().String(); got != want {
+			t.Errorf("index %d derived %s, want %s", i, got, want)
+		}
+
+		// age parses its own encoding of the identity back to the same key
+		parsed, err := age.ParseX25519Identity(identity.String())
+		if err != nil {
+			t.Fatalf("age can't parse derived identity: %v", err)
+		}
+		if parsed.Recipient().String() != want {
+			t.Errorf("index %d parsed as %s, want %s", i, parsed.Recipient(), want)
+		}
+	}
+}
+
+// TestDeriveIdentityMatchesAge checks the Bech32 encoding of derived keys
+// against the public key age computes from them
+func TestDeriveIdentityMatchesAge(t *testing.T) {
+	seed := bytes.Repeat([]byte{0xa5}, 32)
+	for index := uint32(0); index < 64; index++ {
+		identity, err := deriveIdentity(seed, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		scalar, err := decodeIdentityScalar(identity.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		public, err := curve25519.X25519(scalar, curve25519.Basepoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := bech32Encode("age", public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoded != identity.Recipient().String() {
+			t.Fatalf("index %d encodes public key as %s, age computed %s", index, encoded, identity.Recipient())
+		}
+	}
+}
+
+// decodeIdentityScalar reverses the Bech32 encoding of an age identity
+func decodeIdentityScalar(identity string) ([]byte, error) {
+	return convertBits(decodeBech32Data(strings.ToLower(identity)), 5, 8, false)
+}
+
+// BIP173 test vectors with valid checksums
+func TestBech32Encode(t *testing.T) {
+	for _, want := range []string{
+		"a12uel5l",
+		"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw",
+		"split1checkupstagehandshakeupstreamerranterredcaperred2y9e3w",
+	} {
+		data, err := convertBits(decodeBech32Data(want), 5, 8, false)
+		if err != nil {
+			t.Fatalf("%s: %v", want, err)
+		}
+		hrp := want[:strings.LastIndexByte(want, '1')]
+		got, err := bech32Encode(hrp, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("encoded %s, want %s", got, want)
+		}
+	}
+}
+
+// decodeBech32Data returns the 5 bit values of a lower case Bech32 string,
+// without checking its checksum
+func decodeBech32Data(s string) []byte {
+	const charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+	data := s[strings.LastIndexByte(s, '1')+1 : len(s)-6]
+	values := make([]byte, len(data))
+	for i := range data {
+		values[i] = byte(strings.IndexByte(charset, data[i]))
+	}
+	return values
+}
+
+func TestConvertBitsRejectsBadPadding(t *testing.T) {
+	// 8 bits of 5 bit groups leave 2 bits which must be zero
+	if _, err := convertBits([]byte{31, 31}, 5, 8, false); err == nil {
+		t.Error("non-zero padding accepted")
+	}
+	if _, err := convertBits([]byte{31, 28}, 5, 8, false); err != nil {
+		t.Errorf("zero padding rejected: %v", err)
+	}
+}
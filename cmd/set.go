@@ -4,11 +4,9 @@ Copyright © 2022 Zander Hill <zander@xargs.io>
 package cmd
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"os"
-	"strings"
 
 	"github.com/rs/zerolog/log"
 
@@ -19,7 +17,7 @@ import (
 
 // setCmd represents the set command
 var setCmd = &cobra.Command{
-	Use:   "set [keychain]",
+	Use:   "set [keychain] [key]",
 	Short: "Set a key in keychain",
 	Long: `chain set:
 	Set a value in the keychain
@@ -29,30 +27,68 @@ var setCmd = &cobra.Command{
 	$> EXAMPLE_KEY="example-value"
 	$> <enter on empty line to save>
 
-	Via pipeline
+	Via pipeline, input is parsed as a dotenv file supporting comments,
+	"export " prefixes, single and double quotes and multiline quoted values
 	$ echo EXAMPLE_KEY="example-value" | chain set keychain-name
+	$ chain set keychain-name < .env
+
+	Prompts, eg for the password, are read from the terminal rather than
+	stdin so they work while values are piped in
+
+	Multiline or binary values (PEM keys, JSON credentials, kubeconfigs)
+	are stored verbatim for a single key
+	$ chain set keychain-name GCP_CREDENTIALS --file service-account.json
+	$ cat tls.key | chain set keychain-name TLS_KEY --stdin-value
+
+	With AGE backends a key can be scoped to a recipient group so that only
+	the members in that group can read it, see chain members add --group
+	$ chain set prod PAGERDUTY_TOKEN --stdin-value --group oncall
+
+	Keys must be valid environment variable names ([A-Za-z_][A-Za-z0-9_]*),
+	use --raw-keys to allow other names. Keys may never contain path
+	separators or start with '.'.
 	`,
-	Args: cobra.MinimumNArgs(1),
+	Args:    cobra.RangeArgs(1, 2),
+	PreRun:  lockChainPreRun(exclusiveLock),
+	PostRun: unlockChainPostRun,
 	Run: func(cmd *cobra.Command, args []string) {
 		chain := args[0]
 
-		err := set(cmd, chain)
+		var err error
+		if len(args) == 2 {
+			err = setRawValue(cmd, chain, args[1])
+		} else {
+			err = set(cmd, chain)
+		}
 		if err != nil {
 			log.Fatal().Msgf(eris.ToString(err, true))
 		}
 	},
 }
 
+var setValueFile string
+var setStdinValue bool
+var setRawKeys bool
+var setGroup string
+
 func init() {
+	setCmd.Flags().BoolVar(&setRawKeys, "raw-keys", false, "allow keys which are not valid environment variable names")
+	setCmd.Flags().StringVar(&setValueFile, "file", "", "read the raw value for [key] from this file")
+	setCmd.Flags().BoolVar(&setStdinValue, "stdin-value", false, "read the raw value for [key] from stdin")
+	setCmd.Flags().StringVar(&setGroup, "group", "", "with AGE backends, only encrypt the values to members of this recipient group")
 	RootCmd.AddCommand(setCmd)
 }
 
 func set(cmd *cobra.Command, chain string) error {
-	ring, err := NewStore(chain)
-	log.Debug().Str("store_type", ring.Name()).Msg("")
+	if setValueFile != "" || setStdinValue {
+		return eris.New("--file and --stdin-value require a [key] argument")
+	}
+
+	ring, err := newSetStore(chain)
 	if err != nil {
-		return eris.Wrapf(err, "Unable to open keyring for chain: %+v", chain)
+		return err
 	}
+	log.Debug().Str("store_type", ring.Name()).Msg("")
 
 	if isInteractive() {
 		return processInteractiveEntry(ring)
@@ -61,48 +97,93 @@ func set(cmd *cobra.Command, chain string) error {
 	}
 }
 
+// setRawValue stores the unmodified bytes of a file or of stdin under key,
+// which allows values containing newlines or arbitrary binary data
+func setRawValue(cmd *cobra.Command, chain string, key string) error {
+	if (setValueFile != "") == setStdinValue {
+		return eris.New("setting a single key requires exactly one of --file or --stdin-value")
+	}
+
+	key, err := normalizeKey(key, setRawKeys)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	if setStdinValue {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(setValueFile)
+	}
+	if err != nil {
+		return eris.Wrapf(err, "Unable to read value for key: %+v", key)
+	}
+	registerSecret(data)
+	log.Debug().Str("key", key).Stringer("value", Secret(data)).Msg("Read value")
+
+	ring, err := newSetStore(chain)
+	if err != nil {
+		return err
+	}
+
+	err = ring.Set(keyring.Item{
+		Key:  key,
+		Data: data,
+	})
+	if err != nil {
+		return eris.Wrapf(err, "Unable to set key: %+v", key)
+	}
+
+	fmt.Printf("Value(s) saved: %d\n", 1)
+	return nil
+}
+
 func isInteractive() bool {
 	info, _ := os.Stdin.Stat()
 	return (info.Mode() & os.ModeCharDevice) == os.ModeCharDevice
 }
 
+// processStdinEntry reads dotenv formatted input from stdin, see parseDotenv.
+// The whole input is parsed before any value is saved so that a syntax
+// error does not leave the chain partially updated.
 func processStdinEntry(ring Store) error {
-	br := bufio.NewReader(os.Stdin)
-
-	lineCount := 0
-
-	for {
-		line, err := br.ReadString('\n')
-		if (err != nil) && (err != io.EOF) {
-			break
+	entries, err := parseDotenv(os.Stdin)
+	if err != nil {
+		return eris.Wrap(err, "Unable to parse input as dotenv")
+	}
+	for i, e := range entries {
+		registerSecret([]byte(e.Value))
+		entries[i].Key, err = normalizeKey(e.Key, setRawKeys)
+		if err != nil {
+			return eris.Wrapf(err, "Invalid key on line %d", e.Line)
 		}
+		log.Debug().Int("line", e.Line).Str("key", entries[i].Key).Stringer("value", Secret(e.Value)).Msg("Parsed entry")
+	}
 
-		line = strings.TrimRight(line, "\n")
-
-		log.Debug().Str("line", line).Msg("Line")
-
-		if len(line) == 0 {
-			break
+	if batch, ok := ring.(batchSetter); ok {
+		items := make([]keyring.Item, len(entries))
+		for i, e := range entries {
+			items[i] = keyring.Item{Key: e.Key, Data: []byte(e.Value)}
 		}
-
-		lineCount += 1
-
-		key, val, found := strings.Cut(line, "=")
-		if !found {
-			log.Fatal().Msg("Input format must be NAME=VALUE")
+		if err := batch.SetItems(items); err != nil {
+			return eris.Wrap(err, "Unable to set keys, no values were saved")
 		}
+		fmt.Printf("Value(s) saved: %d\n", len(entries))
+		return nil
+	}
 
+	for _, e := range entries {
 		err = ring.Set(keyring.Item{
-			Key:  key,
-			Data: []byte(val),
+			Key:  e.Key,
+			Data: []byte(e.Value),
 		})
 
 		if err != nil {
-			log.Fatal().Msgf("Unable to set key: %+v +%v", key, err)
+			return eris.Wrapf(err, "Unable to set key from line %d: %+v", e.Line, e.Key)
 		}
 	}
 
-	fmt.Printf("Value(s) saved: %d\n", lineCount)
+	fmt.Printf("Value(s) saved: %d\n", len(entries))
 	return nil
 }
 
@@ -119,10 +200,17 @@ func processInteractiveEntry(ring Store) error {
 			break
 		}
 
+		key, err = normalizeKey(key, setRawKeys)
+		if err != nil {
+			log.Warn().Msg(err.Error())
+			continue
+		}
+
 		value, err := promptForPassword("VALUE > ")
 		if err != nil {
 			return err
 		}
+		registerSecret([]byte(value))
 
 		lineCount += 1
 
@@ -139,3 +227,47 @@ func processInteractiveEntry(ring Store) error {
 	fmt.Printf("Value(s) saved: %d\n", lineCount)
 	return nil
 }
+
+// batchSetter is implemented by stores which can save several items in a
+// single transaction
+type batchSetter interface {
+	Store
+	SetItems(items []keyring.Item) error
+}
+
+// groupSetter is implemented by stores which can scope items to a recipient group
+type groupSetter interface {
+	Store
+	SetInGroup(item keyring.Item, group string) error
+}
+
+// groupStore sets every item in group
+type groupStore struct {
+	groupSetter
+	group string
+}
+
+func (s groupStore) Set(item keyring.Item) error {
+	return s.SetInGroup(item, s.group)
+}
+
+// newSetStore opens the chain's store, setting items in the --group
+// recipient group when one is given
+func newSetStore(chain string) (Store, error) {
+	ring, err := NewStore(chain)
+	if err != nil {
+		return nil, eris.Wrapf(err, "Unable to open keyring for chain: %+v", chain)
+	}
+	if setGroup == "" {
+		return ring, nil
+	}
+
+	setter, ok := ring.(groupSetter)
+	if !ok {
+		return nil, eris.Errorf("--group is only supported for AGE backends, not %s", ring.Name())
+	}
+	if err := validateGroup(setGroup); err != nil {
+		return nil, err
+	}
+	return groupStore{groupSetter: setter, group: setGroup}, nil
+}
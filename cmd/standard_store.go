@@ -1,21 +1,49 @@
 package cmd
 
 import (
+	"os"
+	"path/filepath"
+
 	"github.com/99designs/keyring"
+	"github.com/rs/zerolog/log"
 	chainv1 "github.com/zph/chain/gen/go/chain/v1"
 )
 
+// NewStandardStore opens the chain's vault, see vault.go. Chains which were
+// written with the keyring file backend are opened with it until they are
+// converted with chain vault upgrade.
 func NewStandardStore(chain string) (Store, error) {
-	s := StandardStore{}
+	if vaultExists(chain) {
+		return newVaultStore(chain), nil
+	}
+
+	legacy, err := newLegacyStandardStore(chain)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := legacy.Keys()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return newVaultStore(chain), nil
+	}
+	log.Warn().Str("chain", chain).Msg("Chain uses the keyring file format, convert it with chain vault upgrade")
+	return legacy, nil
+}
+
+// newLegacyStandardStore opens a chain written with the keyring file backend
+func newLegacyStandardStore(chain string) (StandardStore, error) {
+	s := StandardStore{chain: chain, dir: filePath(chain)}
 	// https://pkg.go.dev/github.com/99designs/keyring#BackendType
 	k, err := keyring.Open(keyring.Config{
 		AllowedBackends:  []keyring.BackendType{keyring.FileBackend},
 		ServiceName:      chain,
-		FilePasswordFunc: getPassword,
-		FileDir:          filePath(chain),
+		FilePasswordFunc: chainPasswordFunc(chain),
+		FileDir:          s.dir,
 	})
 	if err != nil {
-		return nil, err
+		return s, err
 	}
 
 	s.Keyring = k
@@ -24,9 +52,39 @@ func NewStandardStore(chain string) (Store, error) {
 
 type StandardStore struct {
 	keyring.Keyring
+	chain string
+	dir   string
+}
+
+// Keys skips the chain's lock file and directories which hold namespaced
+// chains, eg "team/aws" within the directory of chain "team"
+func (s StandardStore) Keys() ([]string, error) {
+	keys, err := s.Keyring.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	var output []string
+	for _, k := range keys {
+		if k == lockFile || k == vaultFile {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(s.dir, k)); err == nil && info.IsDir() {
+			continue
+		}
+		output = append(output, k)
+	}
+	return output, nil
 }
 
 func (s StandardStore) Name() string {
 	return chainv1.StorageType_STORAGE_TYPE_STANDARD_STORE.String()
 }
 func (s StandardStore) PostRunHook() error { return nil }
+
+// ChangePassword moves the chain into a vault encrypted with the new
+// password, see moveToVault
+func (s StandardStore) ChangePassword(newPassword func() (string, error)) error {
+	_, _, err := s.moveToVault(newPassword)
+	return err
+}
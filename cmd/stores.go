@@ -26,6 +26,10 @@ type Store interface {
 }
 
 func NewStore(chain string) (Store, error) {
+	if err := validateChainName(chain); err != nil {
+		return nil, err
+	}
+
 	storeType := viper.GetInt32(StoreBackendTypeName)
 	name := chainv1.StorageType_name[storeType]
 	log.Debug().Int32("store_type", storeType).Str("store_options", name).Msg("")
@@ -40,6 +44,8 @@ func NewStore(chain string) (Store, error) {
 		return NewAgeStore(chain)
 	case chainv1.StorageType_STORAGE_TYPE_AGE_OTP_STORE.String():
 		return NewAgeOTPStore(chain)
+	case chainv1.StorageType_STORAGE_TYPE_BOLT_STORE.String():
+		return NewBoltStore(chain)
 	}
 	return nil, eris.New("Store type unfound, choose from chainv1.StorageType enum")
 }
@@ -0,0 +1,258 @@
+/*
+Copyright © 2022 Zander Hill <zander@xargs.io>
+*/
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/rotisserie/eris"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	chainv1 "github.com/zph/chain/gen/go/chain/v1"
+)
+
+// syncCmd represents the sync command
+var syncCmd = &cobra.Command{
+	Use:   "sync [keychain]",
+	Short: "Push and pull an AGE chain with a git remote",
+	Long: `
+	Push and pull an AGE chain with a git remote
+
+	The chain is stored in the remote repository under its name, so one
+	repository can hold many chains. The remote is configured with
+	CHAIN_SYNC_REMOTE or --remote and can be any git url, including a
+	local bare repository.
+
+	Values set on both machines keep the most recently set value and
+	one-time keys expired on either machine stay expired.
+
+	eg:
+	git init --bare ~/chains.git
+	CHAIN_SYNC_REMOTE=~/chains.git chain sync aws-creds
+`,
+	Args:    cobra.ExactArgs(1),
+	PreRun:  lockChainPreRun(exclusiveLock),
+	PostRun: unlockChainPostRun,
+	Run: func(cmd *cobra.Command, args []string) {
+		report, err := syncChain(args[0])
+		if err != nil {
+			log.Fatal().Msgf(eris.ToString(err, true))
+		}
+		if s := report.String(); s != "" {
+			fmt.Println(s)
+		}
+	},
+}
+
+var ErrSyncRejected = errors.New("remote changed while syncing")
+
+// syncAttempts is how many times sync retries when another machine
+// pushes between our fetch and push
+const syncAttempts = 3
+
+func init() {
+	syncCmd.Flags().String("remote", "", "git remote to sync with, overrides CHAIN_SYNC_REMOTE")
+	viper.BindPFlag(SyncRemoteKey, syncCmd.Flags().Lookup("remote"))
+	RootCmd.AddCommand(syncCmd)
+}
+
+func syncChain(chain string) (syncReport, error) {
+	var report syncReport
+	storeType := viper.GetInt(StoreBackendTypeName)
+	if storeType != int(chainv1.StorageType_STORAGE_TYPE_AGE_STORE) && storeType != int(chainv1.StorageType_STORAGE_TYPE_AGE_OTP_STORE) {
+		return report, eris.New("sync is only supported for AGE backends")
+	}
+
+	remote := viper.GetString(SyncRemoteKey)
+	if remote == "" {
+		return report, eris.New("no remote to sync with, set CHAIN_SYNC_REMOTE or use --remote")
+	}
+	branch := viper.GetString(SyncBranchKey)
+
+	workDir, err := syncWorkDir(remote)
+	if err != nil {
+		return report, err
+	}
+
+	for attempt := 1; attempt <= syncAttempts; attempt++ {
+		report, err = syncOnce(chain, remote, branch, workDir)
+		if !errors.Is(err, ErrSyncRejected) {
+			return report, err
+		}
+		log.Info().Str("chain", chain).Int("attempt", attempt).Msg("Remote changed while syncing, retrying")
+	}
+	return report, err
+}
+
+// syncOnce merges the remote copy of the chain into the local chain and
+// pushes the result, failing with ErrSyncRejected if the push races another
+func syncOnce(chain string, remote string, branch string, workDir string) (syncReport, error) {
+	if err := checkoutRemote(remote, branch, workDir); err != nil {
+		return syncReport{}, err
+	}
+
+	chainPath := filepath.FromSlash(chain)
+	remoteDir := filepath.Join(workDir, chainPath)
+	localDir := filePath(chain)
+	// A previous attempt may have merged a different remote copy
+	forgetCachedKeys(localDir)
+	forgetCachedKeys(remoteDir)
+
+	basePath := filepath.Join(workDir, ".git", "chain-sync", chainPath+".json")
+	base, err := loadSyncBase(basePath)
+	if err != nil {
+		return syncReport{}, err
+	}
+	report, err := mergeChain(chain, localDir, remoteDir, base)
+	if err != nil {
+		return report, err
+	}
+	if base, err = newSyncBase(newAgeStoreAt(chain, localDir)); err != nil {
+		return report, err
+	}
+
+	// Replace the chain's files in the work tree with the merged chain
+	entries, err := os.ReadDir(remoteDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return report, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			if err := os.Remove(filepath.Join(remoteDir, e.Name())); err != nil {
+				return report, err
+			}
+		}
+	}
+	if err := copyChainFiles(localDir, remoteDir); err != nil {
+		return report, err
+	}
+
+	if _, err := git(workDir, "add", "--all", "--", chainPath); err != nil {
+		return report, err
+	}
+	status, err := git(workDir, "status", "--porcelain", "--", chainPath)
+	if err != nil {
+		return report, err
+	}
+	if strings.TrimSpace(status) == "" {
+		return report, saveSyncState(base, basePath, remoteDir)
+	}
+
+	hostname, _ := os.Hostname()
+	commitArgs := append(gitIdentityArgs(workDir), "commit", "--quiet", "-m", fmt.Sprintf("Sync %s from %s", chain, hostname))
+	if _, err := git(workDir, commitArgs...); err != nil {
+		return report, err
+	}
+	if out, err := git(workDir, "push", "--quiet", "origin", branch); err != nil {
+		if strings.Contains(out, "rejected") || strings.Contains(out, "fetch first") {
+			return report, ErrSyncRejected
+		}
+		return report, err
+	}
+	return report, saveSyncState(base, basePath, remoteDir)
+}
+
+// saveSyncState records the chain as pushed to the remote, its values as
+// the base of the next merge and the version of its manifest as the oldest
+// the remote may have, see checkRemoteManifest
+func saveSyncState(base syncBase, basePath string, remoteDir string) error {
+	if err := base.Save(basePath); err != nil {
+		return err
+	}
+	m, err := readManifest(remoteDir)
+	if err != nil || m == nil {
+		return err
+	}
+	return writeManifestVersion(remoteDir, m.Version)
+}
+
+// syncWorkDir is the git work tree used to sync with remote,
+// $XDG_STATE_HOME/chain/sync/<hash of remote>
+func syncWorkDir(remote string) (string, error) {
+	stateDir, err := chainStateDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(remote))
+	return filepath.Join(stateDir, "sync", hex.EncodeToString(sum[:16])), nil
+}
+
+// checkoutRemote resets workDir to the remote branch, discarding anything
+// left from a previous sync. A remote without the branch starts empty.
+func checkoutRemote(remote string, branch string, workDir string) error {
+	if _, err := os.Stat(filepath.Join(workDir, ".git")); errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(workDir, 0700); err != nil {
+			return err
+		}
+		if _, err := git(workDir, "init", "--quiet"); err != nil {
+			return err
+		}
+		if _, err := git(workDir, "remote", "add", "origin", remote); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := git(workDir, "remote", "set-url", "origin", remote); err != nil {
+		return err
+	}
+	if _, err := git(workDir, "fetch", "--quiet", "--prune", "origin"); err != nil {
+		return err
+	}
+
+	ref := "refs/remotes/origin/" + branch
+	if _, err := git(workDir, "rev-parse", "--verify", "--quiet", ref); err != nil {
+		// Nothing pushed yet, start the branch from scratch
+		_, _ = git(workDir, "update-ref", "-d", "refs/heads/"+branch)
+		if _, err := git(workDir, "symbolic-ref", "HEAD", "refs/heads/"+branch); err != nil {
+			return err
+		}
+		if _, err := git(workDir, "rm", "-r", "--quiet", "--cached", "--ignore-unmatch", "."); err != nil {
+			return err
+		}
+	} else {
+		if _, err := git(workDir, "checkout", "--quiet", "-B", branch, ref); err != nil {
+			return err
+		}
+		if _, err := git(workDir, "reset", "--quiet", "--hard", ref); err != nil {
+			return err
+		}
+	}
+	_, err := git(workDir, "clean", "--quiet", "-fdx")
+	return err
+}
+
+// gitIdentityArgs sets a committer for machines without a git identity
+func gitIdentityArgs(workDir string) []string {
+	if out, err := git(workDir, "config", "user.email"); err == nil && strings.TrimSpace(out) != "" {
+		return nil
+	}
+	hostname, _ := os.Hostname()
+	return []string{"-c", "user.name=chain", "-c", "user.email=chain@" + hostname}
+}
+
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	log.Debug().Strs("args", args).Msg("Running git")
+	if err := cmd.Run(); err != nil {
+		return out.String(), eris.Wrapf(err, "git %s: %s", args[0], strings.TrimSpace(out.String()))
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,779 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+// Merging two copies of a chain
+//
+// chain sync merges the copy of a chain pulled from the remote into the
+// local chain directory before pushing the result:
+//
+//   - Each key keeps the most recently set value, using the time recorded
+//     in its envelope header. Keys are never deleted. A key is reported as
+//     a conflict when both copies changed it since the last sync.
+//   - Recipient registries are merged with mergeRecipients, so one-time keys
+//     expired on either machine stay expired. A recipient added to or
+//     removed from a group on one machine since the last sync is added or
+//     removed in the merged registry.
+//   - When the copies have different data keys, eg a member was removed on
+//     one machine, the key of the copy which changed since the last sync is
+//     kept. If both changed a new data key is generated. Values are
+//     re-encrypted with the kept key.
+//
+// The remote copy must have a manifest at least as new as the one last
+// synced with the remote, see checkRemoteManifest, as an older but validly
+// signed copy could bring back a data key removed members knew.
+
+// syncReport describes what a sync changed
+type syncReport struct {
+	Pulled    []string // keys updated from the remote
+	Conflicts []string // keys set differently on both machines
+	Rekeyed   bool
+}
+
+func (r syncReport) String() string {
+	var b strings.Builder
+	for _, k := range r.Pulled {
+		fmt.Fprintf(&b, "PULLED: %s\n", k)
+	}
+	for _, c := range r.Conflicts {
+		fmt.Fprintf(&b, "CONFLICT: %s\n", c)
+	}
+	if r.Rekeyed {
+		b.WriteString("REKEYED: the copies had different data keys, every value was re-encrypted\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// syncBase is a hash of each value of a chain as of its last sync, and
+// each recipient's groups under groupMemberKey
+type syncBase map[string]string
+
+func loadSyncBase(path string) (syncBase, error) {
+	b, err := readOptional(path)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	var base syncBase
+	if err := json.Unmarshal(b, &base); err != nil {
+		return nil, eris.Wrapf(err, "invalid sync state %s", path)
+	}
+	return base, nil
+}
+
+// newSyncBase hashes the values and data keys of the chain
+func newSyncBase(s AgeStore) (syncBase, error) {
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.groups()
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, dataKeyFile)
+	for _, group := range groups {
+		keys = append(keys, groupKeyFile(group))
+	}
+
+	base := make(syncBase)
+	for _, k := range keys {
+		b, err := readOptional(s.FilePath(k))
+		if err != nil {
+			return nil, err
+		}
+		if b != nil {
+			base[k] = hashValue(b)
+		}
+	}
+
+	registry, err := loadRecipients(s.Config.FileDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range registry.Recipients {
+		for _, g := range e.Groups {
+			base[groupMemberKey(g, e.ID)] = ""
+		}
+	}
+	return base, nil
+}
+
+// groupMemberKey is the syncBase key recording that recipient id was in
+// group, which can't clash with a value as keys can't start with '.'
+func groupMemberKey(group string, id string) string {
+	return recipientsFile + ":" + group + ":" + id
+}
+
+// inGroup reports whether recipient id was in group as of the last sync,
+// nil before the first sync
+func (base syncBase) inGroup(group string, id string) *bool {
+	if base == nil {
+		return nil
+	}
+	_, ok := base[groupMemberKey(group, id)]
+	return &ok
+}
+
+func (base syncBase) Save(path string) error {
+	b, err := json.MarshalIndent(base, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b, secureFSPerm)
+}
+
+// changed reports whether value differs from the last sync, always true
+// before the first sync
+func (base syncBase) changed(key string, value []byte) bool {
+	h, ok := base[key]
+	return !ok || h != hashValue(value)
+}
+
+// fileChanged reports whether the chain file name in s differs from the
+// last sync
+func (base syncBase) fileChanged(s AgeStore, name string) (bool, error) {
+	b, err := readOptional(s.FilePath(name))
+	if err != nil {
+		return false, err
+	}
+	return base.changed(name, b), nil
+}
+
+func hashValue(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// syncFileIgnored reports files which are local to a machine and never synced
+func syncFileIgnored(name string) bool {
+	return name == lockFile || strings.Contains(name, ".tmp-")
+}
+
+// copyChainFiles copies the files of a chain, but not its namespaced
+// child chains, from src to dst
+func copyChainFiles(src string, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || syncFileIgnored(e.Name()) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(src, e.Name()))
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(filepath.Join(dst, e.Name()), b, secureFSPerm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// optionalDataKey returns nil for chains which have no values yet
+func (s AgeStore) optionalDataKey() ([]byte, error) {
+	for _, file := range []string{dataKeyFile, passphraseKeyFile} {
+		if _, err := os.Stat(s.FilePath(file)); err == nil {
+			return s.getDataKey()
+		}
+	}
+	return nil, nil
+}
+
+// groupSyncKey is the data key a group will use after merging, nil when
+// the user is not a member and the group's key file is copied as it is
+type groupSyncKey struct {
+	key  []byte
+	from AgeStore
+}
+
+// mergeChain merges the copy of chain in remoteDir into localDir, base
+// being the chain as of its last sync
+func mergeChain(chain string, localDir string, remoteDir string, base syncBase) (syncReport, error) {
+	var report syncReport
+	if !recipientsExist(remoteDir) {
+		return report, nil
+	}
+	if err := checkRemoteManifest(remoteDir); err != nil {
+		return report, err
+	}
+	if !recipientsExist(localDir) {
+		keys, err := newAgeStoreAt(chain, remoteDir).Keys()
+		if err != nil {
+			return report, err
+		}
+		report.Pulled = keys
+		return report, copyChainFiles(remoteDir, localDir)
+	}
+
+	local := newAgeStoreAt(chain, localDir)
+	remote := newAgeStoreAt(chain, remoteDir)
+
+	localKey, err := local.optionalDataKey()
+	if err != nil {
+		return report, err
+	}
+	remoteKey, err := remote.optionalDataKey()
+	if err != nil {
+		return report, eris.Wrap(err, "remote copy of the chain")
+	}
+
+	localRegistry, err := loadRecipients(localDir)
+	if err != nil {
+		return report, err
+	}
+	remoteRegistry, err := loadRecipients(remoteDir)
+	if err != nil {
+		return report, err
+	}
+	registry := mergeRecipients(localRegistry, remoteRegistry, recipientsLegacy(localDir), recipientsLegacy(remoteDir), base)
+
+	dataKey, keyFrom := localKey, local
+	if dataKey == nil {
+		dataKey, keyFrom = remoteKey, remote
+	} else if remoteKey != nil && !bytes.Equal(localKey, remoteKey) {
+		if keyFrom, err = changedSince(base, local, remote, dataKeyFile); err != nil {
+			return report, err
+		}
+		switch keyFrom.Config.FileDir {
+		case localDir:
+		case remoteDir:
+			dataKey = remoteKey
+		default:
+			if dataKey, err = newDataKey(); err != nil {
+				return report, err
+			}
+			report.Rekeyed = true
+		}
+	}
+
+	groups, err := mergeGroupKeys(local, remote, base)
+	if err != nil {
+		return report, err
+	}
+	if err := mergeGroupMembers(local, remote, localRegistry, remoteRegistry, registry, groups); err != nil {
+		return report, err
+	}
+
+	// Pick the newest value of each key and seal everything before writing
+	sealed := make(map[string][]byte)
+	modified := make(map[string]time.Time)
+	keys, err := syncKeys(local, remote)
+	if err != nil {
+		return report, err
+	}
+	for _, k := range keys {
+		lb, err := readOptional(local.FilePath(k))
+		if err != nil {
+			return report, err
+		}
+		rb, err := readOptional(remote.FilePath(k))
+		if err != nil {
+			return report, err
+		}
+
+		// Ties are the same value encrypted differently, eg after one copy
+		// was re-encrypted with a new data key, and keep the remote copy
+		// so both machines converge on the same files
+		winner, b := local, lb
+		reencrypted := lb != nil && rb != nil && itemModified(rb) == itemModified(lb)
+		if lb == nil || (rb != nil && !bytes.Equal(lb, rb) && itemModified(rb) >= itemModified(lb)) {
+			winner, b = remote, rb
+		}
+		if lb != nil && rb != nil && !bytes.Equal(lb, rb) && !reencrypted && base.changed(k, lb) && base.changed(k, rb) {
+			kept := "local"
+			if winner.Config.FileDir == remoteDir {
+				kept = "remote"
+			}
+			report.Conflicts = append(report.Conflicts, fmt.Sprintf("%s set on both machines, kept the newer %s value", k, kept))
+		}
+		if winner.Config.FileDir == remoteDir && !bytes.Equal(lb, rb) && !reencrypted {
+			report.Pulled = append(report.Pulled, k)
+		}
+		modified[k] = time.Unix(0, itemModified(b))
+
+		b, err = resealForSync(winner, k, b, dataKey, groups)
+		if err != nil {
+			return report, err
+		}
+		if !bytes.Equal(b, lb) {
+			sealed[k] = b
+		}
+	}
+
+	// The passphrase key is copied from the copy whose data key is kept,
+	// otherwise it needs the passphrase to encrypt the kept data key
+	var passphrase string
+	var copyPassphraseKey bool
+	_, localErr := os.Stat(local.FilePath(passphraseKeyFile))
+	_, remoteErr := os.Stat(remote.FilePath(passphraseKeyFile))
+	switch {
+	case keyFrom.Config.FileDir == localDir && localErr == nil,
+		bytes.Equal(localKey, remoteKey) && localErr == nil:
+	case keyFrom.Config.FileDir == remoteDir && remoteErr == nil,
+		bytes.Equal(localKey, remoteKey) && remoteErr == nil:
+		copyPassphraseKey = true
+	case localErr == nil:
+		if passphrase, err = local.chainPassphrase(); err != nil {
+			return report, err
+		}
+	case remoteErr == nil:
+		if passphrase, err = remote.chainPassphrase(); err != nil {
+			return report, err
+		}
+	}
+
+	flags, err := loadRotationFlags(localDir)
+	if err != nil {
+		return report, err
+	}
+	remoteFlags, err := loadRotationFlags(remoteDir)
+	if err != nil {
+		return report, err
+	}
+	flagsBefore := make(rotationFlags)
+	flagsBefore.Merge(flags)
+	flags.Merge(remoteFlags)
+	for k, t := range modified {
+		flags.ClearIfSetAfter(k, t)
+	}
+
+	unchanged, err := mergeUnchanged(local, localRegistry, registry, flagsBefore, flags, groups)
+	if err != nil {
+		return report, err
+	}
+	if unchanged && len(sealed) == 0 && bytes.Equal(dataKey, localKey) && passphrase == "" && !copyPassphraseKey {
+		// Nothing to merge, re-encrypting the data keys would only add noise
+		return report, adoptNewerCopy(localDir, remoteDir)
+	}
+
+	// Write the merged chain
+	if err := registry.Save(localDir); err != nil {
+		return report, err
+	}
+	if passphrase != "" {
+		if err := local.writePassphraseKey(dataKey, passphrase); err != nil {
+			return report, err
+		}
+	} else if copyPassphraseKey {
+		if err := copyFile(remote.FilePath(passphraseKeyFile), local.FilePath(passphraseKeyFile)); err != nil {
+			return report, err
+		}
+	}
+	for group, g := range groups {
+		if g.key != nil {
+			local.cache.groupKeys[group] = g.key
+		}
+		if g.from.Config.FileDir == remoteDir {
+			if err := copyFile(remote.FilePath(groupKeyFile(group)), local.FilePath(groupKeyFile(group))); err != nil {
+				return report, err
+			}
+		}
+	}
+	if dataKey != nil {
+		local.cache.dataKey = dataKey
+		// Also re-encrypts the data keys of groups the user is a member of
+		if err := local.writeDataKey(dataKey); err != nil {
+			return report, err
+		}
+	}
+	for k, b := range sealed {
+		if err := writeFileAtomic(local.FilePath(k), b, secureFSPerm); err != nil {
+			return report, err
+		}
+	}
+	if err := flags.Save(localDir); err != nil {
+		return report, err
+	}
+	if dataKey != nil {
+		// Version the merged manifest after both copies
+		if remoteManifest, err := readManifest(remoteDir); err == nil && remoteManifest != nil {
+			lastSeen, err := readManifestVersion(localDir)
+			if err != nil {
+				return report, err
+			}
+			if remoteManifest.Version > lastSeen {
+				if err := writeManifestVersion(localDir, remoteManifest.Version); err != nil {
+					return report, err
+				}
+			}
+		}
+		return report, writeManifest(localDir, chain, dataKey)
+	}
+	return report, nil
+}
+
+// checkRemoteManifest refuses a remote copy of the chain without a
+// manifest, unless it has never had values, or whose manifest is older
+// than the version last synced with the remote. Its signature is checked
+// when the remote copy's data key is decrypted, which compares it to the
+// same version.
+func checkRemoteManifest(remoteDir string) error {
+	m, err := readManifest(remoteDir)
+	if err != nil {
+		return eris.Wrap(err, "remote copy of the chain")
+	}
+	synced, err := readManifestVersion(remoteDir)
+	if err != nil {
+		return err
+	}
+
+	if m == nil {
+		hasKey := synced > 0
+		for _, file := range []string{dataKeyFile, passphraseKeyFile} {
+			if _, err := os.Stat(filepath.Join(remoteDir, file)); err == nil {
+				hasKey = true
+			}
+		}
+		if hasKey {
+			return eris.Wrap(ErrIntegrity, "remote copy of the chain has no manifest")
+		}
+		return nil
+	}
+	if m.Version < synced {
+		return eris.Wrapf(ErrIntegrity, "remote copy of the chain has manifest version %d, older than version %d last synced", m.Version, synced)
+	}
+	return nil
+}
+
+// adoptNewerCopy replaces the local chain with the remote copy when the two
+// only differ in how their data keys are encrypted and the remote manifest
+// is at least as new, so both machines converge on the same files
+func adoptNewerCopy(localDir string, remoteDir string) error {
+	localFiles, err := hashChainFiles(localDir)
+	if err != nil {
+		return err
+	}
+	remoteFiles, err := hashChainFiles(remoteDir)
+	if err != nil {
+		return err
+	}
+	if len(localFiles) != len(remoteFiles) {
+		return nil
+	}
+	for name, h := range localFiles {
+		rh, ok := remoteFiles[name]
+		if !ok {
+			return nil
+		}
+		wrapsKey := name == dataKeyFile || name == passphraseKeyFile || strings.HasPrefix(name, groupKeyFilePrefix)
+		if h != rh && !wrapsKey {
+			return nil
+		}
+	}
+
+	localManifest, err := readManifest(localDir)
+	if err != nil {
+		return err
+	}
+	remoteManifest, err := readManifest(remoteDir)
+	if err != nil || remoteManifest == nil {
+		return err
+	}
+	if localManifest != nil && localManifest.Version > remoteManifest.Version {
+		return nil
+	}
+
+	if err := copyChainFiles(remoteDir, localDir); err != nil {
+		return err
+	}
+	return writeManifestVersion(localDir, remoteManifest.Version)
+}
+
+// mergeUnchanged reports whether merging left the local registry, rotation
+// flags and group keys as they were
+func mergeUnchanged(local AgeStore, before *recipientRegistry, after *recipientRegistry, flagsBefore rotationFlags, flags rotationFlags, groups map[string]groupSyncKey) (bool, error) {
+	if same, err := sameJSON(before, after); err != nil || !same {
+		return false, err
+	}
+	if same, err := sameJSON(flagsBefore, flags); err != nil || !same {
+		return false, err
+	}
+
+	for group, g := range groups {
+		if g.from.Config.FileDir != local.Config.FileDir {
+			return false, nil
+		}
+		if g.key == nil {
+			continue
+		}
+		key, err := local.getGroupKey(group)
+		if err != nil || !bytes.Equal(key, g.key) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func sameJSON(a interface{}, b interface{}) (bool, error) {
+	ab, err := json.Marshal(a)
+	if err != nil {
+		return false, err
+	}
+	bb, err := json.Marshal(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(ab, bb), nil
+}
+
+// changedSince returns the copy in which the chain file name changed since
+// the last sync, or the zero AgeStore when it changed in both
+func changedSince(base syncBase, local AgeStore, remote AgeStore, name string) (AgeStore, error) {
+	localChanged, err := base.fileChanged(local, name)
+	if err != nil {
+		return AgeStore{}, err
+	}
+	remoteChanged, err := base.fileChanged(remote, name)
+	if err != nil {
+		return AgeStore{}, err
+	}
+	switch {
+	case localChanged && !remoteChanged:
+		return local, nil
+	case remoteChanged && !localChanged:
+		return remote, nil
+	}
+	return AgeStore{}, nil
+}
+
+// mergeGroupKeys decides the data key of each recipient group. Groups whose
+// keys changed in both copies get a new key, which requires being a member
+// of the group.
+func mergeGroupKeys(local AgeStore, remote AgeStore, base syncBase) (map[string]groupSyncKey, error) {
+	merged := make(map[string]groupSyncKey)
+	localGroups, err := local.groups()
+	if err != nil {
+		return nil, err
+	}
+	remoteGroups, err := remote.groups()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range append(localGroups, remoteGroups...) {
+		if _, ok := merged[group]; ok {
+			continue
+		}
+
+		var keys [][]byte
+		var files [][]byte
+		var from AgeStore
+		for _, s := range []AgeStore{local, remote} {
+			b, err := readOptional(s.FilePath(groupKeyFile(group)))
+			if err != nil {
+				return nil, err
+			}
+			if b == nil {
+				continue
+			}
+			if from.cache == nil {
+				from = s
+			}
+			files = append(files, b)
+
+			key, err := s.getGroupKey(group)
+			if errors.Is(err, ErrNotInGroup) {
+				key = nil
+			} else if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+
+		switch {
+		case len(files) == 1 || bytes.Equal(files[0], files[1]):
+			merged[group] = groupSyncKey{key: keys[0], from: from}
+		case keys[0] != nil && bytes.Equal(keys[0], keys[1]):
+			merged[group] = groupSyncKey{key: keys[0], from: local}
+		default:
+			changed, err := changedSince(base, local, remote, groupKeyFile(group))
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case changed.Config.FileDir == local.Config.FileDir:
+				merged[group] = groupSyncKey{key: keys[0], from: local}
+			case changed.Config.FileDir == remote.Config.FileDir && keys[1] == nil:
+				// Only a member could have changed it, copied as it is
+				merged[group] = groupSyncKey{from: remote}
+			case changed.Config.FileDir == remote.Config.FileDir:
+				merged[group] = groupSyncKey{key: keys[1], from: local}
+			case keys[0] == nil || keys[1] == nil:
+				return nil, eris.Errorf("group %s changed on both machines, sync as a member of the group", group)
+			default:
+				key, err := newDataKey()
+				if err != nil {
+					return nil, err
+				}
+				merged[group] = groupSyncKey{key: key, from: local}
+			}
+		}
+	}
+	return merged, nil
+}
+
+// mergeGroupMembers authenticates the merged members of each group, see
+// groupMembersMAC. Members of a group verify the members granted in each
+// copy they hold the group's key of and sign the merged members with the
+// key kept. Copies they can't verify may only have removed members. Users
+// outside the group keep the members and MAC of the copy its key is taken
+// from, which a member must have signed.
+func mergeGroupMembers(local AgeStore, remote AgeStore, localRegistry *recipientRegistry, remoteRegistry *recipientRegistry, merged *recipientRegistry, groups map[string]groupSyncKey) error {
+	for group, g := range groups {
+		if g.key == nil {
+			from := localRegistry
+			if g.from.Config.FileDir == remote.Config.FileDir {
+				from = remoteRegistry
+			}
+			if strings.Join(merged.groupGrants(group), "\n") != strings.Join(from.groupGrants(group), "\n") {
+				return eris.Errorf("members of group %s changed on both machines, sync as a member of the group", group)
+			}
+			if mac, ok := from.GroupMACs[group]; ok {
+				merged.GroupMACs[group] = mac
+			} else {
+				delete(merged.GroupMACs, group)
+			}
+			continue
+		}
+
+		verified := make(map[string]bool)
+		var unverified []*recipientRegistry
+		for _, side := range []struct {
+			store    AgeStore
+			registry *recipientRegistry
+		}{{local, localRegistry}, {remote, remoteRegistry}} {
+			key, err := side.store.getGroupKey(group)
+			if errors.Is(err, ErrNotInGroup) || errors.Is(err, os.ErrNotExist) {
+				unverified = append(unverified, side.registry)
+				continue
+			} else if err != nil {
+				return err
+			}
+			if err := side.registry.verifyGroupMembers(group, key); err != nil {
+				return eris.Wrapf(err, "copy of the chain in %s", side.store.Config.FileDir)
+			}
+			for _, grant := range side.registry.groupGrants(group) {
+				verified[grant] = true
+			}
+		}
+		for _, r := range unverified {
+			for _, grant := range r.groupGrants(group) {
+				if !verified[grant] {
+					return eris.Wrapf(ErrGroupMembersChanged, "%s grants %s", group, strings.Fields(grant)[0])
+				}
+			}
+		}
+		if err := merged.signGroupMembers(group, g.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resealForSync re-encrypts the value b of key read from s when the data
+// key of its group changed while merging. Values which aren't bound to
+// their key and chain are refused, anyone with the chain's public keys
+// could have written them and merging would sign them into the manifest.
+func resealForSync(s AgeStore, key string, b []byte, dataKey []byte, groups map[string]groupSyncKey) ([]byte, error) {
+	header, _, err := readEnvelopeHeader(b)
+	if !isCurrentEnvelope(b) {
+		return nil, eris.Wrapf(ErrUnboundValue, "key %s in %s, run chain migrate on the machine which wrote it", key, s.Config.FileDir)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var current, target []byte
+	if header.Group == "" {
+		current, err = s.getDataKey()
+		target = dataKey
+	} else {
+		g := groups[header.Group]
+		if g.key == nil {
+			// Unchanged as only a member could have changed it
+			return b, nil
+		}
+		current, err = s.getGroupKey(header.Group)
+		target = g.key
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(current, target) {
+		return b, nil
+	}
+
+	data, header, err := s.openItem(key, b)
+	if err != nil {
+		return nil, eris.Wrapf(err, "Failed to decrypt key: %+v", key)
+	}
+	registerSecret(data)
+	return sealEnvelope(target, header, data)
+}
+
+// itemModified returns when a value was set, 0 for values written
+// before envelope headers recorded it
+func itemModified(b []byte) int64 {
+	header, _, err := readEnvelopeHeader(b)
+	if err != nil {
+		return 0
+	}
+	return header.Modified
+}
+
+func syncKeys(local AgeStore, remote AgeStore) ([]string, error) {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, s := range []AgeStore{local, remote} {
+		ks, err := s.Keys()
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range ks {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func readOptional(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return b, err
+}
+
+func copyFile(src string, dst string) error {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dst, b, secureFSPerm)
+}
@@ -0,0 +1,296 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/99designs/keyring"
+	"github.com/spf13/viper"
+)
+
+// newTestRemoteCopy copies the chain in s to a remote copy as of a sync,
+// returning the remote copy and the base of the next merge
+func newTestRemoteCopy(t *testing.T, s AgeStore) (AgeStore, syncBase) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), s.Config.ServiceName)
+	if err := copyChainFiles(s.Config.FileDir, dir); err != nil {
+		t.Fatal(err)
+	}
+	base, err := newSyncBase(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveSyncState(base, filepath.Join(t.TempDir(), "base.json"), dir); err != nil {
+		t.Fatal(err)
+	}
+	return newAgeStoreAt(s.Config.ServiceName, dir), base
+}
+
+// addTestMembers adds a member of the chain for each name
+func addTestMembers(t *testing.T, s AgeStore, names ...string) map[string]*age.X25519Identity {
+	t.Helper()
+	members := make(map[string]*age.X25519Identity)
+	if err := s.UpdateRecipients(func(r *recipientRegistry) error {
+		for _, name := range names {
+			members[name] = newTestIdentity(t)
+			e, err := r.Add(members[name].Recipient().String(), name)
+			if err != nil {
+				return err
+			}
+			e.Member = true
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return members
+}
+
+func TestMergeRefusesRolledBackRemote(t *testing.T) {
+	useTestAgeStore(t)
+	s, _ := newTestAgeChain(t, "aws")
+	mustSet(t, s, "A", "old")
+	old := filepath.Join(t.TempDir(), "old")
+	if err := copyChainFiles(s.Config.FileDir, old); err != nil {
+		t.Fatal(err)
+	}
+
+	mustSet(t, s, "A", "new")
+	remote, base := newTestRemoteCopy(t, s)
+	// The remote is reset to the older copy, which is validly signed
+	if err := copyChainFiles(old, remote.Config.FileDir); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := mergeChain("aws", s.Config.FileDir, remote.Config.FileDir, base)
+	if !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("got %v, want ErrIntegrity", err)
+	}
+	assertValue(t, s, "A", "new")
+}
+
+func TestMergeRefusesRemoteWithoutManifest(t *testing.T) {
+	useTestAgeStore(t)
+	s, _ := newTestAgeChain(t, "aws")
+	mustSet(t, s, "A", "1")
+
+	// Never synced before, so nothing is known about the remote copy
+	dir := filepath.Join(t.TempDir(), "aws")
+	if err := copyChainFiles(s.Config.FileDir, dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, manifestFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := mergeChain("aws", s.Config.FileDir, dir, nil)
+	if !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("got %v, want ErrIntegrity", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, manifestFile)); !os.IsNotExist(err) {
+		t.Error("a manifest was written for the remote copy")
+	}
+}
+
+func TestMergeRekeysConcurrentDataKeyChanges(t *testing.T) {
+	useTestAgeStore(t)
+	s, owner := newTestAgeChain(t, "aws")
+	members := addTestMembers(t, s, "bob", "carol")
+	mustSet(t, s, "A", "1")
+	remote, base := newTestRemoteCopy(t, s)
+
+	// Each machine removes a different member
+	if _, _, err := asIdentity(t, "aws", owner).RemoveRecipient("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := remote.RemoveRecipient("carol"); err != nil {
+		t.Fatal(err)
+	}
+	keys := make(map[string][]byte)
+	for name, s := range map[string]AgeStore{"local": asIdentity(t, "aws", owner), "remote": remote} {
+		key, err := s.getDataKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = append([]byte(nil), key...)
+	}
+
+	report, err := mergeChain("aws", s.Config.FileDir, remote.Config.FileDir, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Rekeyed {
+		t.Error("data key changed on both machines without re-keying")
+	}
+
+	s = asIdentity(t, "aws", owner)
+	assertValue(t, s, "A", "1")
+	merged, err := s.getDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, key := range keys {
+		if string(merged) == string(key) {
+			t.Errorf("merged chain kept the %s data key", name)
+		}
+	}
+	for name, member := range members {
+		if _, err := asIdentity(t, "aws", member).Get("A"); err == nil {
+			t.Errorf("removed member %s can read the merged chain", name)
+		}
+	}
+}
+
+// newTestSyncedGroup creates a chain with a value in group "oncall", which
+// its owner and carol are members of, and a remote copy as of a sync
+func newTestSyncedGroup(t *testing.T) (s AgeStore, remote AgeStore, base syncBase, owner *age.X25519Identity, members map[string]*age.X25519Identity) {
+	t.Helper()
+	useTestAgeStore(t)
+	s, owner = newTestAgeChain(t, "aws")
+	members = addTestMembers(t, s, "bob", "carol")
+	setTestGroups(t, s, map[string]bool{"owner": true, "carol": true})
+	if err := s.SetInGroup(keyring.Item{Key: "DB", Data: []byte("secret")}, "oncall"); err != nil {
+		t.Fatal(err)
+	}
+	remote, base = newTestRemoteCopy(t, s)
+	return s, remote, base, owner, members
+}
+
+// setTestGroups puts the recipients named in oncall in group "oncall" and
+// takes everyone else out of it
+func setTestGroups(t *testing.T, s AgeStore, oncall map[string]bool) {
+	t.Helper()
+	if err := s.UpdateRecipients(func(r *recipientRegistry) error {
+		for i := range r.Recipients {
+			e := &r.Recipients[i]
+			e.Groups = nil
+			if oncall[e.Label] {
+				e.AddGroup("oncall")
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeGroupMembers(t *testing.T) {
+	s, remote, base, owner, members := newTestSyncedGroup(t)
+
+	// Carol leaves the group locally while bob joins it on the remote
+	setTestGroups(t, asIdentity(t, "aws", owner), map[string]bool{"owner": true})
+	setTestGroups(t, remote, map[string]bool{"owner": true, "carol": true, "bob": true})
+
+	if _, err := mergeChain("aws", s.Config.FileDir, remote.Config.FileDir, base); err != nil {
+		t.Fatal(err)
+	}
+	registry, err := loadRecipients(s.Config.FileDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var grants []string
+	for _, e := range registry.Recipients {
+		if e.InGroup("oncall") {
+			grants = append(grants, e.Label)
+		}
+	}
+	if want := []string{"owner", "bob"}; !reflect.DeepEqual(grants, want) {
+		t.Errorf("merged group members %v, want %v", grants, want)
+	}
+
+	assertValue(t, asIdentity(t, "aws", members["bob"]), "DB", "secret")
+	if _, err := asIdentity(t, "aws", members["carol"]).Get("DB"); !errors.Is(err, ErrNotInGroup) {
+		t.Errorf("member who left the group: got %v, want ErrNotInGroup", err)
+	}
+	// The merged members are signed, so the next write succeeds
+	mustSet(t, asIdentity(t, "aws", owner), "B", "2")
+}
+
+func TestMergeRefusesUnsignedGroupMembers(t *testing.T) {
+	s, remote, base, owner, members := newTestSyncedGroup(t)
+
+	// Bob joins the group on the remote without its key
+	asIdentity(t, "aws", members["bob"])
+	editRecipients(t, newAgeStoreAt("aws", remote.Config.FileDir), func(r *recipientRegistry) {
+		e, err := r.Find("bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.AddGroup("oncall")
+	})
+
+	asIdentity(t, "aws", owner)
+	_, err := mergeChain("aws", s.Config.FileDir, remote.Config.FileDir, base)
+	if !errors.Is(err, ErrGroupMembersChanged) {
+		t.Fatalf("got %v, want ErrGroupMembersChanged", err)
+	}
+	if _, err := asIdentity(t, "aws", members["bob"]).Get("DB"); !errors.Is(err, ErrNotInGroup) {
+		t.Errorf("group key was re-encrypted to a non-member: %v", err)
+	}
+}
+
+func TestMergeGroups(t *testing.T) {
+	base := syncBase{groupMemberKey("oncall", "id"): "", groupMemberKey("ops", "id"): ""}
+	tests := []struct {
+		name          string
+		local, remote []string
+		base          syncBase
+		want          []string
+	}{
+		{"unchanged", []string{"oncall", "ops"}, []string{"oncall", "ops"}, base, []string{"oncall", "ops"}},
+		{"removed locally", []string{"ops"}, []string{"oncall", "ops"}, base, []string{"ops"}},
+		{"removed remotely", []string{"oncall", "ops"}, []string{"oncall"}, base, []string{"oncall"}},
+		{"added remotely", []string{"oncall", "ops"}, []string{"dev", "oncall", "ops"}, base, []string{"dev", "oncall", "ops"}},
+		{"added and removed", []string{"dev", "ops"}, []string{"oncall", "ops"}, base, []string{"dev", "ops"}},
+		{"first sync", []string{"oncall"}, []string{"ops"}, nil, []string{"oncall", "ops"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeGroups("id", tt.local, tt.remote, tt.base); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSyncRefusesRolledBackRemote force pushes an older commit of the chain
+// to the remote, which sync must notice from the version it last pushed
+func TestSyncRefusesRolledBackRemote(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	useTestAgeStore(t)
+	remote := filepath.Join(t.TempDir(), "chains.git")
+	if out, err := exec.Command("git", "init", "--quiet", "--bare", remote).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	viper.Set(SyncRemoteKey, remote)
+	viper.Set(SyncBranchKey, "main")
+
+	s, owner := newTestAgeChain(t, "aws")
+	mustSet(t, s, "A", "old")
+	if _, err := syncChain("aws"); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, asIdentity(t, "aws", owner), "A", "new")
+	if _, err := syncChain("aws"); err != nil {
+		t.Fatal(err)
+	}
+
+	workDir, err := syncWorkDir(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git(workDir, "push", "--quiet", "--force", "origin", "HEAD~1:main"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := syncChain("aws"); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("got %v, want ErrIntegrity", err)
+	}
+	assertValue(t, asIdentity(t, "aws", owner), "A", "new")
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/rotisserie/eris"
+	"golang.org/x/term"
+)
+
+// Prompts read from and write to the controlling terminal rather than
+// stdin and stdout, which may be carrying piped data, eg
+// echo K=V | chain set x prompts for the password on the terminal while
+// reading K=V from stdin.
+
+var ErrNoTTY = errors.New("no terminal to prompt on")
+var ErrPromptCancelled = errors.New("prompt was cancelled")
+
+// promptTTY asks for a value on the terminal, without echoing it when
+// masked, until it passes validate
+func promptTTY(label string, masked bool, validate func(string) error) (string, error) {
+	in, out, err := openTTY()
+	if err != nil {
+		return "", eris.Wrapf(ErrNoTTY, "Unable to prompt for %s, set CHAIN_PASSWORD_FD or CHAIN_PASSWORD_COMMAND for passwords when running without a terminal: %v", strings.TrimRight(label, ":> "), err)
+	}
+	defer in.Close()
+	if out != in {
+		defer out.Close()
+	}
+
+	reader := bufio.NewReader(in)
+	for {
+		fmt.Fprintf(out, "%s ", strings.TrimSpace(label))
+		var input string
+		if masked {
+			input, err = readMasked(in, out)
+		} else {
+			input, err = reader.ReadString('\n')
+			if errors.Is(err, io.EOF) && input == "" {
+				err = ErrPromptCancelled
+			} else if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			input = strings.TrimRight(input, "\r\n")
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if validate != nil {
+			if err := validate(input); err != nil {
+				fmt.Fprintf(out, "%s\n", err)
+				continue
+			}
+		}
+		return input, nil
+	}
+}
+
+// readMasked reads a line with echo turned off, restoring the terminal if
+// chain is interrupted while reading
+func readMasked(in *os.File, out *os.File) (string, error) {
+	fd := int(in.Fd())
+	state, err := term.GetState(fd)
+	if err != nil {
+		return "", eris.Wrap(err, "Unable to read terminal state")
+	}
+
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		signal.Stop(sigs)
+		close(done)
+	}()
+	go func() {
+		select {
+		case <-sigs:
+			_ = term.Restore(fd, state)
+			fmt.Fprintln(out)
+			os.Exit(130)
+		case <-done:
+		}
+	}()
+
+	b, err := term.ReadPassword(fd)
+	defer wipe(b)
+	fmt.Fprintln(out)
+	if errors.Is(err, io.EOF) {
+		return "", ErrPromptCancelled
+	} else if err != nil {
+		return "", eris.Wrap(err, "Unable to read from terminal")
+	}
+	return string(b), nil
+}
@@ -0,0 +1,542 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/99designs/keyring"
+	"github.com/rotisserie/eris"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+
+	chainv1 "github.com/zph/chain/gen/go/chain/v1"
+)
+
+// Chain vault format
+//
+// StandardStore chains are stored in a single vault file, vaultFile in the
+// chain's directory, rather than with the keyring file backend:
+//
+//	vaultMagic | JSON vaultHeader
+//
+// A random data key is encrypted with a key derived from the chain's
+// password using Argon2id with the parameters recorded in the header, which
+// chain vault upgrade raises over time. Each value is encrypted with the
+// data key using XChaCha20-Poly1305, authenticating its key and metadata as
+// additional data. The header as a whole is authenticated with an HMAC keyed
+// from the data key so entries can't be removed or rolled back one by one.
+//
+// Chains written with the keyring file backend keep working and are
+// converted by chain vault upgrade.
+
+var vaultFile = ".VAULT"
+var vaultMagic = []byte("chain-vault/v1\n")
+var vaultVersion = 1
+
+var ErrVaultPassword = errors.New("incorrect password for chain vault")
+var ErrVaultInvalid = errors.New("chain vault failed integrity check")
+
+// kdfParams are the Argon2id parameters used to derive a key from a password
+type kdfParams struct {
+	Algorithm string `json:"algorithm"`
+	Salt      []byte `json:"salt"`
+	Time      uint32 `json:"time"`
+	Memory    uint32 `json:"memory"` // KiB
+	Threads   uint8  `json:"threads"`
+}
+
+// newKDFParams returns the configured Argon2id parameters with a new salt
+func newKDFParams() (kdfParams, error) {
+	p := kdfParams{
+		Algorithm: "argon2id",
+		Salt:      make([]byte, 16),
+		Time:      viper.GetUint32(VaultKDFTimeKey),
+		Memory:    viper.GetUint32(VaultKDFMemoryKey) * 1024,
+		Threads:   uint8(viper.GetUint(VaultKDFThreadsKey)),
+	}
+	if p.Time < 1 || p.Memory < 8*1024 || p.Threads < 1 {
+		return p, eris.Errorf("Argon2id needs a time of at least 1, memory of at least 8 MiB and 1 thread, got %s", p)
+	}
+	if _, err := rand.Read(p.Salt); err != nil {
+		return p, eris.Wrap(err, "Unable to generate salt")
+	}
+	return p, nil
+}
+
+func (p kdfParams) derive(password string) ([]byte, error) {
+	if p.Algorithm != "argon2id" {
+		return nil, eris.Errorf("unsupported key derivation %q", p.Algorithm)
+	}
+	// Parameters are read from the chain's files, argon2 panics on these
+	if p.Time < 1 || p.Threads < 1 {
+		return nil, eris.Errorf("invalid key derivation parameters %s", p)
+	}
+	pw := []byte(password)
+	defer wipe(pw)
+	key := argon2.IDKey(pw, p.Salt, p.Time, p.Memory, p.Threads, chacha20poly1305.KeySize)
+	defer wipe(key)
+	return secretCopy(key), nil
+}
+
+// weakerThan reports whether any parameter is lower than in other
+func (p kdfParams) weakerThan(other kdfParams) bool {
+	return p.Time < other.Time || p.Memory < other.Memory || p.Threads < other.Threads
+}
+
+// max returns the higher of each parameter, keeping the salt of p
+func (p kdfParams) max(other kdfParams) kdfParams {
+	if other.Time > p.Time {
+		p.Time = other.Time
+	}
+	if other.Memory > p.Memory {
+		p.Memory = other.Memory
+	}
+	if other.Threads > p.Threads {
+		p.Threads = other.Threads
+	}
+	return p
+}
+
+func (p kdfParams) String() string {
+	return fmt.Sprintf("%s time=%d memory=%dMiB threads=%d", p.Algorithm, p.Time, p.Memory/1024, p.Threads)
+}
+
+// vaultHeader is the contents of a vault file
+type vaultHeader struct {
+	Version int          `json:"version"`
+	Chain   string       `json:"chain"`
+	KDF     kdfParams    `json:"kdf"`
+	DataKey []byte       `json:"data_key"`
+	Entries []vaultEntry `json:"entries"`
+	MAC     []byte       `json:"mac,omitempty"`
+}
+
+// vaultEntry is a value and its metadata, everything but Value is
+// authenticated as additional data when encrypting Value
+type vaultEntry struct {
+	Key         string    `json:"key"`
+	Label       string    `json:"label,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Created     time.Time `json:"created"`
+	Modified    time.Time `json:"modified"`
+	Value       []byte    `json:"value,omitempty"`
+}
+
+// VaultStore is the StandardStore for chains in the vault format
+type VaultStore struct {
+	chain string
+	path  string
+	state *vaultState
+}
+
+// vaultState is the unlocked vault, loaded once per process
+type vaultState struct {
+	header  *vaultHeader
+	dataKey []byte
+}
+
+func newVaultStore(chain string) VaultStore {
+	return VaultStore{
+		chain: chain,
+		path:  filepath.Join(filePath(chain), vaultFile),
+		state: &vaultState{},
+	}
+}
+
+func vaultExists(chain string) bool {
+	_, err := os.Stat(filepath.Join(filePath(chain), vaultFile))
+	return err == nil
+}
+
+func (s VaultStore) Name() string {
+	return chainv1.StorageType_STORAGE_TYPE_STANDARD_STORE.String()
+}
+
+func (s VaultStore) PostRunHook() error { return nil }
+
+func (s VaultStore) Keys() ([]string, error) {
+	v, err := s.load()
+	if err != nil || v == nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, e := range v.Entries {
+		keys = append(keys, e.Key)
+	}
+	return keys, nil
+}
+
+func (s VaultStore) Get(key string) (keyring.Item, error) {
+	v, err := s.load()
+	if err != nil {
+		return keyring.Item{}, err
+	}
+	if v == nil {
+		return keyring.Item{}, keyring.ErrKeyNotFound
+	}
+
+	for _, e := range v.Entries {
+		if e.Key != key {
+			continue
+		}
+		data, err := s.openEntry(e)
+		if err != nil {
+			return keyring.Item{}, eris.Wrapf(err, "Failed to decrypt key: %+v", key)
+		}
+		registerSecret(data)
+		return keyring.Item{Key: e.Key, Data: data, Label: e.Label, Description: e.Description}, nil
+	}
+	return keyring.Item{}, keyring.ErrKeyNotFound
+}
+
+func (s VaultStore) Set(item keyring.Item) error {
+	return s.SetItems([]keyring.Item{item})
+}
+
+// SetItems saves items with a single write of the vault
+func (s VaultStore) SetItems(items []keyring.Item) error {
+	v, err := s.loadOrCreate()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, item := range items {
+		e := vaultEntry{Key: item.Key, Label: item.Label, Description: item.Description, Created: now, Modified: now}
+		i := sort.Search(len(v.Entries), func(i int) bool { return v.Entries[i].Key >= item.Key })
+		exists := i < len(v.Entries) && v.Entries[i].Key == item.Key
+		if exists {
+			e.Created = v.Entries[i].Created
+		}
+
+		if e.Value, err = s.sealEntry(e, item.Data); err != nil {
+			return eris.Wrapf(err, "Failed to encrypt key: %+v", item.Key)
+		}
+		if exists {
+			v.Entries[i] = e
+		} else {
+			v.Entries = append(v.Entries[:i], append([]vaultEntry{e}, v.Entries[i:]...)...)
+		}
+	}
+	return s.save()
+}
+
+func (s VaultStore) Remove(key string) error {
+	v, err := s.load()
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return keyring.ErrKeyNotFound
+	}
+
+	for i, e := range v.Entries {
+		if e.Key == key {
+			v.Entries = append(v.Entries[:i], v.Entries[i+1:]...)
+			return s.save()
+		}
+	}
+	return keyring.ErrKeyNotFound
+}
+
+// load reads and unlocks the vault, nil when the chain has no vault yet
+func (s VaultStore) load() (*vaultHeader, error) {
+	if s.state.header != nil {
+		return s.state.header, nil
+	}
+
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	v, err := parseVault(b)
+	if err != nil {
+		return nil, err
+	}
+	if v.Chain != s.chain {
+		return nil, eris.Wrapf(ErrVaultInvalid, "vault belongs to chain %q", v.Chain)
+	}
+
+	password, err := getChainPassword(s.chain)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := v.unlock(password)
+	if err != nil {
+		return nil, err
+	}
+
+	s.state.header, s.state.dataKey = v, dataKey
+	return v, nil
+}
+
+// loadOrCreate loads the vault, creating an empty one encrypted with the
+// chain's password when it doesn't exist
+func (s VaultStore) loadOrCreate() (*vaultHeader, error) {
+	v, err := s.load()
+	if err != nil || v != nil {
+		return v, err
+	}
+
+	password, err := getChainPassword(s.chain)
+	if err != nil {
+		return nil, err
+	}
+	return s.create(password)
+}
+
+// create starts an empty vault encrypted with password, it is written by
+// the next save
+func (s VaultStore) create(password string) (*vaultHeader, error) {
+	dataKey, err := newDataKey()
+	if err != nil {
+		return nil, err
+	}
+	v := &vaultHeader{Version: vaultVersion, Chain: s.chain}
+	if err := v.wrapDataKey(dataKey, password); err != nil {
+		return nil, err
+	}
+
+	s.state.header, s.state.dataKey = v, dataKey
+	return v, nil
+}
+
+func (s VaultStore) save() error {
+	v := s.state.header
+	mac, err := v.mac(s.state.dataKey)
+	if err != nil {
+		return err
+	}
+	v.MAC = mac
+
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, append(append([]byte{}, vaultMagic...), b...), secureFSPerm)
+}
+
+// upgradeKDF re-encrypts the data key with new Argon2id parameters
+func (s VaultStore) upgradeKDF(params kdfParams) error {
+	v, err := s.load()
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return eris.New("chain has no vault")
+	}
+
+	password, err := getChainPassword(s.chain)
+	if err != nil {
+		return err
+	}
+	wrapped, err := sealWithParams(params, password, s.state.dataKey, v.dataKeyAD(params))
+	if err != nil {
+		return err
+	}
+	v.KDF, v.DataKey = params, wrapped
+	return s.save()
+}
+
+// ChangePassword re-encrypts every value under a new data key wrapped with
+// the new password. The vault is replaced with a single atomic write so an
+// interrupted change leaves the old vault intact.
+func (s VaultStore) ChangePassword(newPassword func() (string, error)) error {
+	v, err := s.load()
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return eris.Errorf("chain %s has no values", s.chain)
+	}
+
+	values := make([][]byte, len(v.Entries))
+	for i, e := range v.Entries {
+		if values[i], err = s.openEntry(e); err != nil {
+			return eris.Wrapf(err, "Failed to decrypt key: %+v", e.Key)
+		}
+		registerSecret(values[i])
+	}
+
+	password, err := newPassword()
+	if err != nil {
+		return err
+	}
+	params, err := newKDFParams()
+	if err != nil {
+		return err
+	}
+	dataKey, err := newDataKey()
+	if err != nil {
+		return err
+	}
+	next := &vaultHeader{Version: vaultVersion, Chain: s.chain}
+	params = params.max(v.KDF)
+	if next.DataKey, err = sealWithParams(params, password, dataKey, next.dataKeyAD(params)); err != nil {
+		return err
+	}
+	next.KDF = params
+
+	s.state.header, s.state.dataKey = next, dataKey
+	for i, e := range v.Entries {
+		if e.Value, err = s.sealEntry(e, values[i]); err != nil {
+			return eris.Wrapf(err, "Failed to encrypt key: %+v", e.Key)
+		}
+		next.Entries = append(next.Entries, e)
+	}
+	return s.save()
+}
+
+func (s VaultStore) sealEntry(e vaultEntry, data []byte) ([]byte, error) {
+	ad, err := s.entryAD(e)
+	if err != nil {
+		return nil, err
+	}
+	return xchachaSeal(s.state.dataKey, data, ad)
+}
+
+func (s VaultStore) openEntry(e vaultEntry) ([]byte, error) {
+	ad, err := s.entryAD(e)
+	if err != nil {
+		return nil, err
+	}
+	return xchachaOpen(s.state.dataKey, e.Value, ad)
+}
+
+func (s VaultStore) entryAD(e vaultEntry) ([]byte, error) {
+	e.Value = nil
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(string(vaultMagic)+s.chain+"\n"), b...), nil
+}
+
+func parseVault(b []byte) (*vaultHeader, error) {
+	if !bytes.HasPrefix(b, vaultMagic) {
+		return nil, eris.Wrap(ErrVaultInvalid, "unsupported vault format")
+	}
+	var v vaultHeader
+	if err := json.Unmarshal(b[len(vaultMagic):], &v); err != nil {
+		return nil, eris.Wrap(ErrVaultInvalid, err.Error())
+	}
+	if v.Version != vaultVersion {
+		return nil, eris.Wrapf(ErrVaultInvalid, "unsupported vault version %d", v.Version)
+	}
+	return &v, nil
+}
+
+// unlock decrypts the data key with password and verifies the vault's MAC
+func (v *vaultHeader) unlock(password string) ([]byte, error) {
+	key, err := v.KDF.derive(password)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := xchachaOpen(key, v.DataKey, v.dataKeyAD(v.KDF))
+	if err != nil {
+		return nil, eris.Wrapf(ErrVaultPassword, "Unable to unlock vault for chain: %+v", v.Chain)
+	}
+
+	mac, err := v.mac(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, v.MAC) {
+		return nil, ErrVaultInvalid
+	}
+	return dataKey, nil
+}
+
+func (v *vaultHeader) wrapDataKey(dataKey []byte, password string) error {
+	params, err := newKDFParams()
+	if err != nil {
+		return err
+	}
+	wrapped, err := sealWithParams(params, password, dataKey, v.dataKeyAD(params))
+	if err != nil {
+		return err
+	}
+	v.KDF, v.DataKey = params, wrapped
+	return nil
+}
+
+// dataKeyAD authenticates the key derivation parameters, so they can't be
+// lowered without knowing the password
+func (v *vaultHeader) dataKeyAD(params kdfParams) []byte {
+	b, _ := json.Marshal(params)
+	return append([]byte(fmt.Sprintf("%s%d\n%s\n", vaultMagic, v.Version, v.Chain)), b...)
+}
+
+// mac authenticates the whole header except the MAC itself
+func (v *vaultHeader) mac(dataKey []byte) ([]byte, error) {
+	unsigned := *v
+	unsigned.MAC = nil
+	b, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dataKey, nil, []byte("chain-vault/v1 mac")), key); err != nil {
+		return nil, err
+	}
+	m := hmac.New(sha256.New, key)
+	m.Write(vaultMagic)
+	m.Write(b)
+	return m.Sum(nil), nil
+}
+
+func sealWithParams(params kdfParams, password string, plaintext []byte, ad []byte) ([]byte, error) {
+	key, err := params.derive(password)
+	if err != nil {
+		return nil, err
+	}
+	return xchachaSeal(key, plaintext, ad)
+}
+
+// xchachaSeal encrypts plaintext with XChaCha20-Poly1305 as nonce | ciphertext
+func xchachaSeal(key []byte, plaintext []byte, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, eris.Wrap(err, "Unable to generate nonce")
+	}
+	return aead.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+func xchachaOpen(key []byte, sealed []byte, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidEnvelope
+	}
+	dst := secretAlloc(len(sealed) - aead.NonceSize() - aead.Overhead())
+	plaintext, err := aead.Open(dst[:0], sealed[:aead.NonceSize()], sealed[aead.NonceSize():], ad)
+	if err != nil {
+		return nil, eris.Wrap(ErrInvalidEnvelope, err.Error())
+	}
+	return plaintext, nil
+}
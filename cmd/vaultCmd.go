@@ -0,0 +1,156 @@
+/*
+Copyright © 2022 Zander Hill <zander@xargs.io>
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/99designs/keyring"
+	"github.com/rotisserie/eris"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	chainv1 "github.com/zph/chain/gen/go/chain/v1"
+)
+
+// vaultCmd represents the vault command
+var vaultCmd = &cobra.Command{
+	Use:   "vault",
+	Short: "Manage the vault file of a standard chain",
+	Long: `
+	Manage the vault file of a standard chain
+
+	Standard chains are stored in a single vault file whose data key is
+	encrypted with a key derived from the password using Argon2id. The
+	Argon2id parameters are recorded in the vault and can be raised as
+	hardware gets faster.
+
+	eg:
+	chain vault upgrade aws-creds
+	chain vault upgrade aws-creds --time 4 --memory 256
+`,
+}
+
+var vaultUpgradeCmd = &cobra.Command{
+	Use:   "upgrade [keychain]",
+	Short: "Convert a chain to the vault format or raise its Argon2id parameters",
+	Long: `
+	Convert a chain written with the keyring file backend to the vault
+	format, or re-encrypt the data key of a vault with the configured
+	Argon2id parameters. Parameters are never lowered, a parameter lower
+	than the vault's keeps the vault's value.
+`,
+	Args:    cobra.ExactArgs(1),
+	PreRun:  lockChainPreRun(exclusiveLock),
+	PostRun: unlockChainPostRun,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := upgradeVault(args[0]); err != nil {
+			log.Fatal().Msgf(eris.ToString(err, true))
+		}
+	},
+}
+
+func init() {
+	vaultUpgradeCmd.Flags().Uint32("time", 0, "Argon2id passes, overrides CHAIN_VAULT_KDF_TIME")
+	vaultUpgradeCmd.Flags().Uint32("memory", 0, "Argon2id memory in MiB, overrides CHAIN_VAULT_KDF_MEMORY")
+	vaultUpgradeCmd.Flags().Uint8("threads", 0, "Argon2id parallelism, overrides CHAIN_VAULT_KDF_THREADS")
+	viper.BindPFlag(VaultKDFTimeKey, vaultUpgradeCmd.Flags().Lookup("time"))
+	viper.BindPFlag(VaultKDFMemoryKey, vaultUpgradeCmd.Flags().Lookup("memory"))
+	viper.BindPFlag(VaultKDFThreadsKey, vaultUpgradeCmd.Flags().Lookup("threads"))
+
+	vaultCmd.AddCommand(vaultUpgradeCmd)
+	RootCmd.AddCommand(vaultCmd)
+}
+
+func upgradeVault(chain string) error {
+	if viper.GetInt(StoreBackendTypeName) != int(chainv1.StorageType_STORAGE_TYPE_STANDARD_STORE) {
+		return eris.New("vaults are only used by the standard store")
+	}
+
+	params, err := newKDFParams()
+	if err != nil {
+		return err
+	}
+	if !vaultExists(chain) {
+		return convertToVault(chain)
+	}
+
+	vault := newVaultStore(chain)
+	v, err := vault.load()
+	if err != nil {
+		return err
+	}
+	if params.weakerThan(v.KDF) {
+		log.Warn().Msgf("Keeping the higher parameters of %s, they are never lowered", v.KDF)
+		params = params.max(v.KDF)
+	}
+	if params.Time == v.KDF.Time && params.Memory == v.KDF.Memory && params.Threads == v.KDF.Threads {
+		fmt.Printf("Vault already uses %s\n", params)
+		return nil
+	}
+
+	previous := v.KDF
+	if err := vault.upgradeKDF(params); err != nil {
+		return err
+	}
+	fmt.Printf("Upgraded vault from %s to %s\n", previous, params)
+	return nil
+}
+
+// convertToVault moves the values of a chain written with the keyring file
+// backend into a new vault with the chain's current password
+func convertToVault(chain string) error {
+	legacy, err := newLegacyStandardStore(chain)
+	if err != nil {
+		return err
+	}
+	vault, count, err := legacy.moveToVault(func() (string, error) { return getChainPassword(chain) })
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Converted %d value(s) to a vault using %s\n", count, vault.state.header.KDF)
+	return nil
+}
+
+// moveToVault reads every value and writes them to a new vault encrypted
+// with password. The vault is written before the old files are removed so
+// an interrupted conversion loses nothing.
+func (s StandardStore) moveToVault(password func() (string, error)) (VaultStore, int, error) {
+	vault := newVaultStore(s.chain)
+	keys, err := s.Keys()
+	if err != nil {
+		return vault, 0, err
+	}
+	if len(keys) == 0 {
+		return vault, 0, eris.Errorf("chain %s has no values to convert", s.chain)
+	}
+
+	var items []keyring.Item
+	for _, k := range keys {
+		item, err := s.Get(k)
+		if err != nil {
+			return vault, 0, eris.Wrapf(err, "Unable to get key: %+v", k)
+		}
+		registerSecret(item.Data)
+		items = append(items, item)
+	}
+
+	p, err := password()
+	if err != nil {
+		return vault, 0, err
+	}
+	if _, err := vault.create(p); err != nil {
+		return vault, 0, err
+	}
+	if err := vault.SetItems(items); err != nil {
+		return vault, 0, err
+	}
+
+	for _, k := range keys {
+		if err := s.Remove(k); err != nil {
+			return vault, 0, eris.Wrapf(err, "Converted to a vault but unable to remove the old file for key: %+v", k)
+		}
+	}
+	return vault, len(items), nil
+}
@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/99designs/keyring"
+	"github.com/spf13/viper"
+)
+
+// newTestVault opens chain in the vault format in a temporary directory
+func newTestVault(t *testing.T, chain string) VaultStore {
+	t.Helper()
+	useTestBoltStore(t)
+	viper.Set(StoreBackendTypeName, 1)
+	store, err := NewStore(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.(VaultStore)
+}
+
+// editVault rewrites the header of s's vault file without updating its MAC
+func editVault(t *testing.T, s VaultStore, fn func(v *vaultHeader)) {
+	t.Helper()
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := parseVault(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn(v)
+	if b, err = json.Marshal(v); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.path, append(append([]byte{}, vaultMagic...), b...), secureFSPerm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVaultRoundTrip(t *testing.T) {
+	s := newTestVault(t, "vault")
+	if keys, err := s.Keys(); err != nil || len(keys) != 0 {
+		t.Fatalf("new chain has keys %v: %v", keys, err)
+	}
+	if err := s.SetItems([]keyring.Item{
+		{Key: "DB_PASSWORD", Data: []byte("hunter2")},
+		{Key: "API_TOKEN", Data: []byte("token"), Description: "ci"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, s, "API_TOKEN", "rotated")
+
+	s = newVaultStore("vault")
+	assertValue(t, s, "API_TOKEN", "rotated")
+	assertValue(t, s, "DB_PASSWORD", "hunter2")
+	if keys, err := s.Keys(); err != nil || !reflect.DeepEqual(keys, []string{"API_TOKEN", "DB_PASSWORD"}) {
+		t.Errorf("got keys %v: %v", keys, err)
+	}
+
+	if err := s.Remove("API_TOKEN"); err != nil {
+		t.Fatal(err)
+	}
+	s = newVaultStore("vault")
+	if _, err := s.Get("API_TOKEN"); !errors.Is(err, keyring.ErrKeyNotFound) {
+		t.Errorf("removed key: got %v, want ErrKeyNotFound", err)
+	}
+	if err := s.Remove("API_TOKEN"); !errors.Is(err, keyring.ErrKeyNotFound) {
+		t.Errorf("removing a missing key: got %v, want ErrKeyNotFound", err)
+	}
+	assertValue(t, s, "DB_PASSWORD", "hunter2")
+
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("hunter2")) {
+		t.Error("vault contains a value in the clear")
+	}
+}
+
+func TestVaultWrongPassword(t *testing.T) {
+	s := newTestVault(t, "vault")
+	mustSet(t, s, "A", "1")
+	before, err := os.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usePassword(t, "an incorrect password of some length")
+	s = newVaultStore("vault")
+	if _, err := s.Get("A"); !errors.Is(err, ErrVaultPassword) {
+		t.Errorf("get: got %v, want ErrVaultPassword", err)
+	}
+	if err := s.Set(keyring.Item{Key: "B", Data: []byte("2")}); !errors.Is(err, ErrVaultPassword) {
+		t.Errorf("set: got %v, want ErrVaultPassword", err)
+	}
+	if err := s.ChangePassword(rejectNewPassword(t)); !errors.Is(err, ErrVaultPassword) {
+		t.Errorf("passwd: got %v, want ErrVaultPassword", err)
+	}
+	if err := s.upgradeKDF(kdfParams{Time: 2, Memory: 8, Threads: 1}); !errors.Is(err, ErrVaultPassword) {
+		t.Errorf("upgrade: got %v, want ErrVaultPassword", err)
+	}
+
+	after, err := os.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("vault was written with an incorrect password")
+	}
+}
+
+func TestVaultChangePassword(t *testing.T) {
+	s := newTestVault(t, "vault")
+	mustSet(t, s, "A", "1")
+	mustSet(t, s, "B", "2")
+
+	next := "a new password which is long enough"
+	if err := s.ChangePassword(newPassword(next)); err != nil {
+		t.Fatal(err)
+	}
+	assertValue(t, s, "A", "1")
+
+	s = newVaultStore("vault")
+	if _, err := s.Get("A"); !errors.Is(err, ErrVaultPassword) {
+		t.Errorf("old password: got %v, want ErrVaultPassword", err)
+	}
+	usePassword(t, next)
+	s = newVaultStore("vault")
+	assertValue(t, s, "A", "1")
+	assertValue(t, s, "B", "2")
+}
+
+func TestVaultUpgradeKDF(t *testing.T) {
+	s := newTestVault(t, "vault")
+	mustSet(t, s, "A", "1")
+
+	viper.Set(VaultKDFTimeKey, 2)
+	params, err := newKDFParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.upgradeKDF(params); err != nil {
+		t.Fatal(err)
+	}
+	s = newVaultStore("vault")
+	assertValue(t, s, "A", "1")
+	if s.state.header.KDF.Time != params.Time || s.state.header.KDF.Memory != params.Memory {
+		t.Errorf("got key derivation %v, want %v", s.state.header.KDF, params)
+	}
+}
+
+func TestVaultTamperedHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(v *vaultHeader)
+		want error
+	}{
+		{"entry removed", func(v *vaultHeader) { v.Entries = v.Entries[1:] }, ErrVaultInvalid},
+		{"metadata changed", func(v *vaultHeader) { v.Entries[0].Description = "changed" }, ErrVaultInvalid},
+		{"values swapped", func(v *vaultHeader) {
+			v.Entries[0].Value, v.Entries[1].Value = v.Entries[1].Value, v.Entries[0].Value
+		}, ErrVaultInvalid},
+		{"weaker key derivation", func(v *vaultHeader) { v.KDF.Memory-- }, ErrVaultPassword},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestVault(t, "vault")
+			mustSet(t, s, "A", "1")
+			mustSet(t, s, "B", "2")
+			editVault(t, s, tt.edit)
+
+			s = newVaultStore("vault")
+			if _, err := s.Get("A"); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVaultInvalidKeyDerivation(t *testing.T) {
+	s := newTestVault(t, "vault")
+	mustSet(t, s, "A", "1")
+	editVault(t, s, func(v *vaultHeader) { v.KDF.Time = 0 })
+
+	s = newVaultStore("vault")
+	if _, err := s.Get("A"); err == nil {
+		t.Error("unlocked a vault with invalid key derivation parameters")
+	}
+}
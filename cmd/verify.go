@@ -0,0 +1,90 @@
+/*
+Copyright © 2022 Zander Hill <zander@xargs.io>
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rotisserie/eris"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify [keychain]",
+	Short: "Verify an age chain against its signed manifest",
+	Long: `
+	Verify that the files of an age chain match its signed manifest and that
+	the manifest has not been rolled back to an older version.
+
+	Reports files which were modified, removed or added outside of chain.
+	Exits non-zero when any discrepancy is found.
+
+	eg:
+	chain verify aws-creds
+
+	# After reviewing the changes, sign the current contents
+	chain verify aws-creds --update
+`,
+	Args: cobra.ExactArgs(1),
+	PreRun: lockChainPreRun(func() lockMode {
+		if verifyUpdate {
+			return lockExclusive
+		}
+		return lockShared
+	}),
+	PostRun: unlockChainPostRun,
+	Run: func(cmd *cobra.Command, args []string) {
+		chain := args[0]
+
+		ok, err := verify(chain)
+		if err != nil {
+			log.Fatal().Msgf(eris.ToString(err, true))
+		}
+		if !ok {
+			os.Exit(1)
+		}
+	},
+}
+
+var verifyUpdate bool
+
+func init() {
+	verifyCmd.Flags().BoolVar(&verifyUpdate, "update", false, "sign the current contents of the chain as a new manifest version")
+	RootCmd.AddCommand(verifyCmd)
+}
+
+// integrityVerifier is implemented by stores which keep a chain manifest
+type integrityVerifier interface {
+	VerifyIntegrity() (manifestReport, error)
+	UpdateManifest() error
+}
+
+func verify(chain string) (bool, error) {
+	store, err := NewStore(chain)
+	if err != nil {
+		return false, eris.Wrapf(err, "Unable to open keyring for chain: %+v", chain)
+	}
+
+	verifier, ok := store.(integrityVerifier)
+	if !ok {
+		return false, eris.Errorf("verify is only supported for AGE backends, not %s", store.Name())
+	}
+
+	if verifyUpdate {
+		if err := verifier.UpdateManifest(); err != nil {
+			return false, err
+		}
+	}
+
+	report, err := verifier.VerifyIntegrity()
+	if err != nil {
+		return false, err
+	}
+	fmt.Println(report.String())
+
+	return report.OK(), nil
+}
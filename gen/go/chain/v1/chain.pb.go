@@ -30,6 +30,8 @@ const (
 	StorageType_STORAGE_TYPE_KEYCHAIN_BY_PLATFORM StorageType = 3
 	StorageType_STORAGE_TYPE_AGE_STORE            StorageType = 4
 	StorageType_STORAGE_TYPE_AGE_OTP_STORE        StorageType = 5
+	// Single bbolt database file per chain with encrypted names and values
+	StorageType_STORAGE_TYPE_BOLT_STORE StorageType = 6
 )
 
 // Enum value maps for StorageType.
@@ -41,6 +43,7 @@ var (
 		3: "STORAGE_TYPE_KEYCHAIN_BY_PLATFORM",
 		4: "STORAGE_TYPE_AGE_STORE",
 		5: "STORAGE_TYPE_AGE_OTP_STORE",
+		6: "STORAGE_TYPE_BOLT_STORE",
 	}
 	StorageType_value = map[string]int32{
 		"STORAGE_TYPE_UNSPECIFIED":            0,
@@ -49,6 +52,7 @@ var (
 		"STORAGE_TYPE_KEYCHAIN_BY_PLATFORM":   3,
 		"STORAGE_TYPE_AGE_STORE":              4,
 		"STORAGE_TYPE_AGE_OTP_STORE":          5,
+		"STORAGE_TYPE_BOLT_STORE":             6,
 	}
 )
 
@@ -210,7 +214,7 @@ var file_chain_v1_chain_proto_rawDesc = []byte{
 	0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x2a,
 	0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x14, 0x2e,
 	0x63, 0x68, 0x61, 0x69, 0x6e, 0x2e, 0x76, 0x31, 0x2e, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x45, 0x6e,
-	0x74, 0x72, 0x79, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x2a, 0xd8,
+	0x74, 0x72, 0x79, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x2a, 0xf5,
 	0x01, 0x0a, 0x0b, 0x53, 0x74, 0x6f, 0x72, 0x61, 0x67, 0x65, 0x54, 0x79, 0x70, 0x65, 0x12, 0x1c,
 	0x0a, 0x18, 0x53, 0x54, 0x4f, 0x52, 0x41, 0x47, 0x45, 0x5f, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x55,
 	0x4e, 0x53, 0x50, 0x45, 0x43, 0x49, 0x46, 0x49, 0x45, 0x44, 0x10, 0x00, 0x12, 0x1f, 0x0a, 0x1b,
@@ -224,12 +228,13 @@ var file_chain_v1_chain_proto_rawDesc = []byte{
 	0x16, 0x53, 0x54, 0x4f, 0x52, 0x41, 0x47, 0x45, 0x5f, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x41, 0x47,
 	0x45, 0x5f, 0x53, 0x54, 0x4f, 0x52, 0x45, 0x10, 0x04, 0x12, 0x1e, 0x0a, 0x1a, 0x53, 0x54, 0x4f,
 	0x52, 0x41, 0x47, 0x45, 0x5f, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x41, 0x47, 0x45, 0x5f, 0x4f, 0x54,
-	0x50, 0x5f, 0x53, 0x54, 0x4f, 0x52, 0x45, 0x10, 0x05, 0x32, 0x10, 0x0a, 0x0e, 0x53, 0x74, 0x6f,
-	0x72, 0x61, 0x67, 0x65, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x42, 0x2e, 0x5a, 0x2c, 0x67,
-	0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x7a, 0x70, 0x68, 0x2f, 0x63, 0x68,
-	0x61, 0x69, 0x6e, 0x2f, 0x67, 0x65, 0x6e, 0x2f, 0x67, 0x6f, 0x2f, 0x63, 0x68, 0x61, 0x69, 0x6e,
-	0x2f, 0x76, 0x31, 0x3b, 0x63, 0x68, 0x61, 0x69, 0x6e, 0x76, 0x31, 0x62, 0x06, 0x70, 0x72, 0x6f,
-	0x74, 0x6f, 0x33,
+	0x50, 0x5f, 0x53, 0x54, 0x4f, 0x52, 0x45, 0x10, 0x05, 0x12, 0x1b, 0x0a, 0x17, 0x53, 0x54, 0x4f,
+	0x52, 0x41, 0x47, 0x45, 0x5f, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x42, 0x4f, 0x4c, 0x54, 0x5f, 0x53,
+	0x54, 0x4f, 0x52, 0x45, 0x10, 0x06, 0x32, 0x10, 0x0a, 0x0e, 0x53, 0x74, 0x6f, 0x72, 0x61, 0x67,
+	0x65, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x42, 0x2e, 0x5a, 0x2c, 0x67, 0x69, 0x74, 0x68,
+	0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x7a, 0x70, 0x68, 0x2f, 0x63, 0x68, 0x61, 0x69, 0x6e,
+	0x2f, 0x67, 0x65, 0x6e, 0x2f, 0x67, 0x6f, 0x2f, 0x63, 0x68, 0x61, 0x69, 0x6e, 0x2f, 0x76, 0x31,
+	0x3b, 0x63, 0x68, 0x61, 0x69, 0x6e, 0x76, 0x31, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (